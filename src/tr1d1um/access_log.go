@@ -0,0 +1,419 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	accessLogKey = "accessLog"
+
+	defaultAccessLogMaxBodySize = 4096
+	defaultRedactionReplacement = "[REDACTED]"
+)
+
+//Fields the access log can be configured with
+const (
+	AccessFieldRequestAddress  = "requestAddress"
+	AccessFieldRequestURLPath  = "requestURLPath"
+	AccessFieldRequestURLQuery = "requestURLQuery"
+	AccessFieldRequestMethod   = "requestMethod"
+	AccessFieldRequestHeaders  = "requestHeaders"
+	AccessFieldRequestBody     = "requestBody"
+	AccessFieldResponseHeaders = "responseHeaders"
+	AccessFieldResponseCode    = "responseCode"
+	AccessFieldResponseError   = "responseError"
+	AccessFieldResponseSize    = "responseSize"
+	AccessFieldLatency         = "latency"
+	AccessFieldTID             = "tid"
+	AccessFieldSatClientID     = "satClientID"
+	AccessFieldCaller          = "caller"
+	AccessFieldUserAgent       = "userAgent"
+	AccessFieldCommand         = "command"
+	AccessFieldNames           = "names"
+	AccessFieldDeviceID        = "deviceID"
+	AccessFieldService         = "service"
+	AccessFieldAttempts        = "attempts"
+)
+
+var accessFields = map[string]struct{}{
+	AccessFieldRequestAddress: {}, AccessFieldRequestURLPath: {}, AccessFieldRequestURLQuery: {},
+	AccessFieldRequestMethod: {}, AccessFieldRequestHeaders: {}, AccessFieldRequestBody: {},
+	AccessFieldResponseHeaders: {}, AccessFieldResponseCode: {}, AccessFieldResponseError: {},
+	AccessFieldResponseSize: {}, AccessFieldLatency: {}, AccessFieldTID: {}, AccessFieldSatClientID: {},
+	AccessFieldCaller: {}, AccessFieldUserAgent: {}, AccessFieldCommand: {}, AccessFieldNames: {},
+	AccessFieldDeviceID: {}, AccessFieldService: {}, AccessFieldAttempts: {},
+}
+
+//defaultAccessFields are the fields logged when none are configured, the same bookkeepingLog logs
+var defaultAccessFields = []string{
+	AccessFieldRequestAddress, AccessFieldRequestURLPath, AccessFieldRequestURLQuery, AccessFieldRequestMethod,
+	AccessFieldResponseHeaders, AccessFieldResponseCode, AccessFieldResponseError, AccessFieldLatency,
+	AccessFieldTID, AccessFieldSatClientID,
+}
+
+//sensitiveHeaders are always redacted, whatever the redaction rules say
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+var (
+	errUnknownAccessField = errors.New("unknown access log field")
+	errBadSampleRate      = errors.New("access log sample rates must be between 0 and 1")
+)
+
+//RedactionRule replaces what Pattern matches, or the whole value if no Pattern is given, with Replacement.
+//A rule applies to the values of Header if it is set, else to Field, else to every field
+type RedactionRule struct {
+	Field       string `json:"field"`
+	Header      string `json:"header"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+//AccessLogConfig defines the accessLog section of the configuration file
+type AccessLogConfig struct {
+	Fields []string `json:"fields"`
+
+	// SuccessSampleRate and ErrorSampleRate are the fractions of the requests, answered with a status code
+	// under 400 and from 400 on respectively, that get logged
+	SuccessSampleRate float64 `json:"successSampleRate"`
+	ErrorSampleRate   float64 `json:"errorSampleRate"`
+
+	// Headers lists the request and response headers that get logged. Every header is logged if it is empty
+	Headers []string `json:"headers"`
+
+	// MaxBodySize caps the bytes of the request body that get logged
+	MaxBodySize int `json:"maxBodySize"`
+
+	Redact []RedactionRule `json:"redact"`
+
+	// Output, if set, sends the access log to its own rotating file instead of the application log
+	Output *logging.Options `json:"output"`
+}
+
+//defaultAccessLogConfig returns the settings used for anything the accessLog section leaves out
+func defaultAccessLogConfig() AccessLogConfig {
+	return AccessLogConfig{
+		SuccessSampleRate: 1,
+		ErrorSampleRate:   1,
+		MaxBodySize:       defaultAccessLogMaxBodySize,
+	}
+}
+
+//redaction is a compiled RedactionRule
+type redaction struct {
+	RedactionRule
+	pattern *regexp.Regexp
+}
+
+func (r *redaction) apply(value string) string {
+	if r.pattern == nil {
+		return r.Replacement
+	}
+	return r.pattern.ReplaceAllString(value, r.Replacement)
+}
+
+//AccessLogger logs the configured fields of a sample of the requests tr1d1um handles
+type AccessLogger struct {
+	Fields            []string
+	SuccessSampleRate float64
+	ErrorSampleRate   float64
+	MaxBodySize       int
+	log.Logger
+
+	headers    map[string]struct{}
+	redactions []*redaction
+	logBody    bool
+	random     func() float64
+}
+
+//NewAccessLogger builds the AccessLogger described by the given configuration
+func NewAccessLogger(config AccessLogConfig, logger log.Logger) (accessLogger *AccessLogger, err error) {
+	if config.SuccessSampleRate < 0 || config.SuccessSampleRate > 1 || config.ErrorSampleRate < 0 || config.ErrorSampleRate > 1 {
+		return nil, errBadSampleRate
+	}
+
+	if len(config.Fields) == 0 {
+		config.Fields = defaultAccessFields
+	}
+
+	if config.Output != nil {
+		logger = logging.New(config.Output)
+	}
+
+	accessLogger = &AccessLogger{
+		Fields:            config.Fields,
+		SuccessSampleRate: config.SuccessSampleRate,
+		ErrorSampleRate:   config.ErrorSampleRate,
+		MaxBodySize:       config.MaxBodySize,
+		Logger:            logger,
+		random:            rand.Float64,
+	}
+
+	for _, field := range config.Fields {
+		if _, ok := accessFields[field]; !ok {
+			return nil, fmt.Errorf("%s: %s", errUnknownAccessField, field)
+		}
+		accessLogger.logBody = accessLogger.logBody || field == AccessFieldRequestBody
+	}
+
+	if len(config.Headers) > 0 {
+		accessLogger.headers = map[string]struct{}{}
+		for _, header := range config.Headers {
+			accessLogger.headers[http.CanonicalHeaderKey(header)] = struct{}{}
+		}
+	}
+
+	for _, header := range sensitiveHeaders {
+		config.Redact = append(config.Redact, RedactionRule{Header: header})
+	}
+
+	for _, rule := range config.Redact {
+		r := &redaction{RedactionRule: rule}
+		r.Header = http.CanonicalHeaderKey(r.Header)
+
+		if r.Replacement == "" {
+			r.Replacement = defaultRedactionReplacement
+		}
+
+		if r.Pattern != "" {
+			if r.pattern, err = regexp.Compile(r.Pattern); err != nil {
+				return nil, err
+			}
+		}
+		accessLogger.redactions = append(accessLogger.redactions, r)
+	}
+	return
+}
+
+//accessRecord collects, while a request is handled, what only the handlers know about it
+type accessRecord struct {
+	body          []byte
+	tid           string
+	satClientID   string
+	caller        string
+	command       string
+	names         []string
+	attempts      int
+	responseError error
+}
+
+type accessRecordKey struct{}
+
+//accessRecordFrom returns the record of the request the given context belongs to, if the access log is on
+func accessRecordFrom(ctx context.Context) (record *accessRecord, ok bool) {
+	record, ok = ctx.Value(accessRecordKey{}).(*accessRecord)
+	return
+}
+
+//setAccessWDMP records the WDMP command the request carried out and the parameter names it involved
+func setAccessWDMP(ctx context.Context, command string, wdmp interface{}) {
+	if record, ok := accessRecordFrom(ctx); ok {
+		record.command, record.names = command, wdmpNames(wdmp)
+	}
+}
+
+//countAttempt records one more attempt at reaching the target on behalf of the request
+func countAttempt(ctx context.Context) {
+	if record, ok := accessRecordFrom(ctx); ok {
+		record.attempts++
+	}
+}
+
+//wdmpNames returns the parameter names, or table and row, the given WDMP involves
+func wdmpNames(wdmp interface{}) (names []string) {
+	switch w := wdmp.(type) {
+	case *GetWDMP:
+		names = w.Names
+	case *SetWDMP:
+		for _, parameter := range w.Parameters {
+			if parameter.Name != nil {
+				names = append(names, *parameter.Name)
+			}
+		}
+	case *AddRowWDMP:
+		names = []string{w.Table}
+	case *ReplaceRowsWDMP:
+		names = []string{w.Table}
+	case *DeleteRowWDMP:
+		names = []string{w.Row}
+	}
+	return
+}
+
+//accessRecorder remembers the status code and the size of the response written through it
+type accessRecorder struct {
+	statusRecorder
+	size int
+}
+
+func (a *accessRecorder) Write(b []byte) (n int, err error) {
+	n, err = a.statusRecorder.Write(b)
+	a.size += n
+	return
+}
+
+//Decorate logs the requests reaching the given handler once they are answered. It should come first in the chain
+//so that the requests turned down on the way are logged as well
+func (a *AccessLogger) Decorate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		start, record := time.Now(), new(accessRecord)
+
+		if a.logBody && req.Body != nil {
+			record.body = a.peekBody(req)
+		}
+
+		recorder := &accessRecorder{statusRecorder: statusRecorder{ResponseWriter: origin, code: http.StatusOK}}
+		delegate.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), accessRecordKey{}, record)))
+
+		if a.sampled(recorder.code) {
+			a.log(req, recorder, record, time.Since(start))
+		}
+	})
+}
+
+//peekBody reads up to MaxBodySize bytes of the request body and puts them back for the handler to read
+func (a *AccessLogger) peekBody(req *http.Request) []byte {
+	body, _ := ioutil.ReadAll(io.LimitReader(req.Body, int64(a.MaxBodySize)))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	return body
+}
+
+//sampled decides whether a request answered with the given status code gets logged
+func (a *AccessLogger) sampled(code int) bool {
+	rate := a.SuccessSampleRate
+	if code >= http.StatusBadRequest {
+		rate = a.ErrorSampleRate
+	}
+	return rate >= 1 || a.random() < rate
+}
+
+//log writes the configured fields of the given request
+func (a *AccessLogger) log(req *http.Request, recorder *accessRecorder, record *accessRecord, latency time.Duration) {
+	keyvals := []interface{}{logging.MessageKey(), "Bookkeeping response"}
+
+	for _, field := range a.Fields {
+		var value interface{}
+
+		switch field {
+		case AccessFieldRequestAddress:
+			value = a.redact(field, req.RemoteAddr)
+		case AccessFieldRequestURLPath:
+			value = a.redact(field, req.URL.Path)
+		case AccessFieldRequestURLQuery:
+			value = a.redact(field, req.URL.RawQuery)
+		case AccessFieldRequestMethod:
+			value = req.Method
+		case AccessFieldRequestHeaders:
+			value = a.filterHeaders(field, req.Header)
+		case AccessFieldRequestBody:
+			value = a.redact(field, string(record.body))
+		case AccessFieldResponseHeaders:
+			value = a.filterHeaders(field, recorder.Header())
+		case AccessFieldResponseCode:
+			value = recorder.code
+		case AccessFieldResponseError:
+			if value = record.responseError; record.responseError != nil {
+				value = a.redact(field, record.responseError.Error())
+			}
+		case AccessFieldResponseSize:
+			value = recorder.size
+		case AccessFieldLatency:
+			value = latency
+		case AccessFieldTID:
+			if value = record.tid; record.tid == "" {
+				value = recorder.Header().Get(HeaderWPATID)
+			}
+		case AccessFieldSatClientID:
+			if value = record.satClientID; record.satClientID == "" {
+				value = "N/A"
+			}
+		case AccessFieldCaller:
+			if value = record.caller; record.caller == "" {
+				value = ClientIdentity(req)
+			}
+		case AccessFieldUserAgent:
+			value = a.redact(field, req.UserAgent())
+		case AccessFieldCommand:
+			value = record.command
+		case AccessFieldNames:
+			names := make([]string, len(record.names))
+			for i, name := range record.names {
+				names[i] = a.redact(field, name)
+			}
+			value = names
+		case AccessFieldDeviceID:
+			value = a.redact(field, mux.Vars(req)["deviceid"])
+		case AccessFieldService:
+			value = mux.Vars(req)["service"]
+		case AccessFieldAttempts:
+			value = record.attempts
+		}
+
+		keyvals = append(keyvals, field, value)
+	}
+
+	logging.Info(a).Log(keyvals...)
+}
+
+//redact applies the rules that concern the given field to the given value
+func (a *AccessLogger) redact(field, value string) string {
+	for _, r := range a.redactions {
+		if r.Header == "" && (r.Field == "" || r.Field == field) {
+			value = r.apply(value)
+		}
+	}
+	return value
+}
+
+//filterHeaders returns the allowed headers out of the given ones, with the rules that concern them applied
+func (a *AccessLogger) filterHeaders(field string, headers http.Header) http.Header {
+	filtered := http.Header{}
+
+	for name, values := range headers {
+		if _, allowed := a.headers[name]; a.headers != nil && !allowed {
+			continue
+		}
+
+		for _, value := range values {
+			for _, r := range a.redactions {
+				if r.Header == name || (r.Header == "" && (r.Field == "" || r.Field == field)) {
+					value = r.apply(value)
+				}
+			}
+			filtered.Add(name, value)
+		}
+	}
+	return filtered
+}
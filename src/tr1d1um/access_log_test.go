@@ -0,0 +1,234 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+//captureLogger keeps the key values of every entry logged through it
+type captureLogger struct {
+	lock    sync.Mutex
+	entries []map[string]interface{}
+}
+
+func (c *captureLogger) Log(keyvals ...interface{}) error {
+	entry := map[string]interface{}{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		entry[keyvals[i].(string)] = keyvals[i+1]
+	}
+
+	c.lock.Lock()
+	c.entries = append(c.entries, entry)
+	c.lock.Unlock()
+	return nil
+}
+
+func serveAccessLogged(accessLogger *AccessLogger, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Handle("/device/{deviceid}/{service}", accessLogger.Decorate(handler))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestNewAccessLogger(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		assert := assert.New(t)
+		accessLogger, err := NewAccessLogger(defaultAccessLogConfig(), logging.DefaultLogger())
+
+		assert.Nil(err)
+		assert.EqualValues(defaultAccessFields, accessLogger.Fields)
+		assert.Nil(accessLogger.headers)
+		assert.Len(accessLogger.redactions, len(sensitiveHeaders))
+		assert.False(accessLogger.logBody)
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		config := defaultAccessLogConfig()
+		config.Fields = []string{AccessFieldTID, "wut"}
+
+		_, err := NewAccessLogger(config, logging.DefaultLogger())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("BadSampleRate", func(t *testing.T) {
+		config := defaultAccessLogConfig()
+		config.ErrorSampleRate = 2
+
+		_, err := NewAccessLogger(config, logging.DefaultLogger())
+		assert.EqualValues(t, errBadSampleRate, err)
+	})
+
+	t.Run("BadPattern", func(t *testing.T) {
+		config := defaultAccessLogConfig()
+		config.Redact = []RedactionRule{{Pattern: "("}}
+
+		_, err := NewAccessLogger(config, logging.DefaultLogger())
+		assert.NotNil(t, err)
+	})
+}
+
+func TestAccessLoggerDecorate(t *testing.T) {
+	t.Run("Fields", func(t *testing.T) {
+		assert := assert.New(t)
+		logger := new(captureLogger)
+
+		config := defaultAccessLogConfig()
+		config.Fields = []string{AccessFieldRequestBody, AccessFieldRequestHeaders, AccessFieldResponseSize, AccessFieldCommand,
+			AccessFieldNames, AccessFieldDeviceID, AccessFieldService, AccessFieldAttempts, AccessFieldTID, AccessFieldCaller}
+		config.Headers = []string{"authorization", "X-Allowed"}
+		config.Redact = []RedactionRule{{Field: AccessFieldRequestBody, Pattern: `"value":"[^"]*"`, Replacement: `"value":"***"`}}
+
+		accessLogger, err := NewAccessLogger(config, logger)
+		assert.Nil(err)
+
+		body := `{"parameters":[{"name":"Device.Password","value":"secret"}]}`
+		req := httptest.NewRequest(http.MethodPatch, "/device/mac:112233445566/config", strings.NewReader(body))
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		req.Header.Set("X-Allowed", "yes")
+		req.Header.Set("X-Other", "no")
+
+		recorder := serveAccessLogged(accessLogger, func(origin http.ResponseWriter, req *http.Request) {
+			read, _ := ioutil.ReadAll(req.Body)
+			assert.EqualValues(body, string(read))
+
+			name := "Device.Password"
+			setAccessWDMP(req.Context(), CommandSet, &SetWDMP{Command: CommandSet, Parameters: []SetParam{{Name: &name}}})
+			countAttempt(req.Context())
+			countAttempt(req.Context())
+
+			bookkeepingLog(logging.DefaultLogger(), Tr1d1umResponse{}.New(), req, 0, "tid")
+			origin.Write([]byte("hello"))
+		}, req)
+
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.Len(logger.entries, 1)
+
+		entry := logger.entries[0]
+		assert.EqualValues(`{"parameters":[{"name":"Device.Password","value":"***"}]}`, entry[AccessFieldRequestBody])
+		assert.EqualValues(http.Header{"Authorization": {defaultRedactionReplacement}, "X-Allowed": {"yes"}}, entry[AccessFieldRequestHeaders])
+		assert.EqualValues(5, entry[AccessFieldResponseSize])
+		assert.EqualValues(CommandSet, entry[AccessFieldCommand])
+		assert.EqualValues([]string{"Device.Password"}, entry[AccessFieldNames])
+		assert.EqualValues("mac:112233445566", entry[AccessFieldDeviceID])
+		assert.EqualValues("config", entry[AccessFieldService])
+		assert.EqualValues(2, entry[AccessFieldAttempts])
+		assert.EqualValues("tid", entry[AccessFieldTID])
+		assert.EqualValues("basic:user", entry[AccessFieldCaller])
+	})
+
+	t.Run("Sampling", func(t *testing.T) {
+		assert := assert.New(t)
+		logger := new(captureLogger)
+
+		config := defaultAccessLogConfig()
+		config.SuccessSampleRate, config.ErrorSampleRate = 0.5, 1
+
+		accessLogger, err := NewAccessLogger(config, logger)
+		assert.Nil(err)
+		accessLogger.random = func() float64 { return 0.7 }
+
+		for _, code := range []int{http.StatusOK, http.StatusBadRequest, http.StatusOK} {
+			req := httptest.NewRequest(http.MethodGet, "/device/mac:112233445566/config", nil)
+			serveAccessLogged(accessLogger, func(origin http.ResponseWriter, _ *http.Request) {
+				origin.WriteHeader(code)
+			}, req)
+		}
+
+		assert.Len(logger.entries, 1)
+		assert.EqualValues(http.StatusBadRequest, logger.entries[0][AccessFieldResponseCode])
+
+		accessLogger.random = func() float64 { return 0.2 }
+		serveAccessLogged(accessLogger, func(http.ResponseWriter, *http.Request) {},
+			httptest.NewRequest(http.MethodGet, "/device/mac:112233445566/config", nil))
+
+		assert.Len(logger.entries, 2)
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		assert := assert.New(t)
+		accessLogger, _ := NewAccessLogger(defaultAccessLogConfig(), log.NewNopLogger())
+
+		recorder := serveAccessLogged(accessLogger, func(origin http.ResponseWriter, _ *http.Request) {
+			flusher, ok := origin.(http.Flusher)
+			assert.True(ok)
+			flusher.Flush()
+		}, httptest.NewRequest(http.MethodGet, "/device/mac:112233445566/config", nil))
+
+		assert.True(recorder.Flushed)
+	})
+}
+
+func TestBookkeepingLogWithoutAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	logger := new(captureLogger)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	bookkeepingLog(logger, Tr1d1umResponse{}.New(), req, 0, "tid")
+
+	assert.Len(logger.entries, 1)
+	assert.EqualValues("tid", logger.entries[0]["tid"])
+}
+
+func TestWDMPNames(t *testing.T) {
+	assert := assert.New(t)
+	name := "Device.Name"
+
+	assert.EqualValues([]string{"a", "b"}, wdmpNames(&GetWDMP{Names: []string{"a", "b"}}))
+	assert.EqualValues([]string{name}, wdmpNames(&SetWDMP{Parameters: []SetParam{{Name: &name}, {}}}))
+	assert.EqualValues([]string{"table"}, wdmpNames(&AddRowWDMP{Table: "table"}))
+	assert.EqualValues([]string{"table"}, wdmpNames(&ReplaceRowsWDMP{Table: "table"}))
+	assert.EqualValues([]string{"row"}, wdmpNames(&DeleteRowWDMP{Row: "row"}))
+	assert.Nil(wdmpNames(nil))
+}
+
+func TestSetUpAccessLogger(t *testing.T) {
+	t.Run("NotConfigured", func(t *testing.T) {
+		accessLogger, err := SetUpAccessLogger(viper.New(), logging.DefaultLogger())
+		assert.Nil(t, accessLogger)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		assert := assert.New(t)
+		v := viper.New()
+		v.SetConfigType("json")
+		assert.Nil(v.ReadConfig(bytes.NewBufferString(`{"accessLog": {"fields": ["tid", "attempts"], "errorSampleRate": 0.25}}`)))
+
+		accessLogger, err := SetUpAccessLogger(v, logging.DefaultLogger())
+		assert.Nil(err)
+		assert.EqualValues([]string{AccessFieldTID, AccessFieldAttempts}, accessLogger.Fields)
+		assert.EqualValues(1, accessLogger.SuccessSampleRate)
+		assert.EqualValues(0.25, accessLogger.ErrorSampleRate)
+		assert.EqualValues(defaultAccessLogMaxBodySize, accessLogger.MaxBodySize)
+	})
+}
@@ -0,0 +1,436 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/spf13/viper"
+)
+
+const (
+	circuitBreakerKey  = "circuitBreaker"
+	defaultBreakerName = "default"
+
+	defaultBreakerWindow           = "60s"
+	defaultBreakerBuckets          = 10
+	defaultBreakerMinRequests      = 20
+	defaultBreakerFailureRatio     = 0.5
+	defaultBreakerOpenDuration     = "30s"
+	defaultBreakerHalfOpenRequests = 1
+)
+
+//Circuit breaker states
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+var (
+	errCircuitOpen = errors.New("circuit breaker is open")
+
+	errBreakerWindow           = errors.New("circuitBreaker: window must be at least one nanosecond per bucket")
+	errBreakerOpenDuration     = errors.New("circuitBreaker: openDuration must be positive")
+	errBreakerHalfOpenRequests = errors.New("circuitBreaker: halfOpenRequests must be at least 1")
+	errBreakerMinRequests      = errors.New("circuitBreaker: minRequests must be at least 1")
+	errBreakerFailureRatio     = errors.New("circuitBreaker: failureRatio must be above 0 and at most 1")
+)
+
+//BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+//MarshalJSON writes the state by name
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+//CircuitBreakerConfig defines the circuitBreaker section of the configuration file
+type CircuitBreakerConfig struct {
+	Window           string  `json:"window"`
+	Buckets          int     `json:"buckets"`
+	MinRequests      int     `json:"minRequests"`
+	FailureRatio     float64 `json:"failureRatio"`
+	OpenDuration     string  `json:"openDuration"`
+	HalfOpenRequests int     `json:"halfOpenRequests"`
+}
+
+//breakerBucket counts the outcomes of the requests made during one slice of the rolling window
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+//BreakerTicket is handed out by Allow for every request it lets through. The outcome of the request only counts
+//if the breaker is still in the state, i.e. the generation, it was in when the request was allowed
+type BreakerTicket struct {
+	generation uint64
+}
+
+//BreakerMeasures are the metrics a CircuitBreaker reports its state changes to
+type BreakerMeasures struct {
+	State       metrics.Gauge
+	Transitions metrics.Counter
+	Rejected    metrics.Counter
+}
+
+//NewBreakerMeasures fetches the circuit breaker metrics out of the given registry
+func NewBreakerMeasures(registry xmetrics.Registry) *BreakerMeasures {
+	return &BreakerMeasures{
+		State:       registry.NewGauge(CircuitBreakerStateGauge),
+		Transitions: registry.NewCounter(CircuitBreakerTransitionsCounter),
+		Rejected:    registry.NewCounter(CircuitBreakerRejectedCounter),
+	}
+}
+
+//CircuitBreaker tracks the failures of the requests to a single target over a rolling window. Once too many of
+//them fail, it opens and rejects requests for OpenDuration. It then lets HalfOpenRequests probes through and
+//closes again only if they succeed
+type CircuitBreaker struct {
+	Name             string
+	Window           time.Duration
+	MinRequests      int
+	FailureRatio     float64
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+
+	measures   *BreakerMeasures
+	lock       sync.Mutex
+	state      BreakerState
+	generation uint64
+	openUntil  time.Time
+	probes     int
+	successes  int
+	buckets    []breakerBucket
+	now        func() time.Time
+}
+
+//BreakerStatus is a snapshot of a CircuitBreaker as reported by the admin endpoint
+type BreakerStatus struct {
+	Name      string       `json:"name"`
+	State     BreakerState `json:"state"`
+	Requests  int          `json:"requests"`
+	Failures  int          `json:"failures"`
+	OpenUntil *time.Time   `json:"openUntil,omitempty"`
+}
+
+//NewCircuitBreaker builds a closed CircuitBreaker out of the circuitBreaker section of the configuration file
+func NewCircuitBreaker(name string, v *viper.Viper, measures *BreakerMeasures) (breaker *CircuitBreaker, err error) {
+	config := CircuitBreakerConfig{
+		Window:           defaultBreakerWindow,
+		Buckets:          defaultBreakerBuckets,
+		MinRequests:      defaultBreakerMinRequests,
+		FailureRatio:     defaultBreakerFailureRatio,
+		OpenDuration:     defaultBreakerOpenDuration,
+		HalfOpenRequests: defaultBreakerHalfOpenRequests,
+	}
+
+	if err = v.UnmarshalKey(circuitBreakerKey, &config); err != nil {
+		return
+	}
+
+	window, err := time.ParseDuration(config.Window)
+	if err != nil {
+		return
+	}
+
+	openDuration, err := time.ParseDuration(config.OpenDuration)
+	if err != nil {
+		return
+	}
+
+	if config.Buckets < 1 {
+		config.Buckets = 1
+	}
+
+	switch {
+	case window < time.Duration(config.Buckets):
+		return nil, errBreakerWindow
+	case openDuration <= 0:
+		return nil, errBreakerOpenDuration
+	case config.HalfOpenRequests < 1:
+		return nil, errBreakerHalfOpenRequests
+	case config.MinRequests < 1:
+		return nil, errBreakerMinRequests
+	case config.FailureRatio <= 0 || config.FailureRatio > 1:
+		return nil, errBreakerFailureRatio
+	}
+
+	breaker = &CircuitBreaker{
+		Name:             name,
+		Window:           window,
+		MinRequests:      config.MinRequests,
+		FailureRatio:     config.FailureRatio,
+		OpenDuration:     openDuration,
+		HalfOpenRequests: config.HalfOpenRequests,
+		measures:         measures,
+		buckets:          make([]breakerBucket, config.Buckets),
+		now:              time.Now,
+	}
+
+	breaker.report()
+	return
+}
+
+//Allow returns true, along with the ticket the outcome has to be recorded with, if a request may go through.
+//If it may not, the time left until the breaker half-opens is returned instead
+func (b *CircuitBreaker) Allow() (ticket BreakerTicket, allowed bool, retryAfter time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	if b.state == BreakerOpen {
+		if now.Before(b.openUntil) {
+			b.reject()
+			return ticket, false, b.openUntil.Sub(now)
+		}
+		b.transition(BreakerHalfOpen)
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.HalfOpenRequests {
+			b.reject()
+			return ticket, false, b.OpenDuration
+		}
+		b.probes++
+	}
+
+	return BreakerTicket{generation: b.generation}, true, 0
+}
+
+//Record accounts for the outcome of a request that Allow let through. Outcomes of requests allowed before the
+//breaker last changed state are ignored
+func (b *CircuitBreaker) Record(ticket BreakerTicket, failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ticket.generation != b.generation {
+		return
+	}
+
+	now := b.now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.open(now)
+		} else if b.successes++; b.successes >= b.HalfOpenRequests {
+			b.transition(BreakerClosed)
+		}
+
+	case BreakerClosed:
+		bucket := b.bucket(now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+
+		if requests, failures := b.totals(now); requests >= b.MinRequests &&
+			float64(failures) >= b.FailureRatio*float64(requests) {
+			b.open(now)
+		}
+	}
+}
+
+//Abandon gives back the ticket of a request that ended without a real outcome, e.g. because its client went
+//away. A half-open breaker lets another probe through in its place
+func (b *CircuitBreaker) Abandon(ticket BreakerTicket) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ticket.generation == b.generation && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+//Status returns a snapshot of the breaker
+func (b *CircuitBreaker) Status() (status BreakerStatus) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status.Name, status.State = b.Name, b.state
+	status.Requests, status.Failures = b.totals(b.now())
+
+	if b.state == BreakerOpen {
+		openUntil := b.openUntil
+		status.OpenUntil = &openUntil
+	}
+	return
+}
+
+func (b *CircuitBreaker) open(now time.Time) {
+	b.openUntil = now.Add(b.OpenDuration)
+	b.transition(BreakerOpen)
+}
+
+func (b *CircuitBreaker) transition(state BreakerState) {
+	b.state, b.probes, b.successes = state, 0, 0
+	b.generation++
+	if state == BreakerClosed {
+		for i := range b.buckets {
+			b.buckets[i] = breakerBucket{}
+		}
+	}
+
+	if b.measures != nil {
+		b.measures.Transitions.With("service", b.Name, "state", state.String()).Add(1)
+	}
+	b.report()
+}
+
+func (b *CircuitBreaker) report() {
+	if b.measures != nil {
+		b.measures.State.With("service", b.Name).Set(float64(b.state))
+	}
+}
+
+func (b *CircuitBreaker) reject() {
+	if b.measures != nil {
+		b.measures.Rejected.With("service", b.Name).Add(1)
+	}
+}
+
+//bucket returns the bucket of the rolling window the given time falls in, recycling it if it is stale
+func (b *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := b.Window / time.Duration(len(b.buckets))
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%int64(len(b.buckets))]
+
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+//totals sums up the buckets that are still within the rolling window
+func (b *CircuitBreaker) totals(now time.Time) (requests, failures int) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.Window {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return
+}
+
+//BreakerSendAndHandle is a SendAndHandle that guards the target behind another one with a CircuitBreaker
+type BreakerSendAndHandle struct {
+	SendAndHandle
+	Breaker *CircuitBreaker
+}
+
+//MakeRequest fails fast with a 503 and a Retry-After header while the breaker is open. Otherwise the request
+//is made and its outcome recorded, unless its client went away before it completed
+func (s *BreakerSendAndHandle) MakeRequest(ctx context.Context, requestArgs ...interface{}) (interface{}, error) {
+	ticket, allowed, retryAfter := s.Breaker.Allow()
+	if !allowed {
+		tr1Resp := Tr1d1umResponse{}.New()
+		WriteResponse("Service Unavailable", http.StatusServiceUnavailable, tr1Resp)
+		tr1Resp.Headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return tr1Resp, errCircuitOpen
+	}
+
+	tr1Resp, err := s.SendAndHandle.MakeRequest(ctx, requestArgs...)
+	if ctx.Err() != nil {
+		s.Breaker.Abandon(ticket)
+	} else {
+		s.Breaker.Record(ticket, isTargetFailure(ctx, tr1Resp, err))
+	}
+	return tr1Resp, err
+}
+
+//isTargetFailure returns true if the outcome of a request means the target is in trouble. Requests abandoned
+//by their own client do not count against the target
+func isTargetFailure(ctx context.Context, tr1Resp interface{}, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	if tr1Response, ok := tr1Resp.(*Tr1d1umResponse); ok {
+		switch tr1Response.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+//addCircuitBreakers wraps the sender of every route in a CircuitBreaker named after its service.
+//The route of the global targetURL is named default
+func addCircuitBreakers(v *viper.Viper, routes map[string]*ServiceRoute, registry xmetrics.Registry,
+	logger log.Logger) (breakers map[string]*CircuitBreaker, err error) {
+	measures := NewBreakerMeasures(registry)
+	breakers = make(map[string]*CircuitBreaker, len(routes))
+
+	for name, route := range routes {
+		if breakers[name], err = NewCircuitBreaker(name, v, measures); err != nil {
+			return
+		}
+		route.Sender = &BreakerSendAndHandle{SendAndHandle: route.Sender, Breaker: breakers[name]}
+	}
+
+	logging.Info(logger).Log(logging.MessageKey(), "circuit breakers enabled", "count", len(breakers))
+	return
+}
+
+//HandleCircuitBreakers lists the state of every circuit breaker
+func (ch *ConversionHandler) HandleCircuitBreakers(origin http.ResponseWriter, req *http.Request) {
+	statuses := make([]BreakerStatus, 0, len(ch.Breakers))
+	for _, breaker := range ch.Breakers {
+		statuses = append(statuses, breaker.Status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		origin.WriteHeader(http.StatusInternalServerError)
+		logging.Error(ch).Log(logging.ErrorKey(), err.Error())
+		return
+	}
+
+	origin.Header().Set(contentTypeKey, "application/json")
+	origin.Write(data)
+}
@@ -0,0 +1,233 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestCircuitBreaker(t *testing.T) (*CircuitBreaker, *time.Time) {
+	v := viper.New()
+	v.Set(circuitBreakerKey, map[string]interface{}{
+		"window":       "10s",
+		"minRequests":  2,
+		"failureRatio": 0.5,
+		"openDuration": "5s",
+	})
+
+	registry, _ := xmetrics.NewRegistry(nil, Metrics)
+	breaker, err := NewCircuitBreaker("test", v, NewBreakerMeasures(registry))
+	assert.Nil(t, err)
+
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	return breaker, &now
+}
+
+//request lets a request through the breaker, if allowed, and records its outcome
+func request(breaker *CircuitBreaker, failed bool) bool {
+	ticket, allowed, _ := breaker.Allow()
+	if allowed {
+		breaker.Record(ticket, failed)
+	}
+	return allowed
+}
+
+func TestNewCircuitBreakerInvalid(t *testing.T) {
+	testData := []struct {
+		name     string
+		config   map[string]interface{}
+		expected error
+	}{
+		{"ZeroWindow", map[string]interface{}{"window": "0s"}, errBreakerWindow},
+		{"WindowBelowBuckets", map[string]interface{}{"window": "5ns", "buckets": 10}, errBreakerWindow},
+		{"ZeroOpenDuration", map[string]interface{}{"openDuration": "0s"}, errBreakerOpenDuration},
+		{"NoHalfOpenRequests", map[string]interface{}{"halfOpenRequests": 0}, errBreakerHalfOpenRequests},
+		{"NoMinRequests", map[string]interface{}{"minRequests": 0}, errBreakerMinRequests},
+		{"ZeroFailureRatio", map[string]interface{}{"failureRatio": 0}, errBreakerFailureRatio},
+		{"FailureRatioAboveOne", map[string]interface{}{"failureRatio": 1.5}, errBreakerFailureRatio},
+	}
+
+	for _, record := range testData {
+		t.Run(record.name, func(t *testing.T) {
+			assert := assert.New(t)
+			v := viper.New()
+			v.Set(circuitBreakerKey, record.config)
+
+			breaker, err := NewCircuitBreaker("test", v, nil)
+			assert.Nil(breaker)
+			assert.EqualValues(record.expected, err)
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Opens", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, _ := newTestCircuitBreaker(t)
+
+		request(breaker, true)
+		assert.EqualValues(BreakerClosed, breaker.Status().State)
+
+		request(breaker, false)
+		assert.EqualValues(BreakerOpen, breaker.Status().State)
+
+		_, allowed, retryAfter := breaker.Allow()
+		assert.False(allowed)
+		assert.EqualValues(5*time.Second, retryAfter)
+	})
+
+	t.Run("RollingWindow", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, now := newTestCircuitBreaker(t)
+
+		request(breaker, true)
+		*now = now.Add(time.Minute)
+		request(breaker, false)
+
+		status := breaker.Status()
+		assert.EqualValues(BreakerClosed, status.State)
+		assert.EqualValues(1, status.Requests)
+		assert.EqualValues(0, status.Failures)
+	})
+
+	t.Run("HalfOpen", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, now := newTestCircuitBreaker(t)
+		request(breaker, true)
+		request(breaker, true)
+
+		*now = now.Add(6 * time.Second)
+		probe, allowed, _ := breaker.Allow()
+		assert.True(allowed)
+		assert.EqualValues(BreakerHalfOpen, breaker.Status().State)
+
+		_, allowed, _ = breaker.Allow()
+		assert.False(allowed)
+
+		breaker.Record(probe, false)
+		assert.EqualValues(BreakerClosed, breaker.Status().State)
+	})
+
+	t.Run("HalfOpenProbeFails", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, now := newTestCircuitBreaker(t)
+		request(breaker, true)
+		request(breaker, true)
+
+		*now = now.Add(6 * time.Second)
+		assert.True(request(breaker, true))
+		assert.EqualValues(BreakerOpen, breaker.Status().State)
+	})
+
+	t.Run("StaleOutcome", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, now := newTestCircuitBreaker(t)
+
+		//admitted while closed, completes only once the breaker is half-open
+		slow, _, _ := breaker.Allow()
+		request(breaker, true)
+		request(breaker, true)
+
+		*now = now.Add(6 * time.Second)
+		probe, allowed, _ := breaker.Allow()
+		assert.True(allowed)
+
+		breaker.Record(slow, false)
+		assert.EqualValues(BreakerHalfOpen, breaker.Status().State)
+		assert.EqualValues(1, breaker.probes)
+
+		breaker.Record(probe, false)
+		assert.EqualValues(BreakerClosed, breaker.Status().State)
+
+		//outcomes from before the breaker closed do not count either
+		breaker.Record(probe, true)
+		breaker.Record(slow, true)
+		assert.EqualValues(0, breaker.Status().Requests)
+	})
+
+	t.Run("AbandonedProbe", func(t *testing.T) {
+		assert := assert.New(t)
+		breaker, now := newTestCircuitBreaker(t)
+		request(breaker, true)
+		request(breaker, true)
+
+		*now = now.Add(6 * time.Second)
+		probe, _, _ := breaker.Allow()
+		breaker.Abandon(probe)
+		assert.EqualValues(BreakerHalfOpen, breaker.Status().State)
+
+		assert.True(request(breaker, false))
+		assert.EqualValues(BreakerClosed, breaker.Status().State)
+	})
+}
+
+func TestBreakerSendAndHandle(t *testing.T) {
+	breaker, _ := newTestCircuitBreaker(t)
+	sender := &BreakerSendAndHandle{SendAndHandle: mockSender, Breaker: breaker}
+
+	t.Run("RecordsFailures", func(t *testing.T) {
+		assert := assert.New(t)
+		timeout := Tr1d1umResponse{}.New()
+		timeout.Code = Tr1StatusTimeout
+
+		mockSender.On("MakeRequest", mock.Anything, mock.Anything).Return(timeout, errors.New("timeout")).Twice()
+
+		sender.MakeRequest(context.Background(), Tr1d1umRequest{})
+		sender.MakeRequest(context.Background(), Tr1d1umRequest{})
+		assert.EqualValues(BreakerOpen, breaker.Status().State)
+	})
+
+	t.Run("FailsFast", func(t *testing.T) {
+		assert := assert.New(t)
+		resp, err := sender.MakeRequest(context.Background(), Tr1d1umRequest{})
+
+		tr1Resp := resp.(*Tr1d1umResponse)
+		assert.EqualValues(errCircuitOpen, err)
+		assert.EqualValues(http.StatusServiceUnavailable, tr1Resp.Code)
+		assert.EqualValues("5", tr1Resp.Headers.Get("Retry-After"))
+		assert.False(ShouldRetryOnResponse(tr1Resp, err))
+	})
+}
+
+func TestHandleCircuitBreakers(t *testing.T) {
+	assert := assert.New(t)
+	breaker, _ := newTestCircuitBreaker(t)
+	ch := &ConversionHandler{Logger: logging.DefaultLogger(), Breakers: map[string]*CircuitBreaker{"test": breaker}}
+
+	recorder := httptest.NewRecorder()
+	ch.HandleCircuitBreakers(recorder, httptest.NewRequest(http.MethodGet, "http://someURL/admin/breakers", nil))
+
+	var statuses []map[string]interface{}
+	assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &statuses))
+	assert.Len(statuses, 1)
+	assert.EqualValues("test", statuses[0]["name"])
+	assert.EqualValues("closed", statuses[0]["state"])
+}
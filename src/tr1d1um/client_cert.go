@@ -0,0 +1,253 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/go-kit/kit/log"
+	"github.com/justinas/alice"
+)
+
+const clientCertAuthKey = "clientCertAuth"
+
+var (
+	errNoClientCertRules   = errors.New("clientCertAuth requires at least one rule")
+	errEmptyClientCertRule = errors.New("a clientCertAuth rule requires a subject or san pattern")
+	errBadCapability       = errors.New("capabilities must be of the form <path pattern>:<method|all>")
+)
+
+//ClientCertAuthConfig defines the clientCertAuth section of the configuration file
+type ClientCertAuthConfig struct {
+	// CAFile is a PEM bundle of the authorities client certificates must chain to. It is only needed when the
+	// server itself does not verify client certificates
+	CAFile string `json:"caFile"`
+
+	Rules []ClientCertRule `json:"rules"`
+}
+
+//ClientCertRule grants capabilities to the client certificates whose subject common name or any of whose
+//subject alternative names (DNS, email or IP) match the given patterns. A capability has the form
+//<path pattern>:<method|all>, e.g. "/api/v2/device/.*/stat:GET"
+type ClientCertRule struct {
+	Subject      string   `json:"subject"`
+	SAN          string   `json:"san"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type clientCertRule struct {
+	subject      *regexp.Regexp
+	san          *regexp.Regexp
+	capabilities []capability
+}
+
+type capability struct {
+	path   *regexp.Regexp
+	method string
+}
+
+//allows returns true if the capability covers the given request
+func (c capability) allows(method, path string) bool {
+	return (c.method == "all" || strings.EqualFold(c.method, method)) && c.path.MatchString(path)
+}
+
+//ClientCertValidator authenticates requests by their verified client certificate
+type ClientCertValidator struct {
+	roots *x509.CertPool
+	rules []clientCertRule
+}
+
+//NewClientCertValidator compiles the rules of the given configuration
+func NewClientCertValidator(config ClientCertAuthConfig) (validator *ClientCertValidator, err error) {
+	if len(config.Rules) == 0 {
+		return nil, errNoClientCertRules
+	}
+
+	validator = new(ClientCertValidator)
+
+	if config.CAFile != "" {
+		var bundle []byte
+		if bundle, err = ioutil.ReadFile(config.CAFile); err != nil {
+			return nil, err
+		}
+
+		validator.roots = x509.NewCertPool()
+		if !validator.roots.AppendCertsFromPEM(bundle) {
+			return nil, errNoCACertificates
+		}
+	}
+
+	for _, rule := range config.Rules {
+		if rule.Subject == "" && rule.SAN == "" {
+			return nil, errEmptyClientCertRule
+		}
+
+		compiled := clientCertRule{}
+
+		if rule.Subject != "" {
+			if compiled.subject, err = regexp.Compile("^" + rule.Subject + "$"); err != nil {
+				return nil, err
+			}
+		}
+
+		if rule.SAN != "" {
+			if compiled.san, err = regexp.Compile("^" + rule.SAN + "$"); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, c := range rule.Capabilities {
+			separator := strings.LastIndex(c, ":")
+			if separator <= 0 || separator == len(c)-1 {
+				return nil, errBadCapability
+			}
+
+			var path *regexp.Regexp
+			if path, err = regexp.Compile("^" + c[:separator] + "$"); err != nil {
+				return nil, err
+			}
+			compiled.capabilities = append(compiled.capabilities, capability{path: path, method: c[separator+1:]})
+		}
+
+		validator.rules = append(validator.rules, compiled)
+	}
+
+	return
+}
+
+//verifiedLeaf returns the client certificate of the given connection once it is known to be trusted
+func (v *ClientCertValidator) verifiedLeaf(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil {
+		return nil
+	}
+
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		return state.VerifiedChains[0][0]
+	}
+
+	if v.roots == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := state.PeerCertificates[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil
+	}
+	return leaf
+}
+
+//Identify returns the identity of the client behind the given connection and the capabilities of the first rule it
+//matches. Nothing is found if the connection carries no trusted client certificate or no rule matches it
+func (v *ClientCertValidator) Identify(state *tls.ConnectionState) (identity string, capabilities []capability, found bool) {
+	leaf := v.verifiedLeaf(state)
+	if leaf == nil {
+		return
+	}
+
+	sans := append([]string{}, leaf.DNSNames...)
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	for _, rule := range v.rules {
+		if rule.subject != nil && rule.subject.MatchString(leaf.Subject.CommonName) {
+			return leaf.Subject.CommonName, rule.capabilities, true
+		}
+
+		if rule.san != nil {
+			for _, san := range sans {
+				if rule.san.MatchString(san) {
+					return san, rule.capabilities, true
+				}
+			}
+		}
+	}
+	return
+}
+
+//ClientCertHandler lets requests with a recognized client certificate through on the strength of their capabilities.
+//Any other request goes through Fallback, the regular Authorization header checks
+type ClientCertHandler struct {
+	Validator *ClientCertValidator
+	Fallback  alice.Constructor
+	log.Logger
+}
+
+//Decorate wraps the given handler with the client certificate checks
+func (h ClientCertHandler) Decorate(delegate http.Handler) http.Handler {
+	fallback := delegate
+	if h.Fallback != nil {
+		fallback = h.Fallback(delegate)
+	}
+
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		identity, capabilities, found := h.Validator.Identify(req.TLS)
+		if !found {
+			fallback.ServeHTTP(origin, req)
+			return
+		}
+
+		for _, c := range capabilities {
+			if c.allows(req.Method, req.URL.Path) {
+				//prefixed, as basic auth users are, so that a certificate cannot pass for a JWT subject of the same name
+				ctx := handler.NewContextWithValue(req.Context(), &handler.ContextValues{
+					SatClientID: "cert:" + identity,
+					Method:      req.Method,
+					Path:        req.URL.Path,
+				})
+				delegate.ServeHTTP(origin, req.WithContext(withClientCertIdentity(ctx, identity)))
+				return
+			}
+		}
+
+		logging.Info(h).Log(logging.MessageKey(), "client certificate lacks the capability for the request",
+			"identity", identity, "method", req.Method, "path", req.URL.Path)
+		WriteResponseWriter("Forbidden", http.StatusForbidden, origin)
+	})
+}
+
+type clientCertIdentityKey struct{}
+
+func withClientCertIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, clientCertIdentityKey{}, identity)
+}
+
+//ClientCertIdentity returns the identity of the client certificate the request was authenticated by, if any
+func ClientCertIdentity(ctx context.Context) (identity string, ok bool) {
+	identity, ok = ctx.Value(clientCertIdentityKey{}).(string)
+	return
+}
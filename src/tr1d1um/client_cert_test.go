@@ -0,0 +1,130 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/stretchr/testify/assert"
+)
+
+//readTestCertificate parses the PEM certificate written by writeTestKeyPair
+func readTestCertificate(t *testing.T, certFile string) *x509.Certificate {
+	data, err := ioutil.ReadFile(certFile)
+	assert.Nil(t, err)
+
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	return cert
+}
+
+func TestNewClientCertValidator(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewClientCertValidator(ClientCertAuthConfig{})
+	assert.EqualValues(errNoClientCertRules, err)
+
+	_, err = NewClientCertValidator(ClientCertAuthConfig{Rules: []ClientCertRule{{Capabilities: []string{"/.*:all"}}}})
+	assert.EqualValues(errEmptyClientCertRule, err)
+
+	_, err = NewClientCertValidator(ClientCertAuthConfig{Rules: []ClientCertRule{{Subject: "svc", Capabilities: []string{"/.*"}}}})
+	assert.EqualValues(errBadCapability, err)
+
+	_, err = NewClientCertValidator(ClientCertAuthConfig{Rules: []ClientCertRule{{Subject: "(", Capabilities: []string{"/.*:all"}}}})
+	assert.NotNil(err)
+}
+
+func TestClientCertHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tr1d1um-client-cert")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	trustedFile, _ := writeTestKeyPair(t, dir, "stat-reader.svc")
+	untrustedFile, _ := writeTestKeyPair(t, dir, "stranger")
+
+	trusted := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{readTestCertificate(t, trustedFile)}}
+	untrusted := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{readTestCertificate(t, untrustedFile)}}
+
+	validator, err := NewClientCertValidator(ClientCertAuthConfig{
+		CAFile: trustedFile,
+		Rules: []ClientCertRule{
+			{SAN: `.*\.svc`, Capabilities: []string{"/api/v2/device/.*/stat:GET"}},
+		},
+	})
+	assert.Nil(t, err)
+
+	var satClientID string
+	fallbackCalls := 0
+
+	certHandler := ClientCertHandler{
+		Validator: validator,
+		Logger:    logging.DefaultLogger(),
+		Fallback: func(http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fallbackCalls++
+				w.WriteHeader(http.StatusForbidden)
+			})
+		},
+	}
+
+	decorated := certHandler.Decorate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if values, ok := handler.FromContext(r.Context()); ok {
+			satClientID = values.SatClientID
+		}
+	}))
+
+	serve := func(method, path string, state *tls.ConnectionState) int {
+		req := httptest.NewRequest(method, "https://tr1d1um"+path, nil)
+		req.TLS = state
+		recorder := httptest.NewRecorder()
+		decorated.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.EqualValues(http.StatusOK, serve(http.MethodGet, "/api/v2/device/mac:112233445566/stat", trusted))
+		assert.EqualValues("cert:stat-reader.svc", satClientID)
+	})
+
+	t.Run("MissingCapability", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := fallbackCalls
+		assert.EqualValues(http.StatusForbidden, serve(http.MethodPatch, "/api/v2/device/mac:112233445566/config", trusted))
+		assert.EqualValues(calls, fallbackCalls)
+	})
+
+	t.Run("FallsBack", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := fallbackCalls
+
+		serve(http.MethodGet, "/api/v2/device/mac:112233445566/stat", untrusted)
+		serve(http.MethodGet, "/api/v2/device/mac:112233445566/stat", nil)
+		assert.EqualValues(calls+2, fallbackCalls)
+	})
+}
@@ -23,11 +23,14 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/Comcast/webpa-common/device"
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/wrp"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 )
 
 //SendAndHandle wraps the methods to communicate both back to a requester and to a target server
@@ -41,16 +44,33 @@ type SendAndHandle interface {
 type Tr1SendAndHandle struct {
 	RespTimeout time.Duration
 	log.Logger
+	Endpoints *EndpointPool
+
+	//Locations, if set, caches the instances the routing tier redirects devices to
+	Locations    *LocationCache
+	MaxRedirects int
+
+	//Latency and DecodeFailures, if set, are reported to as requests complete
+	Latency        metrics.Histogram
+	DecodeFailures metrics.Counter
+
 	client *http.Client
 }
 
 //Tr1d1umRequest provides a clean way to store information needed to make some request (in our case, it is http but it is not
 // limited to that).
 type Tr1d1umRequest struct {
-	method  string
-	URL     string
-	body    []byte
-	headers http.Header
+	method      string
+	URL         string
+	body        []byte
+	headers     http.Header
+	rawResponse bool
+
+	//deviceID is the canonical ID of the device the request is meant for, if any
+	deviceID device.ID
+
+	//tried collects the endpoints previous attempts of this request went to so that retries can avoid them
+	tried map[string]struct{}
 }
 
 //GetBody is a handy function to provide the payload (body) of Tr1d1umRequest as a fresh reader
@@ -63,9 +83,36 @@ func (tr1Req *Tr1d1umRequest) GetBody() (body io.Reader) {
 
 //MakeRequest contains all the logic that actually performs an http request
 //It is tightly coupled with HandleResponse
-func (tr1 *Tr1SendAndHandle) MakeRequest(ctx context.Context, requestArgs ...interface{}) (interface{}, error) {
+func (tr1 *Tr1SendAndHandle) MakeRequest(ctx context.Context, requestArgs ...interface{}) (tr1Resp interface{}, err error) {
 	tr1Request := requestArgs[0].(Tr1d1umRequest)
-	newRequest, newRequestErr := http.NewRequest(tr1Request.method, tr1Request.URL, tr1Request.GetBody())
+	requestURL := tr1Request.URL
+
+	if tr1.Endpoints != nil {
+		endpoint := tr1.Endpoints.Acquire(string(tr1Request.deviceID), tr1Request.tried)
+		if endpoint == nil {
+			tr1Response := Tr1d1umResponse{}.New()
+			WriteResponse(errNoTargetEndpoints.Error(), http.StatusServiceUnavailable, tr1Response)
+			return tr1Response, errNoTargetEndpoints
+		}
+
+		requestURL = tr1.Endpoints.Rewrite(requestURL, endpoint)
+
+		if tr1Request.tried != nil {
+			tr1Request.tried[endpoint.URL] = struct{}{}
+		}
+
+		defer func() {
+			tr1.Endpoints.Release(endpoint, isTargetFailure(ctx, tr1Resp, err))
+		}()
+	}
+
+	ctx, span := StartSpan(ctx, "HTTP "+tr1Request.method, SpanKindClient)
+	defer span.Finish()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, tr1.GetRespTimeout())
+	defer cancel()
+
+	newRequest, newRequestErr := tr1.newHTTPRequest(timeoutCtx, tr1Request, requestURL)
 	tr1Response := Tr1d1umResponse{}.New()
 
 	if newRequestErr != nil {
@@ -73,6 +120,31 @@ func (tr1 *Tr1SendAndHandle) MakeRequest(ctx context.Context, requestArgs ...int
 		return tr1Response, newRequestErr
 	}
 
+	start := time.Now()
+	httpResp, responseErr := tr1.send(tr1Request, newRequest)
+
+	if tr1.Latency != nil {
+		tr1.Latency.Observe(time.Since(start).Seconds())
+	}
+
+	span.SetAttribute("http.url", newRequest.URL.String())
+	span.SetError(responseErr)
+
+	if httpResp != nil {
+		span.SetAttribute("http.status_code", strconv.Itoa(httpResp.StatusCode))
+	}
+
+	tr1.HandleResponse(responseErr, httpResp, tr1Response, tr1Request.method == http.MethodGet || tr1Request.rawResponse)
+	return tr1Response, responseErr
+}
+
+//newHTTPRequest builds an http request out of the given Tr1d1umRequest, sent to requestURL with a fresh body
+func (tr1 *Tr1SendAndHandle) newHTTPRequest(ctx context.Context, tr1Request Tr1d1umRequest, requestURL string) (*http.Request, error) {
+	newRequest, err := http.NewRequest(tr1Request.method, requestURL, tr1Request.GetBody())
+	if err != nil {
+		return nil, err
+	}
+
 	//transfer headers to request
 	for headerKey := range tr1Request.headers {
 		for _, headerValue := range tr1Request.headers[headerKey] {
@@ -80,12 +152,8 @@ func (tr1 *Tr1SendAndHandle) MakeRequest(ctx context.Context, requestArgs ...int
 		}
 	}
 
-	timeoutCtx, cancel := context.WithTimeout(ctx, tr1.GetRespTimeout())
-	defer cancel()
-
-	httpResp, responseErr := tr1.client.Do(newRequest.WithContext(timeoutCtx))
-	tr1.HandleResponse(responseErr, httpResp, tr1Response, tr1Request.method == http.MethodGet)
-	return tr1Response, responseErr
+	InjectTraceContext(ctx, newRequest.Header)
+	return newRequest.WithContext(ctx), nil
 }
 
 //HandleResponse contains the logic to generate a tr1d1umResponse based on some given error information and an http response
@@ -112,7 +180,7 @@ func (tr1 *Tr1SendAndHandle) HandleResponse(err error, respFromServer *http.Resp
 	}
 
 	if respFromServer.StatusCode != http.StatusOK || wholeBody {
-		tr1Resp.Body, tr1Resp.Code = bodyBytes, respFromServer.StatusCode
+		tr1Resp.Body, tr1Resp.Code, tr1Resp.source = bodyBytes, respFromServer.StatusCode, SourceTarget
 
 		debugLogger.Log(logging.MessageKey(), "non-200 response from server", logging.ErrorKey(), respFromServer.Status)
 		return
@@ -127,8 +195,14 @@ func (tr1 *Tr1SendAndHandle) HandleResponse(err error, respFromServer *http.Resp
 			tr1Resp.Code = RDKRespCode
 		}
 
+		tr1Resp.source, tr1Resp.contentType = SourceDevice, ResponseData.ContentType
+
 		tr1Resp.Body = RDKResponse
 	} else {
+		if tr1.DecodeFailures != nil {
+			tr1.DecodeFailures.Add(1)
+		}
+
 		ReportError(errDecoding, tr1Resp)
 		errorLogger.Log(logging.MessageKey(), "could not extract payload from wrp body", logging.ErrorKey(), errDecoding)
 	}
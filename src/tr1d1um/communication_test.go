@@ -187,8 +187,9 @@ func TestHandleResponse(t *testing.T) {
 		assert := assert.New(t)
 		RDKResponse := []byte(`{"statusCode": 202}`)
 		wrpMsg := wrp.Message{
-			Type:    wrp.SimpleRequestResponseMessageType,
-			Payload: RDKResponse}
+			Type:        wrp.SimpleRequestResponseMessageType,
+			ContentType: wrp.JSON.ContentType(),
+			Payload:     RDKResponse}
 
 		encodedData := wrp.MustEncode(wrpMsg, wrp.Msgpack)
 		fakeResponse := newTestingHTTPResponse(http.StatusOK, string(encodedData), testHeader)
@@ -198,6 +199,7 @@ func TestHandleResponse(t *testing.T) {
 
 		assert.EqualValues(202, recorder.Code)
 		assert.EqualValues(RDKResponse, string(recorder.Body))
+		assert.EqualValues(wrp.JSON.ContentType(), recorder.contentType)
 		assert.True(bodyIsClosed(fakeResponse))
 		assert.EqualValues(testHeader.Get("X-test"), recorder.Headers.Get("X-test"))
 	})
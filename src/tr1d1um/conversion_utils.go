@@ -63,7 +63,8 @@ type EncodingHelper struct{}
 
 //ConversionWDMP implements the definitions defined in ConversionTool
 type ConversionWDMP struct {
-	WRPSource string
+	WRPSource      string
+	ServiceSources map[string]string
 }
 
 //The following functions with names of the form {command}FlavorFormat serve as the low level builders of WDMP objects
@@ -243,7 +244,8 @@ func (cw *ConversionWDMP) GetFromURLPath(key string, urlVars Vars) (val string,
 	return
 }
 
-//GetConfiguredWRP Set the necessary fields in the wrp and return it
+//GetConfiguredWRP Set the necessary fields in the wrp and return it. The deviceid path variable is expected to hold
+//the identifier resolved when the request was validated
 func (cw *ConversionWDMP) GetConfiguredWRP(wdmp []byte, pathVars Vars, header http.Header) (wrpMsg *wrp.Message) {
 	deviceID, _ := cw.GetFromURLPath("deviceid", pathVars)
 	canonicalDeviceID, _ := device.ParseID(deviceID)
@@ -253,7 +255,7 @@ func (cw *ConversionWDMP) GetConfiguredWRP(wdmp []byte, pathVars Vars, header ht
 		Type:            wrp.SimpleRequestResponseMessageType,
 		ContentType:     header.Get("Content-Type"),
 		Payload:         wdmp,
-		Source:          cw.GetWRPSource() + "/" + service,
+		Source:          cw.GetWRPSource(service) + "/" + service,
 		Destination:     string(canonicalDeviceID) + "/" + service,
 		TransactionUUID: GetOrGenTID(header),
 	}
@@ -261,8 +263,11 @@ func (cw *ConversionWDMP) GetConfiguredWRP(wdmp []byte, pathVars Vars, header ht
 }
 
 // GetWRPSource returns the Source that should be used in every
-// WRP transaction message
-func (cw *ConversionWDMP) GetWRPSource() string {
+// WRP transaction message for the given service
+func (cw *ConversionWDMP) GetWRPSource(service string) string {
+	if source, ok := cw.ServiceSources[service]; ok && source != "" {
+		return source
+	}
 	return cw.WRPSource
 }
 
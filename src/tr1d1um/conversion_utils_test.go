@@ -477,6 +477,14 @@ func TestGetConfiguredWRP(t *testing.T) {
 	assert.EqualValues(expectedSource, wrpMsg.Source)
 	assert.EqualValues(tid, wrpMsg.TransactionUUID)
 }
+func TestGetWRPSource(t *testing.T) {
+	assert := assert.New(t)
+	c := ConversionWDMP{WRPSource: "dns:source", ServiceSources: map[string]string{"iot": "dns:iot"}}
+
+	assert.EqualValues("dns:iot", c.GetWRPSource("iot"))
+	assert.EqualValues("dns:source", c.GetWRPSource("config"))
+}
+
 func TestGetOrGenTID(t *testing.T) {
 	assert := assert.New(t)
 	t.Run("UseGivenTID", func(t *testing.T) {
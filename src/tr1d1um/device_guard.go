@@ -0,0 +1,248 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+)
+
+const (
+	deviceGuardKey = "deviceGuard"
+
+	defaultDeviceMaxInFlight  = 1
+	defaultDeviceQueueSize    = 4
+	defaultDeviceQueueTimeout = "5s"
+)
+
+var errDeviceBusy = errors.New("device busy")
+
+//DeviceGuardConfig defines the deviceGuard section of the configuration file
+type DeviceGuardConfig struct {
+	// MaxInFlight is the number of requests a single device may be handling at once
+	MaxInFlight int `json:"maxInFlight"`
+
+	// WriteSpacing is the minimum time between the starts of two writes to the same device
+	WriteSpacing string `json:"writeSpacing"`
+
+	// QueueSize is the number of requests per device allowed to wait, for at most QueueTimeout, for their turn.
+	// Requests beyond that are rejected right away
+	QueueSize    int    `json:"queueSize"`
+	QueueTimeout string `json:"queueTimeout"`
+}
+
+//defaultDeviceGuardConfig returns the settings used for anything the deviceGuard section leaves out
+func defaultDeviceGuardConfig() DeviceGuardConfig {
+	return DeviceGuardConfig{
+		MaxInFlight:  defaultDeviceMaxInFlight,
+		QueueSize:    defaultDeviceQueueSize,
+		QueueTimeout: defaultDeviceQueueTimeout,
+	}
+}
+
+type deviceSlot struct {
+	inFlight  int
+	waiting   int
+	lastWrite time.Time
+
+	//released is closed, and replaced, whenever a request to the device completes
+	released chan struct{}
+}
+
+//DeviceGuard protects devices from more concurrent requests, or more frequent writes, than they can handle.
+//A single DeviceGuard is shared by every handler so the limits hold across all routes
+type DeviceGuard struct {
+	MaxInFlight  int
+	WriteSpacing time.Duration
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	lock  sync.Mutex
+	slots map[device.ID]*deviceSlot
+	now   func() time.Time
+}
+
+//NewDeviceGuard builds the DeviceGuard described by the given configuration
+func NewDeviceGuard(config DeviceGuardConfig) (guard *DeviceGuard, err error) {
+	guard = &DeviceGuard{
+		MaxInFlight: config.MaxInFlight,
+		QueueSize:   config.QueueSize,
+		slots:       map[device.ID]*deviceSlot{},
+		now:         time.Now,
+	}
+
+	if config.WriteSpacing != "" {
+		if guard.WriteSpacing, err = time.ParseDuration(config.WriteSpacing); err != nil {
+			return nil, err
+		}
+	}
+
+	if guard.QueueTimeout, err = time.ParseDuration(config.QueueTimeout); err != nil {
+		return nil, err
+	}
+
+	if guard.MaxInFlight < 1 {
+		guard.MaxInFlight = defaultDeviceMaxInFlight
+	}
+	return
+}
+
+//Acquire waits for the given device to be free to take a request. The returned function must be called once the
+//request completes. errDeviceBusy, along with a hint of when to try again, is returned if the device's queue is
+//full or the request waited longer than QueueTimeout
+func (g *DeviceGuard) Acquire(ctx context.Context, id device.ID, write bool) (release func(), retryAfter time.Duration, err error) {
+	var deadline <-chan time.Time
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	slot, ok := g.slots[id]
+	if !ok {
+		slot = &deviceSlot{released: make(chan struct{})}
+		g.slots[id] = slot
+	}
+
+	for {
+		now := g.now()
+		spacing := g.WriteSpacing - now.Sub(slot.lastWrite)
+
+		if slot.inFlight < g.MaxInFlight && (!write || spacing <= 0) {
+			slot.inFlight++
+			if write {
+				slot.lastWrite = now
+			}
+			return func() { g.release(id, slot) }, 0, nil
+		}
+
+		retryAfter = g.QueueTimeout
+		if write && spacing > 0 {
+			retryAfter = spacing
+		}
+
+		if deadline == nil {
+			if slot.waiting >= g.QueueSize {
+				g.forget(id, slot)
+				return nil, retryAfter, errDeviceBusy
+			}
+
+			timer := time.NewTimer(g.QueueTimeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		//a write held back only by the spacing of writes has nothing else to wait for
+		var spacingTimer *time.Timer
+		var spaced <-chan time.Time
+		if write && spacing > 0 && slot.inFlight < g.MaxInFlight {
+			spacingTimer = time.NewTimer(spacing)
+			spaced = spacingTimer.C
+		}
+
+		released := slot.released
+		slot.waiting++
+		g.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-spaced:
+		case <-deadline:
+			err = errDeviceBusy
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if spacingTimer != nil {
+			spacingTimer.Stop()
+		}
+
+		g.lock.Lock()
+		slot.waiting--
+
+		if err != nil {
+			g.forget(id, slot)
+			return nil, retryAfter, err
+		}
+	}
+}
+
+//release frees the place the request held and lets waiting requests try again
+func (g *DeviceGuard) release(id device.ID, slot *deviceSlot) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	slot.inFlight--
+	close(slot.released)
+	slot.released = make(chan struct{})
+	g.forget(id, slot)
+}
+
+//forget drops the slot of an idle device once nothing about it needs to be remembered anymore. The caller must hold the lock
+func (g *DeviceGuard) forget(id device.ID, slot *deviceSlot) {
+	if slot.inFlight == 0 && slot.waiting == 0 && g.now().Sub(slot.lastWrite) >= g.WriteSpacing {
+		delete(g.slots, id)
+	}
+}
+
+//isWriteCommand returns true unless the given WDMP payload is a GET or GET_ATTRIBUTES command. Payloads that are not
+//WDMP, e.g. passthrough messages, are taken to be writes unless the request method is GET
+func isWriteCommand(method string, payload []byte) bool {
+	command := wdmpCommand(payload)
+	if command == "" {
+		return method != http.MethodGet
+	}
+	return !strings.HasPrefix(command, CommandGet)
+}
+
+//wdmpCommand returns the command of the given WDMP payload, or an empty string if the payload is not WDMP
+func wdmpCommand(payload []byte) string {
+	var wdmp struct {
+		Command string `json:"command"`
+	}
+
+	json.Unmarshal(payload, &wdmp)
+	return wdmp.Command
+}
+
+//guardDevice waits for the given device to be free to take a request. If it does not get to, the returned
+//Tr1d1umResponse describes what should be passed back to the caller instead
+func (ch *ConversionHandler) guardDevice(ctx context.Context, id device.ID, write bool) (release func(), failure *Tr1d1umResponse, err error) {
+	if ch.DeviceGuard == nil || id == "" {
+		return func() {}, nil, nil
+	}
+
+	release, retryAfter, err := ch.DeviceGuard.Acquire(ctx, id, write)
+	if err != nil {
+		failure = Tr1d1umResponse{}.New()
+
+		if err == errDeviceBusy {
+			failure.Headers.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			WriteProblem(ProblemDeviceBusy, http.StatusTooManyRequests, "Device busy", failure)
+		} else {
+			ReportError(err, failure)
+		}
+	}
+	return
+}
@@ -0,0 +1,160 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeviceGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	guard, err := NewDeviceGuard(defaultDeviceGuardConfig())
+	assert.Nil(err)
+	assert.EqualValues(defaultDeviceMaxInFlight, guard.MaxInFlight)
+	assert.EqualValues(5*time.Second, guard.QueueTimeout)
+
+	_, err = NewDeviceGuard(DeviceGuardConfig{WriteSpacing: "soon", QueueTimeout: "1s"})
+	assert.NotNil(err)
+}
+
+func TestDeviceGuard(t *testing.T) {
+	t.Run("MaxInFlight", func(t *testing.T) {
+		assert := assert.New(t)
+		guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 2, QueueSize: 8, QueueTimeout: "5s"})
+
+		var inFlight, peak int32
+		var wg sync.WaitGroup
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, _, err := guard.Acquire(context.Background(), "mac:112233445566", false)
+				assert.Nil(err)
+
+				if n := atomic.AddInt32(&inFlight, 1); n > atomic.LoadInt32(&peak) {
+					atomic.StoreInt32(&peak, n)
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				release()
+			}()
+		}
+
+		wg.Wait()
+		assert.True(atomic.LoadInt32(&peak) <= 2)
+		assert.Empty(guard.slots)
+	})
+
+	t.Run("QueueFull", func(t *testing.T) {
+		assert := assert.New(t)
+		guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 1, QueueSize: 0, QueueTimeout: "1s"})
+
+		release, _, err := guard.Acquire(context.Background(), "mac:112233445566", false)
+		assert.Nil(err)
+
+		_, retryAfter, err := guard.Acquire(context.Background(), "mac:112233445566", false)
+		assert.EqualValues(errDeviceBusy, err)
+		assert.EqualValues(time.Second, retryAfter)
+
+		//other devices are not affected
+		other, _, err := guard.Acquire(context.Background(), "mac:aabbccddeeff", false)
+		assert.Nil(err)
+
+		other()
+		release()
+	})
+
+	t.Run("QueueTimeout", func(t *testing.T) {
+		assert := assert.New(t)
+		guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 1, QueueSize: 1, QueueTimeout: "10ms"})
+
+		release, _, _ := guard.Acquire(context.Background(), "mac:112233445566", false)
+		_, _, err := guard.Acquire(context.Background(), "mac:112233445566", false)
+		assert.EqualValues(errDeviceBusy, err)
+		release()
+	})
+
+	t.Run("ContextDone", func(t *testing.T) {
+		assert := assert.New(t)
+		guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 1, QueueSize: 1, QueueTimeout: "5s"})
+
+		release, _, _ := guard.Acquire(context.Background(), "mac:112233445566", false)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := guard.Acquire(ctx, "mac:112233445566", false)
+		assert.EqualValues(context.Canceled, err)
+		release()
+	})
+
+	t.Run("WriteSpacing", func(t *testing.T) {
+		assert := assert.New(t)
+		guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 4, WriteSpacing: "30ms", QueueSize: 1, QueueTimeout: "1s"})
+
+		release, _, _ := guard.Acquire(context.Background(), "mac:112233445566", true)
+		release()
+		start := time.Now()
+
+		//reads are not spaced out
+		read, _, err := guard.Acquire(context.Background(), "mac:112233445566", false)
+		assert.Nil(err)
+		read()
+		assert.True(time.Since(start) < 30*time.Millisecond)
+
+		release, _, err = guard.Acquire(context.Background(), "mac:112233445566", true)
+		assert.Nil(err)
+		assert.True(time.Since(start) >= 25*time.Millisecond)
+		release()
+	})
+}
+
+func TestIsWriteCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(isWriteCommand(http.MethodPatch, []byte(`{"command":"GET","names":["Device.Param"]}`)))
+	assert.False(isWriteCommand(http.MethodGet, []byte(`{"command":"GET_ATTRIBUTES"}`)))
+	assert.True(isWriteCommand(http.MethodGet, []byte(`{"command":"SET"}`)))
+	assert.True(isWriteCommand(http.MethodPost, []byte("raw")))
+	assert.False(isWriteCommand(http.MethodGet, nil))
+}
+
+func TestGuardDevice(t *testing.T) {
+	assert := assert.New(t)
+	guard, _ := NewDeviceGuard(DeviceGuardConfig{MaxInFlight: 1, QueueTimeout: "1s"})
+	ch := &ConversionHandler{DeviceGuard: guard}
+
+	release, failure, err := ch.guardDevice(context.Background(), "mac:112233445566", true)
+	assert.Nil(failure)
+	assert.Nil(err)
+
+	_, failure, err = ch.guardDevice(context.Background(), "mac:112233445566", true)
+	assert.EqualValues(errDeviceBusy, err)
+	assert.EqualValues(http.StatusTooManyRequests, failure.Code)
+	assert.EqualValues("1", failure.Headers.Get("Retry-After"))
+
+	release()
+}
@@ -0,0 +1,356 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	deviceResolverKey = "deviceResolver"
+
+	defaultResolverReloadInterval = "30s"
+	defaultResolverTimeout        = "5s"
+	defaultResolverCacheTTL       = "10m"
+	defaultResolverNegativeTTL    = "30s"
+	defaultResolverCacheSize      = 10000
+)
+
+//defaultResolverPrefixes are the identifier prefixes handed to the resolver when none are configured
+var defaultResolverPrefixes = []string{"serial", "account"}
+
+var (
+	errDeviceNotMapped         = errors.New("no mapping found for device identifier")
+	errUnknownDeviceResolver   = errors.New("unknown deviceResolver type")
+	errDeviceLookupUnavailable = errors.New("device lookup service unavailable")
+)
+
+//DeviceResolver turns alternate device identifiers (i.e. serial:XYZ) into canonical device IDs
+type DeviceResolver interface {
+	Resolve(context.Context, string) (device.ID, error)
+}
+
+//DeviceResolverConfig defines the deviceResolver section of the configuration file
+type DeviceResolverConfig struct {
+	Type     string   `json:"type"`
+	Prefixes []string `json:"prefixes"`
+
+	// file resolver options
+	File           string `json:"file"`
+	ReloadInterval string `json:"reloadInterval"`
+
+	// http resolver options
+	URL      string `json:"url"`
+	Timeout  string `json:"timeout"`
+	CacheTTL string `json:"cacheTTL"`
+
+	// NegativeCacheTTL is how long identifiers the lookup service does not know about are remembered as such
+	NegativeCacheTTL string `json:"negativeCacheTTL"`
+
+	// CacheSize is the most lookup results kept at once. The least recently used ones make room for new ones
+	CacheSize int `json:"cacheSize"`
+}
+
+//NewDeviceResolver builds the DeviceResolver described in the configuration. A nil resolver
+//is returned if none was configured
+func NewDeviceResolver(v *viper.Viper, logger log.Logger) (resolver DeviceResolver, err error) {
+	if !v.IsSet(deviceResolverKey) {
+		return
+	}
+
+	//prefixes are left empty so that the configured ones replace, rather than get merged into, the default ones
+	config := DeviceResolverConfig{
+		ReloadInterval: defaultResolverReloadInterval,
+		Timeout:        defaultResolverTimeout,
+		CacheTTL:       defaultResolverCacheTTL,
+
+		NegativeCacheTTL: defaultResolverNegativeTTL,
+		CacheSize:        defaultResolverCacheSize,
+	}
+
+	if err = v.UnmarshalKey(deviceResolverKey, &config); err != nil {
+		return
+	}
+
+	if len(config.Prefixes) == 0 {
+		config.Prefixes = defaultResolverPrefixes
+	}
+
+	var delegate DeviceResolver
+
+	switch config.Type {
+	case "file":
+		reloadInterval, _ := time.ParseDuration(config.ReloadInterval)
+		delegate, err = NewFileDeviceResolver(config.File, reloadInterval, logger)
+
+	case "http":
+		timeout, _ := time.ParseDuration(config.Timeout)
+		cacheTTL, _ := time.ParseDuration(config.CacheTTL)
+		negativeCacheTTL, _ := time.ParseDuration(config.NegativeCacheTTL)
+
+		httpResolver := NewHTTPDeviceResolver(config.URL, cacheTTL, &http.Client{Timeout: timeout})
+		httpResolver.NegativeCacheTTL = negativeCacheTTL
+		httpResolver.cache = newLRUCache(config.CacheSize)
+		delegate = httpResolver
+
+	default:
+		err = errUnknownDeviceResolver
+	}
+
+	if err == nil {
+		resolver = &prefixResolver{prefixes: getSupportedServicesMap(config.Prefixes), delegate: delegate}
+	}
+	return
+}
+
+//resolveDeviceID returns the canonical form of the given device identifier. The resolver, if any, is consulted
+//first and device.ParseID is used for identifiers it does not know about
+func resolveDeviceID(ctx context.Context, resolver DeviceResolver, id string) (device.ID, error) {
+	if resolver != nil {
+		if canonical, err := resolver.Resolve(ctx, id); err != errDeviceNotMapped {
+			return canonical, err
+		}
+	}
+	return device.ParseID(id)
+}
+
+//prefixResolver only hands identifiers with the configured prefixes to its delegate
+type prefixResolver struct {
+	prefixes map[string]struct{}
+	delegate DeviceResolver
+}
+
+func (p *prefixResolver) Resolve(ctx context.Context, id string) (device.ID, error) {
+	if i := strings.Index(id, ":"); i > 0 {
+		if _, handled := p.prefixes[strings.ToLower(id[:i])]; handled {
+			return p.delegate.Resolve(ctx, id)
+		}
+	}
+	return "", errDeviceNotMapped
+}
+
+//FileDeviceResolver resolves identifiers through a JSON file of the form {"serial:XYZ": "mac:112233445566", ...}
+//The file is reloaded whenever its modification time changes
+type FileDeviceResolver struct {
+	log.Logger
+	path     string
+	lock     sync.RWMutex
+	mappings map[string]string
+	modTime  time.Time
+	stop     chan struct{}
+}
+
+//NewFileDeviceResolver loads the given file and, given a positive reloadInterval, starts watching it for changes
+func NewFileDeviceResolver(path string, reloadInterval time.Duration, logger log.Logger) (f *FileDeviceResolver, err error) {
+	f = &FileDeviceResolver{Logger: logger, path: path, stop: make(chan struct{})}
+
+	if err = f.reload(); err != nil {
+		return
+	}
+
+	if reloadInterval > 0 {
+		go f.watch(reloadInterval)
+	}
+	return
+}
+
+//Resolve looks the given identifier up in the last successfully loaded version of the file
+func (f *FileDeviceResolver) Resolve(_ context.Context, id string) (device.ID, error) {
+	f.lock.RLock()
+	canonical, found := f.mappings[id]
+	f.lock.RUnlock()
+
+	if !found {
+		return "", errDeviceNotMapped
+	}
+	return device.ParseID(canonical)
+}
+
+//Stop ends the file watch
+func (f *FileDeviceResolver) Stop() {
+	close(f.stop)
+}
+
+func (f *FileDeviceResolver) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.reload(); err != nil {
+				logging.Error(f).Log(logging.MessageKey(), "could not reload device mappings", "file", f.path, logging.ErrorKey(), err)
+			}
+		}
+	}
+}
+
+func (f *FileDeviceResolver) reload() (err error) {
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(f.modTime) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return
+	}
+
+	mappings := map[string]string{}
+	if err = json.Unmarshal(data, &mappings); err != nil {
+		return
+	}
+
+	f.lock.Lock()
+	f.mappings, f.modTime = mappings, info.ModTime()
+	f.lock.Unlock()
+
+	logging.Info(f).Log(logging.MessageKey(), "loaded device mappings", "file", f.path, "count", len(mappings))
+	return
+}
+
+//deviceLookupResponse is the payload expected from the device lookup service
+type deviceLookupResponse struct {
+	DeviceID string `json:"deviceId"`
+}
+
+type cachedDeviceID struct {
+	id      device.ID
+	err     error
+	expires time.Time
+}
+
+//HTTPDeviceResolver resolves identifiers through a lookup service. The URL must contain a single %s
+//where the escaped identifier is placed. Results are cached for CacheTTL and identifiers the service does not know
+//about for NegativeCacheTTL. The cache is unbounded unless replaced with a sized one
+type HTTPDeviceResolver struct {
+	URL              string
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	client           *http.Client
+	lock             sync.Mutex
+	cache            *lruCache
+	now              func() time.Time
+}
+
+//NewHTTPDeviceResolver returns an HTTPDeviceResolver with an empty cache
+func NewHTTPDeviceResolver(URL string, cacheTTL time.Duration, client *http.Client) *HTTPDeviceResolver {
+	return &HTTPDeviceResolver{
+		URL:      URL,
+		CacheTTL: cacheTTL,
+		client:   client,
+		cache:    newLRUCache(0),
+		now:      time.Now,
+	}
+}
+
+//Resolve returns the cached result for the given identifier or asks the lookup service for it. Failures to reach
+//the service, or to make sense of its answer, are reported as errDeviceLookupUnavailable
+func (h *HTTPDeviceResolver) Resolve(ctx context.Context, id string) (canonical device.ID, err error) {
+	if cached, found := h.cached(id); found {
+		return cached.id, cached.err
+	}
+
+	if canonical, err = h.lookup(ctx, id); err == nil {
+		h.store(id, cachedDeviceID{id: canonical}, h.CacheTTL)
+	} else if err == errDeviceNotMapped {
+		h.store(id, cachedDeviceID{err: err}, h.NegativeCacheTTL)
+	}
+	return
+}
+
+//lookup asks the lookup service for the canonical ID of the given identifier
+func (h *HTTPDeviceResolver) lookup(ctx context.Context, id string) (canonical device.ID, err error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(h.URL, url.PathEscape(id)), nil)
+	if err != nil {
+		return "", errDeviceLookupUnavailable
+	}
+
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errDeviceLookupUnavailable
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errDeviceNotMapped
+	default:
+		return "", errDeviceLookupUnavailable
+	}
+
+	var lookup deviceLookupResponse
+	if err = json.NewDecoder(resp.Body).Decode(&lookup); err != nil {
+		return "", errDeviceLookupUnavailable
+	}
+
+	if canonical, err = device.ParseID(lookup.DeviceID); err != nil {
+		return "", errDeviceLookupUnavailable
+	}
+	return
+}
+
+//cached returns the unexpired result cached for the given identifier. An expired result is dropped
+func (h *HTTPDeviceResolver) cached(id string) (cached cachedDeviceID, found bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	value, found := h.cache.Get(id)
+	if !found {
+		return
+	}
+
+	if cached = value.(cachedDeviceID); h.now().Before(cached.expires) {
+		return
+	}
+
+	h.cache.Remove(id)
+	return cachedDeviceID{}, false
+}
+
+//store caches the given result for ttl, evicting the least recently used results when the cache is full
+func (h *HTTPDeviceResolver) store(id string, cached cachedDeviceID, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	cached.expires = h.now().Add(ttl)
+	h.cache.Add(id, cached)
+}
@@ -0,0 +1,244 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveDeviceID(t *testing.T) {
+	t.Run("NoResolver", func(t *testing.T) {
+		assert := assert.New(t)
+		id, err := resolveDeviceID(context.Background(), nil, "mac:112233445566")
+		assert.Nil(err)
+		assert.EqualValues("mac:112233445566", id)
+	})
+
+	t.Run("UnhandledPrefix", func(t *testing.T) {
+		assert := assert.New(t)
+		resolver := &prefixResolver{prefixes: map[string]struct{}{"serial": {}}}
+		id, err := resolveDeviceID(context.Background(), resolver, "mac:112233445566")
+		assert.Nil(err)
+		assert.EqualValues("mac:112233445566", id)
+	})
+}
+
+func TestFileDeviceResolver(t *testing.T) {
+	assert := assert.New(t)
+	file, err := ioutil.TempFile("", "devices")
+	assert.Nil(err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"serial:XYZ": "mac:112233445566"}`)
+	file.Close()
+
+	resolver, err := NewFileDeviceResolver(file.Name(), 0, logging.DefaultLogger())
+	assert.Nil(err)
+
+	id, err := resolver.Resolve(context.Background(), "serial:XYZ")
+	assert.Nil(err)
+	assert.EqualValues(device.ID("mac:112233445566"), id)
+
+	_, err = resolver.Resolve(context.Background(), "serial:ABC")
+	assert.EqualValues(errDeviceNotMapped, err)
+}
+
+//newDeviceLookupServer returns a lookup service that only knows about serial:XYZ and counts the calls it gets
+func newDeviceLookupServer(calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if r.URL.Path != "/devices/serial:XYZ" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"deviceId": "mac:112233445566"}`))
+	}))
+}
+
+func TestHTTPDeviceResolver(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	server := newDeviceLookupServer(&calls)
+	defer server.Close()
+
+	resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+
+	for i := 0; i < 2; i++ {
+		id, err := resolver.Resolve(context.Background(), "serial:XYZ")
+		assert.Nil(err)
+		assert.EqualValues(device.ID("mac:112233445566"), id)
+	}
+	assert.EqualValues(1, calls)
+
+	_, err := resolver.Resolve(context.Background(), "serial:ABC")
+	assert.EqualValues(errDeviceNotMapped, err)
+	assert.EqualValues(2, calls)
+}
+
+func TestHTTPDeviceResolverCache(t *testing.T) {
+	t.Run("NegativeCache", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := 0
+		server := newDeviceLookupServer(&calls)
+		defer server.Close()
+
+		resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+		resolver.NegativeCacheTTL = time.Second
+
+		for i := 0; i < 2; i++ {
+			_, err := resolver.Resolve(context.Background(), "serial:ABC")
+			assert.EqualValues(errDeviceNotMapped, err)
+		}
+		assert.EqualValues(1, calls)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := 0
+		server := newDeviceLookupServer(&calls)
+		defer server.Close()
+
+		now := time.Now()
+		resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+		resolver.NegativeCacheTTL = time.Second
+		resolver.now = func() time.Time { return now }
+
+		resolver.Resolve(context.Background(), "serial:ABC")
+		now = now.Add(2 * time.Second)
+		resolver.Resolve(context.Background(), "serial:ABC")
+
+		assert.EqualValues(2, calls)
+		assert.EqualValues(1, resolver.cache.Len())
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := 0
+		server := newDeviceLookupServer(&calls)
+		defer server.Close()
+
+		resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+		resolver.NegativeCacheTTL = time.Minute
+		resolver.cache = newLRUCache(2)
+
+		resolver.Resolve(context.Background(), "serial:XYZ")
+		resolver.Resolve(context.Background(), "serial:ABC")
+		resolver.Resolve(context.Background(), "serial:XYZ")
+		resolver.Resolve(context.Background(), "serial:DEF")
+		assert.EqualValues(2, resolver.cache.Len())
+		assert.EqualValues(3, calls)
+
+		//serial:ABC was the least recently used, so it made room for serial:DEF
+		resolver.Resolve(context.Background(), "serial:XYZ")
+		resolver.Resolve(context.Background(), "serial:ABC")
+		assert.EqualValues(4, calls)
+	})
+}
+
+func TestHTTPDeviceResolverUnavailable(t *testing.T) {
+	t.Run("ServerError", func(t *testing.T) {
+		assert := assert.New(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+		_, err := resolver.Resolve(context.Background(), "serial:XYZ")
+		assert.EqualValues(errDeviceLookupUnavailable, err)
+		assert.Zero(resolver.cache.Len())
+	})
+
+	t.Run("ContextEnded", func(t *testing.T) {
+		assert := assert.New(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		resolver := NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client())
+		_, err := resolver.Resolve(ctx, "serial:XYZ")
+		assert.EqualValues(errDeviceLookupUnavailable, err)
+	})
+}
+
+func TestNewDeviceResolver(t *testing.T) {
+	t.Run("NotConfigured", func(t *testing.T) {
+		assert := assert.New(t)
+		resolver, err := NewDeviceResolver(viper.New(), logging.DefaultLogger())
+		assert.Nil(err)
+		assert.Nil(resolver)
+	})
+
+	t.Run("UnknownType", func(t *testing.T) {
+		assert := assert.New(t)
+		v := viper.New()
+		v.Set(deviceResolverKey, map[string]interface{}{"type": "carrierPigeon"})
+		_, err := NewDeviceResolver(v, logging.DefaultLogger())
+		assert.EqualValues(errUnknownDeviceResolver, err)
+	})
+
+	t.Run("Prefixes", func(t *testing.T) {
+		file, err := ioutil.TempFile("", "devices")
+		assert.Nil(t, err)
+		defer os.Remove(file.Name())
+
+		file.WriteString(`{}`)
+		file.Close()
+
+		testData := []struct {
+			name     string
+			prefixes []string
+			expected map[string]struct{}
+		}{
+			{"Default", nil, map[string]struct{}{"serial": {}, "account": {}}},
+			{"Configured", []string{"imei"}, map[string]struct{}{"imei": {}}},
+		}
+
+		for _, record := range testData {
+			t.Run(record.name, func(t *testing.T) {
+				assert := assert.New(t)
+				config := map[string]interface{}{"type": "file", "file": file.Name(), "reloadInterval": "0s"}
+				if record.prefixes != nil {
+					config["prefixes"] = record.prefixes
+				}
+
+				v := viper.New()
+				v.Set(deviceResolverKey, config)
+
+				resolver, err := NewDeviceResolver(v, logging.DefaultLogger())
+				assert.Nil(err)
+				assert.EqualValues(record.expected, resolver.(*prefixResolver).prefixes)
+			})
+		}
+	})
+}
@@ -0,0 +1,211 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	discoveryKey = "discovery"
+
+	defaultDiscoveryRefresh = "30s"
+	defaultSRVScheme        = "https"
+	defaultSRVProto         = "tcp"
+)
+
+var (
+	errUnknownDiscovery  = errors.New("unknown discovery type")
+	errNoTargetEndpoints = errors.New("no target endpoints available")
+
+	errNonPositiveRefreshInterval = errors.New("discovery: refreshInterval must be positive")
+)
+
+//Discoverer provides the current set of target endpoint URLs
+type Discoverer interface {
+	Discover() ([]string, error)
+}
+
+//DiscoveryConfig defines the discovery section of the configuration file
+type DiscoveryConfig struct {
+	Type            string `json:"type"`
+	RefreshInterval string `json:"refreshInterval"`
+
+	// file discovery options
+	File string `json:"file"`
+
+	// dns srv discovery options
+	Service string `json:"service"`
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	Scheme  string `json:"scheme"`
+}
+
+//defaultDiscoveryConfig returns the settings used for anything the discovery section leaves out
+func defaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		RefreshInterval: defaultDiscoveryRefresh,
+		Proto:           defaultSRVProto,
+		Scheme:          defaultSRVScheme,
+	}
+}
+
+//NewDiscoverer builds the Discoverer described by the given configuration. A nil Discoverer is
+//returned if no discovery type was configured
+func NewDiscoverer(config DiscoveryConfig) (discoverer Discoverer, refreshInterval time.Duration, err error) {
+	if config.Type == "" {
+		return
+	}
+
+	if refreshInterval, err = time.ParseDuration(config.RefreshInterval); err != nil {
+		return
+	}
+
+	if refreshInterval <= 0 {
+		return nil, 0, errNonPositiveRefreshInterval
+	}
+
+	switch config.Type {
+	case "file":
+		discoverer = &FileDiscoverer{Path: config.File}
+	case "dnssrv":
+		discoverer = &SRVDiscoverer{Service: config.Service, Proto: config.Proto, Name: config.Name, Scheme: config.Scheme,
+			lookup: net.LookupSRV}
+	default:
+		err = errUnknownDiscovery
+	}
+	return
+}
+
+//FileDiscoverer reads target endpoints from a local JSON or YAML file holding a list of URLs. YAML is
+//assumed for files with a .yaml or .yml extension. The file is only parsed again once its modification time changes
+type FileDiscoverer struct {
+	Path string
+
+	lock    sync.Mutex
+	modTime time.Time
+	urls    []string
+}
+
+//Discover returns the URLs listed in the file
+func (f *FileDiscoverer) Discover() (urls []string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return
+	}
+
+	if info.ModTime().Equal(f.modTime) {
+		return f.urls, nil
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &urls)
+	default:
+		err = json.Unmarshal(data, &urls)
+	}
+
+	if err == nil {
+		f.modTime, f.urls = info.ModTime(), urls
+	}
+	return
+}
+
+//SRVDiscoverer turns the DNS SRV records of a service into target endpoints of the form scheme://host:port
+type SRVDiscoverer struct {
+	Service string
+	Proto   string
+	Name    string
+	Scheme  string
+
+	lookup func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+//Discover returns one URL per SRV record, ordered by priority and then weight as returned by the resolver
+func (s *SRVDiscoverer) Discover() (urls []string, err error) {
+	_, records, err := s.lookup(s.Service, s.Proto, s.Name)
+	if err != nil {
+		return
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		urls = append(urls, fmt.Sprintf("%s://%s", s.Scheme, net.JoinHostPort(host, fmt.Sprint(record.Port))))
+	}
+	return
+}
+
+//refresh asks the pool's Discoverer for the current endpoints. A failed or empty discovery keeps the
+//endpoints the pool already has
+func (p *EndpointPool) refresh() {
+	urls, err := p.Discoverer.Discover()
+	if err != nil {
+		logging.Error(p).Log(logging.MessageKey(), "target discovery failed", logging.ErrorKey(), err)
+		return
+	}
+
+	if len(urls) == 0 {
+		logging.Error(p).Log(logging.MessageKey(), "target discovery returned no endpoints, keeping the current ones")
+		return
+	}
+
+	p.Update(urls)
+}
+
+//Refresh updates the endpoints from the pool's Discoverer every RefreshInterval until shutdown is closed.
+//Nothing is done if the pool has no Discoverer
+func (p *EndpointPool) Refresh(shutdown <-chan struct{}) {
+	if p.Discoverer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(p.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			p.refresh()
+		}
+	}
+}
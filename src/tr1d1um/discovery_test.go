@@ -0,0 +1,126 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDiscoverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("JSON", func(t *testing.T) {
+		assert := assert.New(t)
+		file := filepath.Join(dir, "targets.json")
+		assert.Nil(ioutil.WriteFile(file, []byte(`["http://a:8080", "http://b:8080"]`), 0644))
+
+		discoverer := &FileDiscoverer{Path: file}
+		urls, err := discoverer.Discover()
+		assert.Nil(err)
+		assert.EqualValues([]string{"http://a:8080", "http://b:8080"}, urls)
+
+		assert.Nil(ioutil.WriteFile(file, []byte(`["http://c:8080"]`), 0644))
+		assert.Nil(os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+		urls, err = discoverer.Discover()
+		assert.Nil(err)
+		assert.EqualValues([]string{"http://c:8080"}, urls)
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		assert := assert.New(t)
+		file := filepath.Join(dir, "targets.yaml")
+		assert.Nil(ioutil.WriteFile(file, []byte("- http://a:8080\n- http://b:8080\n"), 0644))
+
+		urls, err := (&FileDiscoverer{Path: file}).Discover()
+		assert.Nil(err)
+		assert.EqualValues([]string{"http://a:8080", "http://b:8080"}, urls)
+	})
+}
+
+func TestSRVDiscoverer(t *testing.T) {
+	assert := assert.New(t)
+	discoverer := &SRVDiscoverer{
+		Service: "talaria", Proto: "tcp", Name: "example.com", Scheme: "https",
+		lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+			assert.EqualValues("talaria", service)
+			return "", []*net.SRV{
+				{Target: "talaria-2.example.com.", Port: 6200, Priority: 20},
+				{Target: "talaria-1.example.com.", Port: 6200, Priority: 10},
+			}, nil
+		},
+	}
+
+	urls, err := discoverer.Discover()
+	assert.Nil(err)
+	assert.EqualValues([]string{"https://talaria-1.example.com:6200", "https://talaria-2.example.com:6200"}, urls)
+}
+
+type failingDiscoverer struct{}
+
+func (failingDiscoverer) Discover() ([]string, error) { return nil, errors.New("dns down") }
+
+func TestEndpointPoolRefresh(t *testing.T) {
+	assert := assert.New(t)
+	pool := newTestEndpointPool(t, BalanceRoundRobin, "http://a")
+	pool.Discoverer = failingDiscoverer{}
+
+	pool.refresh()
+	assert.EqualValues([]string{"http://a"}, pool.URLs())
+}
+
+func TestNewServiceRouteWithDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "discovery")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "targets.json")
+	assert.Nil(ioutil.WriteFile(file, []byte(`["http://a:8080"]`), 0644))
+
+	config := ServiceConfig{
+		TargetURL:         "http://ignored.com",
+		RequestMaxRetries: 1,
+		LoadBalancer:      defaultLoadBalancerConfig(),
+		Discovery:         DiscoveryConfig{Type: "file", File: file, RefreshInterval: "1s"},
+	}
+
+	route, err := newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+	assert.EqualValues("/api/v2/device", route.WRPRequestURL)
+	assert.EqualValues([]string{"http://a:8080"}, route.Endpoints.URLs())
+	assert.EqualValues("http://a:8080/api/v2/device", route.Endpoints.Rewrite(route.WRPRequestURL, route.Endpoints.Acquire("", nil)))
+}
+
+func TestNewDiscovererNonPositiveRefreshInterval(t *testing.T) {
+	assert := assert.New(t)
+	discoverer, _, err := NewDiscoverer(DiscoveryConfig{Type: "file", File: "targets.json", RefreshInterval: "0s"})
+	assert.Nil(discoverer)
+	assert.EqualValues(errNonPositiveRefreshInterval, err)
+}
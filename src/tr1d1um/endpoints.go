@@ -0,0 +1,357 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	targetURLsKey   = "targetURLs"
+	loadBalancerKey = "loadBalancer"
+
+	defaultHealthCheckInterval = "10s"
+	defaultHealthCheckTimeout  = "2s"
+	defaultEndpointMaxFailures = 3
+	defaultEndpointEjection    = "30s"
+)
+
+var errNonPositiveHealthCheckInterval = errors.New("loadBalancer: healthCheckInterval must be positive")
+
+//Supported endpoint selection strategies
+const (
+	BalanceRoundRobin       = "roundRobin"
+	BalanceLeastOutstanding = "leastOutstanding"
+	BalanceConsistentHash   = "consistentHash"
+)
+
+//LoadBalancerConfig defines the loadBalancer section of the configuration file, which applies whenever
+//targetURLs lists more than one endpoint
+type LoadBalancerConfig struct {
+	Strategy            string `json:"strategy"`
+	HealthCheckPath     string `json:"healthCheckPath"`
+	HealthCheckInterval string `json:"healthCheckInterval"`
+	HealthCheckTimeout  string `json:"healthCheckTimeout"`
+	MaxFailures         int    `json:"maxFailures"`
+	EjectionDuration    string `json:"ejectionDuration"`
+
+	// Replicas is the number of points each endpoint gets on the consistentHash ring
+	Replicas int `json:"replicas"`
+}
+
+//defaultLoadBalancerConfig returns the settings used for anything the loadBalancer section leaves out
+func defaultLoadBalancerConfig() LoadBalancerConfig {
+	return LoadBalancerConfig{
+		Strategy:            BalanceRoundRobin,
+		HealthCheckInterval: defaultHealthCheckInterval,
+		HealthCheckTimeout:  defaultHealthCheckTimeout,
+		MaxFailures:         defaultEndpointMaxFailures,
+		EjectionDuration:    defaultEndpointEjection,
+		Replicas:            defaultHashReplicas,
+	}
+}
+
+//Endpoint is a single target instance requests can be sent to
+type Endpoint struct {
+	URL string
+
+	unhealthy    bool
+	failures     int
+	ejectedUntil time.Time
+	outstanding  int
+}
+
+//EndpointPool spreads requests over a set of target endpoints. Requests are built with URLs relative to the target
+//and the URL of the selected endpoint is prepended to them. Endpoints that fail their active health check,
+//or that fail MaxFailures requests in a row, are skipped until they recover
+type EndpointPool struct {
+	log.Logger
+	Strategy            string
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	MaxFailures         int
+	EjectionDuration    time.Duration
+	Replicas            int
+
+	//Discoverer, if set, refreshes the endpoints every RefreshInterval
+	Discoverer      Discoverer
+	RefreshInterval time.Duration
+
+	client    *http.Client
+	lock      sync.Mutex
+	endpoints []*Endpoint
+	ring      *hashRing
+	next      int
+	now       func() time.Time
+}
+
+//NewEndpointPool builds an EndpointPool for the given endpoint URLs
+func NewEndpointPool(urls []string, config LoadBalancerConfig, logger log.Logger) (pool *EndpointPool, err error) {
+	switch config.Strategy {
+	case BalanceRoundRobin, BalanceLeastOutstanding, BalanceConsistentHash:
+	default:
+		return nil, fmt.Errorf("loadBalancer: unsupported strategy '%s'", config.Strategy)
+	}
+
+	healthCheckInterval, err := time.ParseDuration(config.HealthCheckInterval)
+	if err != nil {
+		return
+	}
+
+	if config.HealthCheckPath != "" && healthCheckInterval <= 0 {
+		return nil, errNonPositiveHealthCheckInterval
+	}
+
+	healthCheckTimeout, err := time.ParseDuration(config.HealthCheckTimeout)
+	if err != nil {
+		return
+	}
+
+	ejectionDuration, err := time.ParseDuration(config.EjectionDuration)
+	if err != nil {
+		return
+	}
+
+	pool = &EndpointPool{
+		Logger:              logger,
+		Strategy:            config.Strategy,
+		HealthCheckPath:     config.HealthCheckPath,
+		HealthCheckInterval: healthCheckInterval,
+		MaxFailures:         config.MaxFailures,
+		EjectionDuration:    ejectionDuration,
+		Replicas:            config.Replicas,
+		client:              &http.Client{Timeout: healthCheckTimeout},
+		now:                 time.Now,
+	}
+
+	pool.Update(urls)
+	return
+}
+
+//Update replaces the set of endpoints. Endpoints that are kept retain their health information
+func (p *EndpointPool) Update(urls []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	current := make(map[string]*Endpoint, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		current[endpoint.URL] = endpoint
+	}
+
+	endpoints := make([]*Endpoint, 0, len(urls))
+	for _, url := range urls {
+		url = strings.TrimSuffix(url, "/")
+		if endpoint, ok := current[url]; ok {
+			endpoints = append(endpoints, endpoint)
+		} else {
+			endpoints = append(endpoints, &Endpoint{URL: url})
+		}
+	}
+
+	p.endpoints = endpoints
+
+	if p.Strategy == BalanceConsistentHash {
+		urls := make([]string, len(endpoints))
+		for i, endpoint := range endpoints {
+			urls[i] = endpoint.URL
+		}
+		p.ring = newHashRing(urls, p.Replicas)
+	}
+}
+
+//URLs returns the URLs of all endpoints in the pool
+func (p *EndpointPool) URLs() (urls []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, endpoint := range p.endpoints {
+		urls = append(urls, endpoint.URL)
+	}
+	return
+}
+
+//Acquire selects the endpoint the next request should go to and counts it as outstanding. The key, i.e. the
+//canonical device ID, is only used by the consistentHash strategy. Endpoints listed in tried are avoided as long
+//as some other endpoint is available. If no endpoint is available at all, every endpoint is considered rather
+//than failing the request outright
+func (p *EndpointPool) Acquire(key string, tried map[string]struct{}) *Endpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.endpoints) == 0 {
+		return nil
+	}
+
+	now := p.now()
+	var available, untried []*Endpoint
+
+	for _, endpoint := range p.endpoints {
+		if endpoint.unhealthy || now.Before(endpoint.ejectedUntil) {
+			continue
+		}
+
+		available = append(available, endpoint)
+		if _, ok := tried[endpoint.URL]; !ok {
+			untried = append(untried, endpoint)
+		}
+	}
+
+	candidates := untried
+	if len(candidates) == 0 {
+		candidates = available
+	}
+
+	if len(candidates) == 0 {
+		logging.Error(p).Log(logging.MessageKey(), "no healthy target endpoint, trying all of them")
+		candidates = p.endpoints
+	}
+
+	endpoint := p.pick(key, candidates)
+	endpoint.outstanding++
+	return endpoint
+}
+
+func (p *EndpointPool) pick(key string, candidates []*Endpoint) (selected *Endpoint) {
+	if p.Strategy == BalanceConsistentHash && key != "" && p.ring != nil {
+		byURL := make(map[string]*Endpoint, len(candidates))
+		for _, candidate := range candidates {
+			byURL[candidate.URL] = candidate
+		}
+
+		p.ring.walk(key, func(url string) bool {
+			selected = byURL[url]
+			return selected != nil
+		})
+
+		if selected != nil {
+			return
+		}
+	}
+
+	if p.Strategy == BalanceLeastOutstanding {
+		for _, candidate := range candidates {
+			if selected == nil || candidate.outstanding < selected.outstanding {
+				selected = candidate
+			}
+		}
+		return
+	}
+
+	selected = candidates[p.next%len(candidates)]
+	p.next++
+	return
+}
+
+//Release accounts for the outcome of a request sent to the given endpoint. An endpoint that fails MaxFailures
+//requests in a row is ejected for EjectionDuration
+func (p *EndpointPool) Release(endpoint *Endpoint, failed bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	endpoint.outstanding--
+
+	if !failed {
+		endpoint.failures = 0
+		return
+	}
+
+	if endpoint.failures++; p.MaxFailures > 0 && endpoint.failures >= p.MaxFailures {
+		endpoint.failures = 0
+		endpoint.ejectedUntil = p.now().Add(p.EjectionDuration)
+		logging.Error(p).Log(logging.MessageKey(), "ejecting failing target endpoint", "endpoint", endpoint.URL,
+			"until", endpoint.ejectedUntil)
+	}
+}
+
+//Rewrite points the given request URL, relative to the target, to the given endpoint
+func (p *EndpointPool) Rewrite(url string, endpoint *Endpoint) string {
+	if !strings.HasPrefix(url, "/") {
+		return url
+	}
+	return endpoint.URL + url
+}
+
+//HealthCheck probes every endpoint on HealthCheckPath each HealthCheckInterval until shutdown is closed.
+//Nothing is done if no HealthCheckPath is configured
+func (p *EndpointPool) HealthCheck(shutdown <-chan struct{}) {
+	if p.HealthCheckPath == "" {
+		return
+	}
+
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			p.checkAll()
+		}
+	}
+}
+
+func (p *EndpointPool) checkAll() {
+	for _, url := range p.URLs() {
+		healthy := p.check(url)
+
+		p.lock.Lock()
+		for _, endpoint := range p.endpoints {
+			if endpoint.URL == url {
+				if endpoint.unhealthy == healthy {
+					logging.Info(p).Log(logging.MessageKey(), "target endpoint health changed", "endpoint", url, "healthy", healthy)
+				}
+				endpoint.unhealthy = !healthy
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+//check returns true if the endpoint answers its health check with a 2xx
+func (p *EndpointPool) check(url string) bool {
+	resp, err := p.client.Get(url + p.HealthCheckPath)
+	if err != nil {
+		return false
+	}
+
+	resp.Body.Close()
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices
+}
+
+//endpointPools returns the endpoint pools of the default route and of every service route
+func (ch *ConversionHandler) endpointPools() (pools []*EndpointPool) {
+	if ch.Endpoints != nil {
+		pools = append(pools, ch.Endpoints)
+	}
+
+	for _, route := range ch.Services {
+		if route.Endpoints != nil {
+			pools = append(pools, route.Endpoints)
+		}
+	}
+	return
+}
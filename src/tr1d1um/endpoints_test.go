@@ -0,0 +1,149 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEndpointPool(t *testing.T, strategy string, urls ...string) *EndpointPool {
+	config := defaultLoadBalancerConfig()
+	config.Strategy = strategy
+	config.HealthCheckPath = "/health"
+
+	pool, err := NewEndpointPool(urls, config, logging.DefaultLogger())
+	assert.Nil(t, err)
+	return pool
+}
+
+func TestEndpointPoolSelection(t *testing.T) {
+	t.Run("RoundRobin", func(t *testing.T) {
+		assert := assert.New(t)
+		pool := newTestEndpointPool(t, BalanceRoundRobin, "http://a", "http://b")
+
+		first, second := pool.Acquire("", nil), pool.Acquire("", nil)
+		assert.NotEqual(first.URL, second.URL)
+	})
+
+	t.Run("LeastOutstanding", func(t *testing.T) {
+		assert := assert.New(t)
+		pool := newTestEndpointPool(t, BalanceLeastOutstanding, "http://a", "http://b")
+
+		busy := pool.Acquire("", nil)
+		assert.NotEqual(busy.URL, pool.Acquire("", nil).URL)
+	})
+
+	t.Run("PrefersUntried", func(t *testing.T) {
+		assert := assert.New(t)
+		pool := newTestEndpointPool(t, BalanceRoundRobin, "http://a", "http://b")
+
+		for i := 0; i < 4; i++ {
+			assert.EqualValues("http://b", pool.Acquire("", map[string]struct{}{"http://a": {}}).URL)
+		}
+	})
+
+	t.Run("PassiveEjection", func(t *testing.T) {
+		assert := assert.New(t)
+		pool := newTestEndpointPool(t, BalanceRoundRobin, "http://a", "http://b")
+		pool.MaxFailures = 2
+
+		a := pool.endpoints[0]
+		pool.Release(a, true)
+		pool.Release(a, true)
+
+		for i := 0; i < 4; i++ {
+			assert.EqualValues("http://b", pool.Acquire("", nil).URL)
+		}
+	})
+
+	t.Run("UnsupportedStrategy", func(t *testing.T) {
+		config := defaultLoadBalancerConfig()
+		config.Strategy = "random"
+
+		_, err := NewEndpointPool([]string{"http://a"}, config, logging.DefaultLogger())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("NonPositiveHealthCheckInterval", func(t *testing.T) {
+		config := defaultLoadBalancerConfig()
+		config.HealthCheckPath, config.HealthCheckInterval = "/health", "0s"
+
+		_, err := NewEndpointPool([]string{"http://a"}, config, logging.DefaultLogger())
+		assert.EqualValues(t, errNonPositiveHealthCheckInterval, err)
+	})
+}
+
+func TestEndpointPoolHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues("/health", r.URL.Path)
+	}))
+	defer healthy.Close()
+
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer sick.Close()
+
+	pool := newTestEndpointPool(t, BalanceRoundRobin, sick.URL, healthy.URL)
+	pool.checkAll()
+
+	for i := 0; i < 4; i++ {
+		assert.EqualValues(healthy.URL, pool.Acquire("", nil).URL)
+	}
+}
+
+func TestMakeRequestRetriesOtherEndpoint(t *testing.T) {
+	assert := assert.New(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues("/api/v2/device", r.URL.Path)
+	}))
+	defer up.Close()
+
+	tr1 := &Tr1SendAndHandle{
+		RespTimeout: time.Second,
+		Logger:      logging.DefaultLogger(),
+		Endpoints:   newTestEndpointPool(t, BalanceRoundRobin, down.URL, up.URL),
+		client:      &http.Client{},
+	}
+
+	tr1Request := Tr1d1umRequest{
+		method:      http.MethodPost,
+		URL:         "/api/v2/device",
+		rawResponse: true,
+		tried:       map[string]struct{}{},
+	}
+
+	first, _ := tr1.MakeRequest(context.Background(), tr1Request)
+	assert.EqualValues(http.StatusBadGateway, first.(*Tr1d1umResponse).Code)
+
+	second, _ := tr1.MakeRequest(context.Background(), tr1Request)
+	assert.EqualValues(http.StatusOK, second.(*Tr1d1umResponse).Code)
+}
@@ -0,0 +1,397 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/spf13/viper"
+)
+
+const (
+	eventStreamKey = "eventStream"
+
+	defaultEventBufferSize  = 100
+	defaultEventMaxDropped  = 10
+	defaultEventKeepAlive   = "15s"
+	eventDestinationPrefix  = "event:"
+	eventStreamContentType  = "text/event-stream"
+	eventStreamDeviceIDKey  = "deviceid"
+	eventStreamEventTypeKey = "event"
+
+	//maxIngestBodySize caps the size of a single ingested event
+	maxIngestBodySize = 1 << 20
+)
+
+var (
+	errNonPositiveKeepAlive  = errors.New("eventStream keepAlive must be positive")
+	errNonPositiveBufferSize = errors.New("eventStream bufferSize must be positive")
+	errNonPositiveMaxDropped = errors.New("eventStream maxDropped must be positive")
+	errMissingIngestSecret   = errors.New("eventStream ingestSecret is required")
+)
+
+//ingestHashes are the algorithms event senders may sign their deliveries with
+var ingestHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+//EventStreamConfig defines the eventStream section of the configuration file
+type EventStreamConfig struct {
+	BufferSize int    `json:"bufferSize"`
+	MaxDropped int    `json:"maxDropped"`
+	KeepAlive  string `json:"keepAlive"`
+
+	// IngestSecret is shared with the event senders, which sign each delivery with it in the X-Webpa-Signature
+	// header. Events cannot be ingested without it
+	IngestSecret string `json:"ingestSecret"`
+}
+
+//eventType returns the type of the given event message, i.e. "device-status/mac:112233445566/online"
+//for a message whose destination is "event:device-status/mac:112233445566/online"
+func eventType(msg *wrp.Message) string {
+	return strings.TrimPrefix(msg.Destination, eventDestinationPrefix)
+}
+
+//EventSubscription is a single client's interest in device events. Matching events are queued in Events until
+//the client's connection can take them
+type EventSubscription struct {
+	Events     chan *wrp.Message
+	deviceIDs  map[device.ID]struct{}
+	eventTypes []*regexp.Regexp
+	dropped    int
+	closed     bool
+}
+
+//matches returns true if the given event comes from one of the subscribed devices and its type
+//matches any of the subscribed patterns. Empty lists match everything
+func (s *EventSubscription) matches(deviceID device.ID, msg *wrp.Message) bool {
+	if len(s.deviceIDs) > 0 {
+		if _, ok := s.deviceIDs[deviceID]; !ok {
+			return false
+		}
+	}
+
+	if len(s.eventTypes) == 0 {
+		return true
+	}
+
+	for _, pattern := range s.eventTypes {
+		if pattern.MatchString(eventType(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+//EventBroker fans ingested device events out to all subscriptions interested in them
+type EventBroker struct {
+	log.Logger
+	BufferSize int
+	MaxDropped int
+
+	lock          sync.Mutex
+	subscriptions map[*EventSubscription]struct{}
+}
+
+//NewEventBroker returns an EventBroker without subscriptions
+func NewEventBroker(bufferSize, maxDropped int, logger log.Logger) *EventBroker {
+	return &EventBroker{
+		Logger:        logger,
+		BufferSize:    bufferSize,
+		MaxDropped:    maxDropped,
+		subscriptions: map[*EventSubscription]struct{}{},
+	}
+}
+
+//Subscribe registers a new subscription for the given devices and event type patterns
+func (b *EventBroker) Subscribe(deviceIDs []device.ID, eventTypes []*regexp.Regexp) *EventSubscription {
+	s := &EventSubscription{
+		Events:     make(chan *wrp.Message, b.BufferSize),
+		deviceIDs:  make(map[device.ID]struct{}, len(deviceIDs)),
+		eventTypes: eventTypes,
+	}
+
+	for _, deviceID := range deviceIDs {
+		s.deviceIDs[deviceID] = struct{}{}
+	}
+
+	b.lock.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.lock.Unlock()
+	return s
+}
+
+//Unsubscribe removes the given subscription and closes its Events channel
+func (b *EventBroker) Unsubscribe(s *EventSubscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.remove(s)
+}
+
+func (b *EventBroker) remove(s *EventSubscription) {
+	if !s.closed {
+		delete(b.subscriptions, s)
+		close(s.Events)
+		s.closed = true
+	}
+}
+
+//Publish queues the given event on every matching subscription. Publishing never blocks: a subscription whose
+//buffer is full misses the event, and it is dropped altogether once it has missed MaxDropped events in a row
+func (b *EventBroker) Publish(msg *wrp.Message) {
+	deviceID, _ := device.ParseID(msg.Source)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for s := range b.subscriptions {
+		if !s.matches(deviceID, msg) {
+			continue
+		}
+
+		select {
+		case s.Events <- msg:
+			s.dropped = 0
+		default:
+			if s.dropped++; s.dropped >= b.MaxDropped {
+				logging.Info(b).Log(logging.MessageKey(), "dropping slow event stream subscriber", "missedEvents", s.dropped)
+				b.remove(s)
+			}
+		}
+	}
+}
+
+//EventStreamHandler serves the ingest route that receives event deliveries as well as the client facing
+//Server-Sent Events stream
+type EventStreamHandler struct {
+	log.Logger
+	Broker     *EventBroker
+	Dispatcher *HookDispatcher
+	Resolver   DeviceResolver
+	KeepAlive  time.Duration
+
+	IngestSecret string
+}
+
+//verifySignature returns true if the given signature header, i.e. sha1=<hex encoded HMAC>, is the one the
+//ingest secret gives the body
+func (es *EventStreamHandler) verifySignature(signature string, body []byte) bool {
+	parts := strings.SplitN(signature, "=", 2)
+	if len(parts) != 2 || es.IngestSecret == "" {
+		return false
+	}
+
+	newHash, ok := ingestHashes[parts[0]]
+	if !ok {
+		return false
+	}
+
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(es.IngestSecret))
+	mac.Write(body)
+	return hmac.Equal(expected, mac.Sum(nil))
+}
+
+//HandleIngest accepts a single WRP event, in either msgpack or JSON format, and publishes it to the broker
+//as well as to the webhook dispatcher, if any. Events must be signed with the ingest secret
+func (es *EventStreamHandler) HandleIngest(origin http.ResponseWriter, req *http.Request) {
+	format := wrp.JSON
+	if req.Header.Get(contentTypeKey) == wrp.Msgpack.ContentType() {
+		format = wrp.Msgpack
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxIngestBodySize))
+	if err != nil {
+		WriteResponseWriter("could not read event", http.StatusBadRequest, origin)
+		return
+	}
+
+	if !es.verifySignature(req.Header.Get(HeaderWebhookSignature), body) {
+		logging.Error(es).Log(logging.MessageKey(), "rejected event with a missing or invalid signature", "remoteAddress", req.RemoteAddr)
+		WriteResponseWriter("Invalid signature", http.StatusForbidden, origin)
+		return
+	}
+
+	msg := new(wrp.Message)
+	if err := wrp.NewDecoder(bytes.NewReader(body), format).Decode(msg); err != nil {
+		WriteResponseWriter("could not decode event", http.StatusBadRequest, origin)
+		logging.Error(es).Log(logging.MessageKey(), "could not decode event", logging.ErrorKey(), err)
+		return
+	}
+
+	es.Broker.Publish(msg)
+
+	if es.Dispatcher != nil {
+		es.Dispatcher.Dispatch(msg)
+	}
+
+	origin.WriteHeader(http.StatusAccepted)
+}
+
+//HandleStream streams the events that match the deviceid and event query parameters until the client goes away
+func (es *EventStreamHandler) HandleStream(origin http.ResponseWriter, req *http.Request) {
+	flusher, ok := origin.(http.Flusher)
+	if !ok {
+		WriteResponseWriter("streaming unsupported", http.StatusInternalServerError, origin)
+		return
+	}
+
+	deviceIDs, eventTypes, err := es.parseSubscription(req)
+	if err == errDeviceLookupUnavailable {
+		WriteProblemWriter(ProblemDeviceLookupUnavailable, http.StatusServiceUnavailable, err.Error(), origin)
+		return
+	} else if err != nil {
+		WriteResponseWriter(err.Error(), http.StatusBadRequest, origin)
+		return
+	}
+
+	subscription := es.Broker.Subscribe(deviceIDs, eventTypes)
+	defer es.Broker.Unsubscribe(subscription)
+
+	origin.Header().Set(contentTypeKey, eventStreamContentType)
+	origin.Header().Set("Cache-Control", "no-cache")
+	origin.Header().Set("Connection", "keep-alive")
+	origin.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(es.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(origin, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case msg, open := <-subscription.Events:
+			if !open {
+				return
+			}
+
+			var data bytes.Buffer
+			if err := wrp.NewEncoder(&data, wrp.JSON).Encode(msg); err != nil {
+				logging.Error(es).Log(logging.MessageKey(), "could not encode event", logging.ErrorKey(), err)
+				continue
+			}
+
+			fmt.Fprintf(origin, "id: %s\nevent: %s\ndata: %s\n\n", msg.TransactionUUID, eventType(msg), bytes.TrimSpace(data.Bytes()))
+			flusher.Flush()
+		}
+	}
+}
+
+//parseSubscription reads the device IDs and event type patterns a client wants to subscribe to
+func (es *EventStreamHandler) parseSubscription(req *http.Request) (deviceIDs []device.ID, eventTypes []*regexp.Regexp, err error) {
+	query := req.URL.Query()
+
+	for _, id := range query[eventStreamDeviceIDKey] {
+		var deviceID device.ID
+		if deviceID, err = resolveDeviceID(req.Context(), es.Resolver, id); err == errDeviceLookupUnavailable {
+			return
+		} else if err != nil {
+			err = fmt.Errorf("Invalid deviceID: %s", err)
+			return
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	for _, pattern := range query[eventStreamEventTypeKey] {
+		var eventTypePattern *regexp.Regexp
+		if eventTypePattern, err = regexp.Compile(pattern); err != nil {
+			err = fmt.Errorf("Invalid event pattern: %s", err)
+			return
+		}
+		eventTypes = append(eventTypes, eventTypePattern)
+	}
+
+	return
+}
+
+//ConfigureEventStream sets the route paths for the event ingest and stream endpoints
+//baseRouter is pre-configured with the api/v2 prefix path. The ingest endpoint is not for API clients so it
+//skips the preHandler and authenticates senders by the signature of their deliveries instead
+func ConfigureEventStream(baseRouter *mux.Router, preHandler *alice.Chain, v *viper.Viper, logger log.Logger, resolver DeviceResolver,
+	dispatcher *HookDispatcher) (err error) {
+	config := EventStreamConfig{
+		BufferSize: defaultEventBufferSize,
+		MaxDropped: defaultEventMaxDropped,
+		KeepAlive:  defaultEventKeepAlive,
+	}
+
+	if err = v.UnmarshalKey(eventStreamKey, &config); err != nil {
+		return
+	}
+
+	keepAlive, err := time.ParseDuration(config.KeepAlive)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case keepAlive <= 0:
+		return errNonPositiveKeepAlive
+	case config.BufferSize <= 0:
+		return errNonPositiveBufferSize
+	case config.MaxDropped <= 0:
+		return errNonPositiveMaxDropped
+	case config.IngestSecret == "":
+		return errMissingIngestSecret
+	}
+
+	es := &EventStreamHandler{
+		Logger:     logger,
+		Broker:     NewEventBroker(config.BufferSize, config.MaxDropped, logger),
+		Dispatcher: dispatcher,
+		Resolver:   resolver,
+		KeepAlive:  keepAlive,
+
+		IngestSecret: config.IngestSecret,
+	}
+
+	baseRouter.HandleFunc("/events/ingest", es.HandleIngest).Methods(http.MethodPost)
+	baseRouter.Handle("/events/stream", preHandler.ThenFunc(es.HandleStream)).Methods(http.MethodGet)
+	return
+}
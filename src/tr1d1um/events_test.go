@@ -0,0 +1,230 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBroker(t *testing.T) {
+	onlineEvent := &wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566/service",
+		Destination: "event:device-status/mac:112233445566/online",
+	}
+
+	t.Run("Matching", func(t *testing.T) {
+		assert := assert.New(t)
+		broker := NewEventBroker(1, 1, logging.DefaultLogger())
+
+		matching := broker.Subscribe([]device.ID{"mac:112233445566"}, []*regexp.Regexp{regexp.MustCompile("^device-status/")})
+		otherDevice := broker.Subscribe([]device.ID{"mac:aabbccddeeff"}, nil)
+		otherType := broker.Subscribe(nil, []*regexp.Regexp{regexp.MustCompile("^iot")})
+
+		broker.Publish(onlineEvent)
+
+		assert.Len(matching.Events, 1)
+		assert.Len(otherDevice.Events, 0)
+		assert.Len(otherType.Events, 0)
+	})
+
+	t.Run("SlowSubscriber", func(t *testing.T) {
+		assert := assert.New(t)
+		broker := NewEventBroker(1, 2, logging.DefaultLogger())
+		subscription := broker.Subscribe(nil, nil)
+
+		broker.Publish(onlineEvent)
+		broker.Publish(onlineEvent)
+		assert.Len(broker.subscriptions, 1)
+
+		broker.Publish(onlineEvent)
+		assert.Len(broker.subscriptions, 0)
+		assert.True(subscription.closed)
+
+		//unsubscribing a dropped subscription must not panic
+		broker.Unsubscribe(subscription)
+	})
+}
+
+func TestEventStreamHandler(t *testing.T) {
+	t.Run("InvalidDeviceID", func(t *testing.T) {
+		assert := assert.New(t)
+		es := &EventStreamHandler{Logger: logging.DefaultLogger(), Broker: NewEventBroker(1, 1, logging.DefaultLogger()), KeepAlive: time.Minute}
+		recorder := httptest.NewRecorder()
+
+		es.HandleStream(recorder, httptest.NewRequest(http.MethodGet, "http://someURL/events/stream?deviceid=wut", nil))
+		assert.EqualValues(http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("IngestAndStream", func(t *testing.T) {
+		assert := assert.New(t)
+		es := &EventStreamHandler{Logger: logging.DefaultLogger(), Broker: NewEventBroker(1, 1, logging.DefaultLogger()), KeepAlive: time.Minute,
+			IngestSecret: "secret"}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://someURL/events/stream?event=online", nil).WithContext(ctx)
+
+		done := make(chan struct{})
+		go func() {
+			es.HandleStream(recorder, req)
+			close(done)
+		}()
+
+		for {
+			es.Broker.lock.Lock()
+			subscribed := len(es.Broker.subscriptions) > 0
+			es.Broker.lock.Unlock()
+			if subscribed {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		var event bytes.Buffer
+		wrp.NewEncoder(&event, wrp.JSON).Encode(&wrp.Message{
+			Type:            wrp.SimpleEventMessageType,
+			Source:          "mac:112233445566",
+			Destination:     "event:device-status/mac:112233445566/online",
+			TransactionUUID: "tid",
+		})
+
+		ingestRecorder := httptest.NewRecorder()
+		ingest := httptest.NewRequest(http.MethodPost, "http://someURL/events/ingest", bytes.NewReader(event.Bytes()))
+		ingest.Header.Set(HeaderWebhookSignature, signIngest("sha1", "secret", event.Bytes()))
+
+		es.HandleIngest(ingestRecorder, ingest)
+		assert.EqualValues(http.StatusAccepted, ingestRecorder.Code)
+
+		for {
+			es.Broker.lock.Lock()
+			pending := len(es.Broker.subscriptions) > 0 && len(es.Broker.subscriptionsList()[0].Events) > 0
+			es.Broker.lock.Unlock()
+			if !pending {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		<-done
+
+		assert.EqualValues(eventStreamContentType, recorder.Header().Get(contentTypeKey))
+		assert.True(strings.Contains(recorder.Body.String(), "event: device-status/mac:112233445566/online"))
+	})
+}
+
+func signIngest(algorithm, secret string, body []byte) string {
+	mac := hmac.New(ingestHashes[algorithm], []byte(secret))
+	mac.Write(body)
+	return algorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleIngestSignature(t *testing.T) {
+	event := []byte(`{"msg_type": 4, "source": "mac:112233445566", "dest": "event:device-status/mac:112233445566/online"}`)
+
+	testData := []struct {
+		name      string
+		signature string
+		expected  int
+	}{
+		{"Missing", "", http.StatusForbidden},
+		{"WrongSecret", signIngest("sha1", "wrong", event), http.StatusForbidden},
+		{"UnknownAlgorithm", "md5=abcd", http.StatusForbidden},
+		{"SHA1", signIngest("sha1", "secret", event), http.StatusAccepted},
+		{"SHA256", signIngest("sha256", "secret", event), http.StatusAccepted},
+	}
+
+	for _, record := range testData {
+		t.Run(record.name, func(t *testing.T) {
+			assert := assert.New(t)
+			es := &EventStreamHandler{Logger: logging.DefaultLogger(), Broker: NewEventBroker(1, 1, logging.DefaultLogger()), IngestSecret: "secret"}
+
+			req := httptest.NewRequest(http.MethodPost, "http://someURL/events/ingest", bytes.NewReader(event))
+			if record.signature != "" {
+				req.Header.Set(HeaderWebhookSignature, record.signature)
+			}
+
+			recorder := httptest.NewRecorder()
+			es.HandleIngest(recorder, req)
+			assert.EqualValues(record.expected, recorder.Code)
+		})
+	}
+}
+
+func TestConfigureEventStream(t *testing.T) {
+	t.Run("Invalid", func(t *testing.T) {
+		testData := []struct {
+			name     string
+			config   map[string]interface{}
+			expected error
+		}{
+			{"NonPositiveKeepAlive", map[string]interface{}{"keepAlive": "0s", "ingestSecret": "secret"}, errNonPositiveKeepAlive},
+			{"ZeroBufferSize", map[string]interface{}{"bufferSize": 0, "ingestSecret": "secret"}, errNonPositiveBufferSize},
+			{"NegativeBufferSize", map[string]interface{}{"bufferSize": -1, "ingestSecret": "secret"}, errNonPositiveBufferSize},
+			{"NegativeMaxDropped", map[string]interface{}{"maxDropped": -1, "ingestSecret": "secret"}, errNonPositiveMaxDropped},
+			{"NoSecret", map[string]interface{}{"bufferSize": 1}, errMissingIngestSecret},
+		}
+
+		for _, record := range testData {
+			t.Run(record.name, func(t *testing.T) {
+				v := viper.New()
+				v.Set(eventStreamKey, record.config)
+
+				err := ConfigureEventStream(mux.NewRouter(), &alice.Chain{}, v, logging.DefaultLogger(), nil, nil)
+				assert.EqualValues(t, record.expected, err)
+			})
+		}
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		assert := assert.New(t)
+		v, router := viper.New(), mux.NewRouter()
+		v.Set(eventStreamKey, map[string]interface{}{"ingestSecret": "secret"})
+
+		assert.Nil(ConfigureEventStream(router, &alice.Chain{}, v, logging.DefaultLogger(), nil, nil))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "http://someURL/events/ingest", strings.NewReader("{}")))
+		assert.EqualValues(http.StatusForbidden, recorder.Code)
+	})
+}
+
+func (b *EventBroker) subscriptionsList() (list []*EventSubscription) {
+	for s := range b.subscriptions {
+		list = append(list, s)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const defaultHashReplicas = 100
+
+//hashRing places every endpoint at Replicas points of a 32 bit hash circle. A key belongs to the first
+//endpoint found walking the circle clockwise from the key's hash, so adding or removing an endpoint
+//only moves the keys that land next to its points
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+//newHashRing builds the ring of the given endpoint URLs
+func newHashRing(urls []string, replicas int) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string, len(urls)*replicas)}
+
+	for _, url := range urls {
+		for i := 0; i < replicas; i++ {
+			point := hashKey(url + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; !taken {
+				ring.owners[point] = url
+				ring.points = append(ring.points, point)
+			}
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+//walk calls visit with the distinct endpoints of the ring in the order they are found starting at the given key,
+//until visit returns true
+func (r *hashRing) walk(key string, visit func(url string) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+
+	hash := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	seen := map[string]struct{}{}
+
+	for i := 0; i < len(r.points); i++ {
+		url := r.owners[r.points[(start+i)%len(r.points)]]
+		if _, visited := seen[url]; visited {
+			continue
+		}
+
+		seen[url] = struct{}{}
+		if visit(url) {
+			return
+		}
+	}
+}
+
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
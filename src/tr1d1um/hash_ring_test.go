@@ -0,0 +1,85 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+
+	owner := func(ring *hashRing, key string) (owner string) {
+		ring.walk(key, func(url string) bool {
+			owner = url
+			return true
+		})
+		return
+	}
+
+	t.Run("Stable", func(t *testing.T) {
+		assert := assert.New(t)
+		ring := newHashRing(urls, defaultHashReplicas)
+		assert.EqualValues(owner(ring, "mac:112233445566"), owner(newHashRing(urls, defaultHashReplicas), "mac:112233445566"))
+	})
+
+	t.Run("MinimalMovement", func(t *testing.T) {
+		assert := assert.New(t)
+		before := newHashRing(urls, defaultHashReplicas)
+		after := newHashRing(append(urls, "http://d"), defaultHashReplicas)
+
+		moved := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("mac:%012x", i)
+			if previous, current := owner(before, key), owner(after, key); previous != current {
+				assert.EqualValues("http://d", current)
+				moved++
+			}
+		}
+
+		assert.True(moved > 0 && moved < 500, "moved %d keys", moved)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.EqualValues(t, "", owner(newHashRing(nil, defaultHashReplicas), "mac:112233445566"))
+	})
+}
+
+func TestEndpointPoolConsistentHash(t *testing.T) {
+	assert := assert.New(t)
+	pool := newTestEndpointPool(t, BalanceConsistentHash, "http://a", "http://b", "http://c")
+	key := "mac:112233445566"
+
+	owner := pool.Acquire(key, nil).URL
+	for i := 0; i < 4; i++ {
+		assert.EqualValues(owner, pool.Acquire(key, nil).URL)
+	}
+
+	retry := pool.Acquire(key, map[string]struct{}{owner: {}}).URL
+	assert.NotEqual(owner, retry)
+
+	for _, endpoint := range pool.endpoints {
+		if endpoint.URL == owner {
+			endpoint.unhealthy = true
+		}
+	}
+	assert.EqualValues(retry, pool.Acquire(key, nil).URL)
+}
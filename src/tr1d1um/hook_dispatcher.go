@@ -0,0 +1,326 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/webhook"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	webhookDispatcherKey = "webhookDispatcher"
+
+	HeaderWebhookSignature = "X-Webpa-Signature"
+	HeaderWebhookEvent     = "X-Webpa-Event"
+	HeaderWebhookDeviceID  = "X-Webpa-Device-Id"
+
+	defaultHookQueueSize       = 1000
+	defaultHookMaxRetries      = 3
+	defaultHookRetryBackoff    = "1s"
+	defaultHookMaxBackoff      = "30s"
+	defaultHookDeliveryTimeout = "10s"
+	defaultHookSignature       = "sha1"
+)
+
+var (
+	errUnsupportedSignature = errors.New("signatureAlgorithm must be one of sha1 or sha256")
+	errNonPositiveQueueSize = errors.New("webhookDispatcher queueSize must be positive")
+)
+
+//HookDispatcherConfig defines the webhookDispatcher section of the configuration file
+type HookDispatcherConfig struct {
+	QueueSize          int    `json:"queueSize"`
+	MaxRetries         int    `json:"maxRetries"`
+	RetryBackoff       string `json:"retryBackoff"`
+	MaxBackoff         string `json:"maxBackoff"`
+	DeliveryTimeout    string `json:"deliveryTimeout"`
+	SignatureAlgorithm string `json:"signatureAlgorithm"`
+}
+
+//hookSender owns the delivery queue of a single webhook
+type hookSender struct {
+	hook      webhook.W
+	events    []*regexp.Regexp
+	deviceIDs []*regexp.Regexp
+	queue     chan *wrp.Message
+	stop      chan struct{}
+}
+
+//matches returns true if the event type and device of the given message match the hook's regular expressions
+func (s *hookSender) matches(deviceID device.ID, msg *wrp.Message) bool {
+	return matchesAny(s.events, eventType(msg)) && matchesAny(s.deviceIDs, string(deviceID))
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+//HookDispatcher delivers device events to the webhooks whose event and device ID expressions match them.
+//Every hook gets its own queue so a slow listener only delays its own deliveries
+type HookDispatcher struct {
+	log.Logger
+	QueueSize    int
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	newHash func() hash.Hash
+	hashTag string
+	client  *http.Client
+	lock    sync.Mutex
+	senders map[string]*hookSender
+	now     func() time.Time
+}
+
+//NewHookDispatcher builds a HookDispatcher out of the webhookDispatcher section of the configuration file
+func NewHookDispatcher(v *viper.Viper, logger log.Logger) (dispatcher *HookDispatcher, err error) {
+	config := HookDispatcherConfig{
+		QueueSize:          defaultHookQueueSize,
+		MaxRetries:         defaultHookMaxRetries,
+		RetryBackoff:       defaultHookRetryBackoff,
+		MaxBackoff:         defaultHookMaxBackoff,
+		DeliveryTimeout:    defaultHookDeliveryTimeout,
+		SignatureAlgorithm: defaultHookSignature,
+	}
+
+	if err = v.UnmarshalKey(webhookDispatcherKey, &config); err != nil {
+		return
+	}
+
+	if config.QueueSize <= 0 {
+		return nil, errNonPositiveQueueSize
+	}
+
+	retryBackoff, _ := time.ParseDuration(config.RetryBackoff)
+	maxBackoff, _ := time.ParseDuration(config.MaxBackoff)
+	deliveryTimeout, _ := time.ParseDuration(config.DeliveryTimeout)
+
+	dispatcher = &HookDispatcher{
+		Logger:       logger,
+		QueueSize:    config.QueueSize,
+		MaxRetries:   config.MaxRetries,
+		RetryBackoff: retryBackoff,
+		MaxBackoff:   maxBackoff,
+		hashTag:      config.SignatureAlgorithm,
+		client:       &http.Client{Timeout: deliveryTimeout},
+		senders:      map[string]*hookSender{},
+		now:          time.Now,
+	}
+
+	switch config.SignatureAlgorithm {
+	case "sha1":
+		dispatcher.newHash = sha1.New
+	case "sha256":
+		dispatcher.newHash = sha256.New
+	default:
+		dispatcher, err = nil, errUnsupportedSignature
+	}
+
+	return
+}
+
+//Update replaces the set of hooks events are delivered to. Queues of hooks that are still registered are kept
+func (d *HookDispatcher) Update(hooks []webhook.W) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	current := make(map[string]struct{}, len(hooks))
+
+	for _, hook := range hooks {
+		events, err := compileAll(hook.Events)
+		if err != nil {
+			logging.Error(d).Log(logging.MessageKey(), "invalid event expression in webhook", "url", hook.ID(), logging.ErrorKey(), err)
+			continue
+		}
+
+		deviceIDs, err := compileAll(hook.Matcher.DeviceId)
+		if err != nil {
+			logging.Error(d).Log(logging.MessageKey(), "invalid device id expression in webhook", "url", hook.ID(), logging.ErrorKey(), err)
+			continue
+		}
+
+		current[hook.ID()] = struct{}{}
+
+		if sender, exists := d.senders[hook.ID()]; exists {
+			sender.hook, sender.events, sender.deviceIDs = hook, events, deviceIDs
+			continue
+		}
+
+		sender := &hookSender{
+			hook:      hook,
+			events:    events,
+			deviceIDs: deviceIDs,
+			queue:     make(chan *wrp.Message, d.QueueSize),
+			stop:      make(chan struct{}),
+		}
+
+		d.senders[hook.ID()] = sender
+		go d.run(sender)
+	}
+
+	for id, sender := range d.senders {
+		if _, exists := current[id]; !exists {
+			d.remove(id, sender)
+		}
+	}
+}
+
+//Dispatch queues the given event for delivery to every matching hook. Hooks past their registration period are dropped
+func (d *HookDispatcher) Dispatch(msg *wrp.Message) {
+	deviceID, _ := device.ParseID(msg.Source)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	for id, sender := range d.senders {
+		if now.After(sender.hook.Until) {
+			logging.Info(d).Log(logging.MessageKey(), "dropping expired webhook", "url", id)
+			d.remove(id, sender)
+			continue
+		}
+
+		if !sender.matches(deviceID, msg) {
+			continue
+		}
+
+		select {
+		case sender.queue <- msg:
+		default:
+			logging.Error(d).Log(logging.MessageKey(), "webhook queue full, dropping event", "url", id, "event", eventType(msg))
+		}
+	}
+}
+
+func (d *HookDispatcher) remove(id string, sender *hookSender) {
+	delete(d.senders, id)
+	close(sender.stop)
+}
+
+//run delivers the queued events of a single hook until it is removed
+func (d *HookDispatcher) run(sender *hookSender) {
+	for {
+		select {
+		case <-sender.stop:
+			return
+		case msg := <-sender.queue:
+			d.lock.Lock()
+			hook := sender.hook
+			d.lock.Unlock()
+
+			d.deliver(hook, msg, sender.stop)
+		}
+	}
+}
+
+//deliver sends a single event to a hook, retrying with exponential backoff on failures
+func (d *HookDispatcher) deliver(hook webhook.W, msg *wrp.Message, stop <-chan struct{}) {
+	format := wrp.JSON
+	if hook.Config.ContentType == wrp.Msgpack.ContentType() {
+		format = wrp.Msgpack
+	}
+
+	var body bytes.Buffer
+	if err := wrp.NewEncoder(&body, format).Encode(msg); err != nil {
+		logging.Error(d).Log(logging.MessageKey(), "could not encode event", logging.ErrorKey(), err)
+		return
+	}
+
+	backoff := d.RetryBackoff
+
+	for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > d.MaxBackoff {
+				backoff = d.MaxBackoff
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodPost, hook.Config.URL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			logging.Error(d).Log(logging.MessageKey(), "invalid webhook url", "url", hook.Config.URL, logging.ErrorKey(), err)
+			return
+		}
+
+		req.Header.Set(contentTypeKey, format.ContentType())
+		req.Header.Set(HeaderWebhookEvent, eventType(msg))
+		req.Header.Set(HeaderWebhookDeviceID, msg.Source)
+		req.Header.Set(HeaderWPATID, msg.TransactionUUID)
+
+		if hook.Config.Secret != "" {
+			req.Header.Set(HeaderWebhookSignature, d.sign(hook.Config.Secret, body.Bytes()))
+		}
+
+		resp, err := d.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+				return
+			}
+		}
+
+		logging.Debug(d).Log(logging.MessageKey(), "webhook delivery failed", "url", hook.Config.URL, "attempt", attempt, logging.ErrorKey(), err)
+	}
+
+	logging.Error(d).Log(logging.MessageKey(), "giving up on webhook delivery", "url", hook.Config.URL, "tid", msg.TransactionUUID)
+}
+
+//sign returns the signature header value of the given body, i.e. sha1=<hex encoded HMAC>
+func (d *HookDispatcher) sign(secret string, body []byte) string {
+	mac := hmac.New(d.newHash, []byte(secret))
+	mac.Write(body)
+	return d.hashTag + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func compileAll(expressions []string) (compiled []*regexp.Regexp, err error) {
+	compiled = make([]*regexp.Regexp, 0, len(expressions))
+	for _, expression := range expressions {
+		var r *regexp.Regexp
+		if r, err = regexp.Compile(expression); err != nil {
+			return
+		}
+		compiled = append(compiled, r)
+	}
+	return
+}
@@ -0,0 +1,145 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/webhook"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHookDispatcher(t *testing.T, algorithm string) *HookDispatcher {
+	v := viper.New()
+	v.Set(webhookDispatcherKey, map[string]interface{}{
+		"signatureAlgorithm": algorithm,
+		"retryBackoff":       "1ms",
+		"maxBackoff":         "2ms",
+	})
+
+	dispatcher, err := NewHookDispatcher(v, logging.DefaultLogger())
+	assert.Nil(t, err)
+	return dispatcher
+}
+
+func newTestHook(url string, until time.Time) webhook.W {
+	hook := webhook.W{Events: []string{"^device-status/"}, Until: until}
+	hook.Config.URL = url
+	hook.Config.Secret = "secret"
+	hook.Matcher.DeviceId = []string{"mac:112233445566"}
+	return hook
+}
+
+func TestNewHookDispatcher(t *testing.T) {
+	testData := []struct {
+		name     string
+		config   map[string]interface{}
+		expected error
+	}{
+		{"UnsupportedSignature", map[string]interface{}{"signatureAlgorithm": "md5"}, errUnsupportedSignature},
+		{"ZeroQueueSize", map[string]interface{}{"queueSize": 0}, errNonPositiveQueueSize},
+		{"NegativeQueueSize", map[string]interface{}{"queueSize": -1}, errNonPositiveQueueSize},
+	}
+
+	for _, record := range testData {
+		t.Run(record.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set(webhookDispatcherKey, record.config)
+
+			dispatcher, err := NewHookDispatcher(v, logging.DefaultLogger())
+			assert.Nil(t, dispatcher)
+			assert.EqualValues(t, record.expected, err)
+		})
+	}
+}
+
+func TestHookDispatcher(t *testing.T) {
+	event := &wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566",
+		Destination: "event:device-status/mac:112233445566/online",
+	}
+
+	t.Run("SignedDeliveryWithRetry", func(t *testing.T) {
+		assert := assert.New(t)
+		deliveries := make(chan *http.Request, 2)
+		bodies := make(chan []byte, 2)
+		attempts := 0
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if attempts++; attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			deliveries <- r
+			bodies <- body
+		}))
+		defer server.Close()
+
+		dispatcher := newTestHookDispatcher(t, "sha256")
+		dispatcher.Update([]webhook.W{newTestHook(server.URL, time.Now().Add(time.Minute))})
+		dispatcher.Dispatch(event)
+
+		select {
+		case req := <-deliveries:
+			body := <-bodies
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write(body)
+
+			assert.EqualValues("sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get(HeaderWebhookSignature))
+			assert.EqualValues("device-status/mac:112233445566/online", req.Header.Get(HeaderWebhookEvent))
+			assert.EqualValues(2, attempts)
+		case <-time.After(5 * time.Second):
+			assert.Fail("event was not delivered")
+		}
+
+		dispatcher.Update(nil)
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		assert := assert.New(t)
+		dispatcher := newTestHookDispatcher(t, "sha1")
+		dispatcher.Update([]webhook.W{newTestHook("http://listener.com", time.Now().Add(time.Minute))})
+
+		dispatcher.Dispatch(&wrp.Message{Source: "mac:aabbccddeeff", Destination: "event:device-status/online"})
+		assert.Len(dispatcher.senders["http://listener.com"].queue, 0)
+
+		dispatcher.Update(nil)
+		assert.Empty(dispatcher.senders)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		dispatcher := newTestHookDispatcher(t, "sha1")
+		dispatcher.Update([]webhook.W{newTestHook("http://listener.com", time.Now().Add(-time.Minute))})
+
+		dispatcher.Dispatch(event)
+		assert.Empty(dispatcher.senders)
+	})
+}
@@ -0,0 +1,696 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/webhook"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/spf13/viper"
+)
+
+const (
+	webhookRegistryKey = "webhookRegistry"
+
+	defaultHookDuration     = "5m"
+	defaultHookSyncInterval = "30s"
+	defaultHookSyncTimeout  = "10s"
+	hookSyncPath            = apiBase + "/hooks/sync"
+
+	HeaderWebhookChallenge = "X-Webpa-Challenge"
+
+	challengeEvent         = "challenge"
+	challengeSize          = 16
+	maxChallengeEchoSize   = 4096
+	verificationPending    = "pending"
+	verificationFailed     = "failed"
+	defaultChallengeWindow = "1h"
+	defaultChallengeRetry  = "1m"
+)
+
+var (
+	errInvalidHookURL     = errors.New("invalid Config URL")
+	errInvalidHookEvents  = errors.New("invalid events")
+	errChallengeMismatch  = errors.New("challenge was not echoed back")
+	errPeerUnauthorized   = errors.New("peer not authorized")
+	errHostFailedRecently = errors.New("another URL on the same host failed ownership verification recently")
+
+	errNonPositiveSyncInterval = errors.New("webhookRegistry: syncInterval must be positive")
+)
+
+//HookVerification reports the state of a registration that has not proven ownership of its URL yet
+type HookVerification struct {
+	URL       string    `json:"url"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Attempted time.Time `json:"attempted"`
+}
+
+//HookRegistryConfig defines the webhookRegistry section of the configuration file. It is used whenever
+//AWS SNS is not configured
+type HookRegistryConfig struct {
+	File              string   `json:"file"`
+	Peers             []string `json:"peers"`
+	PeerAuthorization string   `json:"peerAuthorization"`
+	SyncInterval      string   `json:"syncInterval"`
+	SyncTimeout       string   `json:"syncTimeout"`
+	HookDuration      string   `json:"hookDuration"`
+
+	// VerifyOwnership requires the receiver of a new registration to echo a challenge before the hook is active
+	VerifyOwnership bool   `json:"verifyOwnership"`
+	ChallengeWindow string `json:"challengeWindow"`
+
+	// ChallengeRetry is how long the host of a URL that failed a challenge has to wait before any of its
+	// URLs is challenged again
+	ChallengeRetry string `json:"challengeRetry"`
+}
+
+//FileHookStore persists webhook registrations as a JSON list in a local file
+type FileHookStore struct {
+	Path string
+}
+
+//Load returns the registrations saved in the file. A missing file holds no registrations
+func (f *FileHookStore) Load() (hooks []webhook.W, err error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &hooks)
+	return
+}
+
+//Save replaces the contents of the file with the given registrations
+func (f *FileHookStore) Save(hooks []webhook.W) (err error) {
+	data, err := json.Marshal(hooks)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.Path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return
+}
+
+//HookRegistry is a webhook registry that does not depend on AWS SNS. Registrations are kept in memory, persisted
+//through an optional FileHookStore and exchanged with a static list of peer tr1d1um instances
+type HookRegistry struct {
+	log.Logger
+	Store             *FileHookStore
+	Peers             []string
+	PeerAuthorization string
+	HookDuration      time.Duration
+	VerifyOwnership   bool
+
+	// ChallengeWindow is how long a URL that has answered a challenge can be renewed without another one
+	ChallengeWindow time.Duration
+
+	// ChallengeRetry is how long the host of a URL that failed a challenge has to wait before any of its
+	// URLs is challenged again
+	ChallengeRetry time.Duration
+
+	// OnUpdate, if set, is handed the current registrations every time they change
+	OnUpdate func([]webhook.W)
+
+	client        *http.Client
+	lock          sync.RWMutex
+	hooks         map[string]webhook.W
+	verifications map[string]HookVerification
+	verified      map[string]time.Time
+	failedHosts   map[string]time.Time
+	now           func() time.Time
+}
+
+//NewHookRegistry returns a HookRegistry loaded with whatever registrations the store holds
+func NewHookRegistry(config HookRegistryConfig, logger log.Logger) (registry *HookRegistry, err error) {
+	hookDuration, err := time.ParseDuration(config.HookDuration)
+	if err != nil {
+		return
+	}
+
+	syncTimeout, err := time.ParseDuration(config.SyncTimeout)
+	if err != nil {
+		return
+	}
+
+	if config.ChallengeWindow == "" {
+		config.ChallengeWindow = defaultChallengeWindow
+	}
+
+	challengeWindow, err := time.ParseDuration(config.ChallengeWindow)
+	if err != nil {
+		return
+	}
+
+	if config.ChallengeRetry == "" {
+		config.ChallengeRetry = defaultChallengeRetry
+	}
+
+	challengeRetry, err := time.ParseDuration(config.ChallengeRetry)
+	if err != nil {
+		return
+	}
+
+	registry = &HookRegistry{
+		Logger:            logger,
+		Peers:             config.Peers,
+		PeerAuthorization: config.PeerAuthorization,
+		HookDuration:      hookDuration,
+		VerifyOwnership:   config.VerifyOwnership,
+		ChallengeWindow:   challengeWindow,
+		ChallengeRetry:    challengeRetry,
+		client:            &http.Client{Timeout: syncTimeout},
+		hooks:             map[string]webhook.W{},
+		verifications:     map[string]HookVerification{},
+		verified:          map[string]time.Time{},
+		failedHosts:       map[string]time.Time{},
+		now:               time.Now,
+	}
+
+	if config.File != "" {
+		registry.Store = &FileHookStore{Path: config.File}
+
+		var stored []webhook.W
+		if stored, err = registry.Store.Load(); err != nil {
+			return
+		}
+		registry.merge(stored)
+	}
+
+	return
+}
+
+//Hooks returns the registrations that have not expired yet
+func (r *HookRegistry) Hooks() (hooks []webhook.W) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	now := r.now()
+	for _, hook := range r.hooks {
+		if hook.Until.After(now) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return
+}
+
+//UpdateRegistry registers (or renews) the webhook described in the request body
+func (r *HookRegistry) UpdateRegistry(origin http.ResponseWriter, req *http.Request) {
+	hook, err := r.newHook(req)
+
+	if err != nil {
+		WriteResponseWriter(err.Error(), http.StatusBadRequest, origin)
+		logging.Error(r).Log(logging.MessageKey(), "invalid webhook registration", logging.ErrorKey(), err)
+		return
+	}
+
+	if r.needsChallenge(hook) {
+		if !r.startChallenge(*hook) {
+			if verification, _ := r.verification(hook.ID()); verification.Status == verificationFailed {
+				WriteResponseWriter("Ownership verification failed recently, try again later", http.StatusTooManyRequests, origin)
+				return
+			}
+		}
+
+		WriteResponseWriter("Pending ownership verification", http.StatusAccepted, origin)
+		return
+	}
+
+	r.activate(*hook)
+	WriteResponseWriter("Success", http.StatusOK, origin)
+}
+
+//GetVerifications lists the registrations that are waiting for, or have failed, ownership verification
+func (r *HookRegistry) GetVerifications(origin http.ResponseWriter, req *http.Request) {
+	r.lock.RLock()
+	verifications := make([]HookVerification, 0, len(r.verifications))
+	for _, verification := range r.verifications {
+		verifications = append(verifications, verification)
+	}
+	r.lock.RUnlock()
+
+	data, err := json.Marshal(verifications)
+	if err != nil {
+		origin.WriteHeader(http.StatusInternalServerError)
+		logging.Error(r).Log(logging.ErrorKey(), err.Error())
+		return
+	}
+
+	origin.Header().Set(contentTypeKey, "application/json")
+	origin.Write(data)
+}
+
+//GetRegistry lists all current registrations
+func (r *HookRegistry) GetRegistry(origin http.ResponseWriter, req *http.Request) {
+	hooks := r.Hooks()
+	if hooks == nil {
+		hooks = []webhook.W{}
+	}
+
+	data, err := json.Marshal(hooks)
+	if err != nil {
+		origin.WriteHeader(http.StatusInternalServerError)
+		logging.Error(r).Log(logging.ErrorKey(), err.Error())
+		return
+	}
+
+	origin.Header().Set(contentTypeKey, "application/json")
+	origin.Write(data)
+}
+
+//HandleSync merges the registrations pushed by a peer. Peers must present the shared PeerAuthorization secret.
+//Every registration is validated like a local one and cannot outlive HookDuration. When ownership verification
+//is enabled, registrations for URLs this instance has not verified are challenged before they are activated
+func (r *HookRegistry) HandleSync(origin http.ResponseWriter, req *http.Request) {
+	if !r.isPeer(req) {
+		WriteResponseWriter("Invalid peer authorization", http.StatusForbidden, origin)
+		logging.Error(r).Log(logging.MessageKey(), "rejected webhook sync", "remoteAddr", req.RemoteAddr,
+			logging.ErrorKey(), errPeerUnauthorized)
+		return
+	}
+
+	var hooks []webhook.W
+
+	if err := json.NewDecoder(req.Body).Decode(&hooks); err != nil {
+		WriteResponseWriter("could not decode registrations", http.StatusBadRequest, origin)
+		return
+	}
+
+	accepted := make([]webhook.W, 0, len(hooks))
+	for i := range hooks {
+		hook := &hooks[i]
+		if err := r.sanitize(hook); err != nil {
+			logging.Error(r).Log(logging.MessageKey(), "dropping invalid synced webhook", "url", hook.ID(), logging.ErrorKey(), err)
+			continue
+		}
+
+		if maxUntil := r.now().Add(r.HookDuration); hook.Until.After(maxUntil) {
+			hook.Until = maxUntil
+		}
+
+		if hook.Duration <= 0 || hook.Duration > r.HookDuration {
+			hook.Duration = r.HookDuration
+		}
+
+		if r.needsChallenge(hook) {
+			r.startChallenge(*hook)
+			continue
+		}
+
+		accepted = append(accepted, *hook)
+	}
+
+	if r.merge(accepted) {
+		r.persist()
+		r.notify()
+	}
+
+	origin.WriteHeader(http.StatusOK)
+}
+
+//isPeer returns true if the request carries the shared PeerAuthorization secret. No request is a peer's
+//when the secret is not configured
+func (r *HookRegistry) isPeer(req *http.Request) bool {
+	if r.PeerAuthorization == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(r.PeerAuthorization)) == 1
+}
+
+//Sync periodically pushes every current registration to all peers until shutdown is closed
+func (r *HookRegistry) Sync(interval time.Duration, shutdown <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if hooks := r.Hooks(); len(hooks) > 0 {
+				r.push(hooks)
+			}
+		}
+	}
+}
+
+//activate makes the given registration live on this instance and its peers
+func (r *HookRegistry) activate(hook webhook.W) {
+	r.merge([]webhook.W{hook})
+	r.persist()
+	r.notify()
+	go r.push([]webhook.W{hook})
+}
+
+//needsChallenge returns true if the hook's URL has to prove ownership before the registration is activated.
+//URLs that answered a challenge recently, or that are already registered, can renew without one
+func (r *HookRegistry) needsChallenge(hook *webhook.W) bool {
+	if !r.VerifyOwnership {
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if current, exists := r.hooks[hook.ID()]; exists && current.Until.After(r.now()) {
+		return false
+	}
+
+	verifiedAt, verified := r.verified[hook.ID()]
+	return !verified || r.now().Sub(verifiedAt) > r.ChallengeWindow
+}
+
+//verify sends a random challenge to the hook's URL and activates the registration only if the receiver
+//echoes it back in the response body. The outcome is recorded so it can be listed through GetVerifications
+func (r *HookRegistry) verify(hook webhook.W) {
+	if err := r.challenge(hook); err != nil {
+		logging.Error(r).Log(logging.MessageKey(), "webhook ownership verification failed", "url", hook.ID(), logging.ErrorKey(), err)
+		r.setVerification(HookVerification{URL: hook.ID(), Status: verificationFailed, Error: err.Error(), Attempted: r.now()})
+		return
+	}
+
+	r.lock.Lock()
+	delete(r.verifications, hook.ID())
+	r.verified[hook.ID()] = r.now()
+	r.lock.Unlock()
+
+	r.activate(hook)
+}
+
+func (r *HookRegistry) challenge(hook webhook.W) (err error) {
+	token := make([]byte, challengeSize)
+	if _, err = rand.Read(token); err != nil {
+		return
+	}
+
+	challenge := hex.EncodeToString(token)
+	body, err := json.Marshal(map[string]string{challengeEvent: challenge})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hook.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set(contentTypeKey, "application/json")
+	req.Header.Set(HeaderWebhookEvent, challengeEvent)
+	req.Header.Set(HeaderWebhookChallenge, challenge)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("challenge answered with status %d", resp.StatusCode)
+	}
+
+	echo, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChallengeEchoSize))
+	if err != nil {
+		return
+	}
+
+	if string(bytes.TrimSpace(echo)) != challenge {
+		err = errChallengeMismatch
+	}
+	return
+}
+
+//startChallenge challenges the hook's URL in the background unless a challenge for it is already in flight, or
+//a challenge to its host failed less than ChallengeRetry ago. It returns true if a challenge was started
+func (r *HookRegistry) startChallenge(hook webhook.W) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	r.expireVerifications(now)
+
+	//whatever survived expiry is either in flight or failed too recently
+	if _, exists := r.verifications[hook.ID()]; exists {
+		return false
+	}
+
+	//varying the path or query of a URL must not buy another challenge to the same host
+	if failedAt, failed := r.failedHosts[challengeHost(hook.ID())]; failed {
+		r.verifications[hook.ID()] = HookVerification{URL: hook.ID(), Status: verificationFailed, Error: errHostFailedRecently.Error(), Attempted: failedAt}
+		return false
+	}
+
+	r.verifications[hook.ID()] = HookVerification{URL: hook.ID(), Status: verificationPending, Attempted: now}
+	go r.verify(hook)
+	return true
+}
+
+func (r *HookRegistry) verification(url string) (verification HookVerification, exists bool) {
+	r.lock.RLock()
+	verification, exists = r.verifications[url]
+	r.lock.RUnlock()
+	return
+}
+
+func (r *HookRegistry) setVerification(verification HookVerification) {
+	r.lock.Lock()
+	r.expireVerifications(r.now())
+	r.verifications[verification.URL] = verification
+	if verification.Status == verificationFailed {
+		r.failedHosts[challengeHost(verification.URL)] = verification.Attempted
+	}
+	r.lock.Unlock()
+}
+
+//challengeHost returns the host challenges to the given URL are sent to
+func challengeHost(hookURL string) string {
+	if parsed, err := url.Parse(hookURL); err == nil {
+		return parsed.Host
+	}
+	return hookURL
+}
+
+//expireVerifications drops failed verifications that can be retried and successful ones that no longer
+//spare a challenge. Pending ones are kept as their challenge is still in flight. The caller must hold the lock
+func (r *HookRegistry) expireVerifications(now time.Time) {
+	for url, verification := range r.verifications {
+		if verification.Status != verificationPending && now.Sub(verification.Attempted) >= r.ChallengeRetry {
+			delete(r.verifications, url)
+		}
+	}
+
+	for url, verifiedAt := range r.verified {
+		if now.Sub(verifiedAt) > r.ChallengeWindow {
+			delete(r.verified, url)
+		}
+	}
+
+	for host, failedAt := range r.failedHosts {
+		if now.Sub(failedAt) >= r.ChallengeRetry {
+			delete(r.failedHosts, host)
+		}
+	}
+}
+
+//newHook reads and sanitizes the registration in the given request
+func (r *HookRegistry) newHook(req *http.Request) (hook *webhook.W, err error) {
+	hook = new(webhook.W)
+	if err = json.NewDecoder(req.Body).Decode(hook); err != nil {
+		return
+	}
+
+	if err = r.sanitize(hook); err != nil {
+		return nil, err
+	}
+
+	hook.Address = req.RemoteAddr
+	hook.Duration = r.HookDuration
+	hook.Until = r.now().Add(hook.Duration)
+	return
+}
+
+//sanitize rejects registrations without a URL or events and fills in the defaults for the rest
+func (r *HookRegistry) sanitize(hook *webhook.W) error {
+	if hook.Config.URL == "" {
+		return errInvalidHookURL
+	}
+
+	if len(hook.Events) == 0 {
+		return errInvalidHookEvents
+	}
+
+	if hook.Config.ContentType == "" {
+		hook.Config.ContentType = "application/json"
+	}
+
+	if len(hook.Matcher.DeviceId) == 0 {
+		hook.Matcher.DeviceId = []string{".*"}
+	}
+	return nil
+}
+
+//merge adds the given registrations, keeping the most recent one for each URL. It returns true if anything changed
+func (r *HookRegistry) merge(hooks []webhook.W) (changed bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	for id, hook := range r.hooks {
+		if !hook.Until.After(now) {
+			delete(r.hooks, id)
+			changed = true
+		}
+	}
+
+	for _, hook := range hooks {
+		if current, exists := r.hooks[hook.ID()]; (!exists || hook.Until.After(current.Until)) && hook.Until.After(now) {
+			r.hooks[hook.ID()] = hook
+			changed = true
+		}
+	}
+	return
+}
+
+func (r *HookRegistry) notify() {
+	if r.OnUpdate != nil {
+		r.OnUpdate(r.Hooks())
+	}
+}
+
+func (r *HookRegistry) persist() {
+	if r.Store == nil {
+		return
+	}
+
+	if err := r.Store.Save(r.Hooks()); err != nil {
+		logging.Error(r).Log(logging.MessageKey(), "could not persist webhook registrations", logging.ErrorKey(), err)
+	}
+}
+
+//push sends the given registrations to every peer. Failures are only logged as the next sync will try again
+func (r *HookRegistry) push(hooks []webhook.W) {
+	data, err := json.Marshal(hooks)
+	if err != nil {
+		return
+	}
+
+	for _, peer := range r.Peers {
+		req, err := http.NewRequest(http.MethodPost, peer+hookSyncPath, bytes.NewReader(data))
+		if err != nil {
+			logging.Error(r).Log(logging.MessageKey(), "invalid peer", "peer", peer, logging.ErrorKey(), err)
+			continue
+		}
+
+		req.Header.Set(contentTypeKey, "application/json")
+		req.Header.Set("Authorization", r.PeerAuthorization)
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			logging.Error(r).Log(logging.MessageKey(), "could not sync webhooks with peer", "peer", peer, logging.ErrorKey(), err)
+			continue
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			logging.Error(r).Log(logging.MessageKey(), "peer rejected webhook sync", "peer", peer, "code", resp.StatusCode)
+		}
+	}
+}
+
+//ConfigureLocalWebHooks sets route paths for a HookRegistry, which stands in for the AWS backed registry
+//baseRouter is pre-configured with the api/v2 prefix path
+func ConfigureLocalWebHooks(baseRouter *mux.Router, preHandler *alice.Chain, v *viper.Viper, logger log.Logger) (*HookRegistry, time.Duration, int) {
+	config := HookRegistryConfig{
+		SyncInterval: defaultHookSyncInterval,
+		SyncTimeout:  defaultHookSyncTimeout,
+		HookDuration: defaultHookDuration,
+	}
+
+	if err := v.UnmarshalKey(webhookRegistryKey, &config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading webhook registry config: %s\n", err)
+		return nil, 0, 1
+	}
+
+	syncInterval, err := time.ParseDuration(config.SyncInterval)
+
+	if err == nil && syncInterval <= 0 {
+		err = errNonPositiveSyncInterval
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading webhook registry sync interval: %s\n", err)
+		return nil, 0, 1
+	}
+
+	hookRegistry, err := NewHookRegistry(config, logger)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating webhook registry: %s\n", err)
+		return nil, 0, 1
+	}
+
+	baseRouter.Handle("/hook", preHandler.ThenFunc(hookRegistry.UpdateRegistry))
+	baseRouter.Handle("/hooks", preHandler.ThenFunc(hookRegistry.GetRegistry))
+	baseRouter.Handle("/hooks/verifications", preHandler.ThenFunc(hookRegistry.GetVerifications)).Methods(http.MethodGet)
+
+	//peers authenticate with the shared secret rather than an API token, so the sync route skips preHandler
+	if config.PeerAuthorization != "" {
+		baseRouter.HandleFunc("/hooks/sync", hookRegistry.HandleSync).Methods(http.MethodPost)
+	} else {
+		logging.Info(logger).Log(logging.MessageKey(), "webhookRegistry peerAuthorization not set, webhook sync from peers is disabled")
+	}
+
+	return hookRegistry, syncInterval, 0
+}
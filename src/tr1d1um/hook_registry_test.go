@@ -0,0 +1,360 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/webhook"
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHookRegistry(t *testing.T, file string, peers ...string) *HookRegistry {
+	registry, err := NewHookRegistry(HookRegistryConfig{
+		File:         file,
+		Peers:        peers,
+		SyncTimeout:  "1s",
+		HookDuration: "5m",
+	}, logging.DefaultLogger())
+
+	assert.Nil(t, err)
+	return registry
+}
+
+func TestHookRegistry(t *testing.T) {
+	t.Run("RegisterAndList", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+
+		recorder := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"config": {"url": "http://listener.com"}, "events": ["iot"]}`)
+		registry.UpdateRegistry(recorder, httptest.NewRequest(http.MethodPost, "http://someURL/hook", body))
+		assert.EqualValues(http.StatusOK, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		registry.GetRegistry(recorder, httptest.NewRequest(http.MethodGet, "http://someURL/hooks", nil))
+
+		var hooks []webhook.W
+		assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &hooks))
+		assert.Len(hooks, 1)
+		assert.EqualValues("http://listener.com", hooks[0].Config.URL)
+		assert.EqualValues([]string{".*"}, hooks[0].Matcher.DeviceId)
+	})
+
+	t.Run("InvalidRegistration", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+
+		recorder := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"config": {"url": "http://listener.com"}}`)
+		registry.UpdateRegistry(recorder, httptest.NewRequest(http.MethodPost, "http://someURL/hook", body))
+		assert.EqualValues(http.StatusBadRequest, recorder.Code)
+		assert.Empty(registry.Hooks())
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+
+		hook := webhook.W{Until: time.Now().Add(-time.Minute)}
+		hook.Config.URL = "http://listener.com"
+
+		assert.False(registry.merge([]webhook.W{hook}))
+		assert.Empty(registry.Hooks())
+	})
+}
+
+func TestHookRegistryPersistence(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hooks.json")
+	registry := newTestHookRegistry(t, file)
+
+	hook := webhook.W{Until: time.Now().Add(time.Minute)}
+	hook.Config.URL = "http://listener.com"
+	registry.merge([]webhook.W{hook})
+	registry.persist()
+
+	reloaded := newTestHookRegistry(t, file)
+	assert.Len(reloaded.Hooks(), 1)
+}
+
+func TestHookRegistryPeerSync(t *testing.T) {
+	assert := assert.New(t)
+	peer := newTestHookRegistry(t, "")
+	peer.PeerAuthorization = "peer-secret"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues(hookSyncPath, r.URL.Path)
+		assert.EqualValues("peer-secret", r.Header.Get("Authorization"))
+		peer.HandleSync(w, r)
+	}))
+	defer server.Close()
+
+	registry := newTestHookRegistry(t, "", server.URL)
+	registry.PeerAuthorization = "peer-secret"
+
+	hook := webhook.W{Events: []string{"iot"}, Until: time.Now().Add(time.Minute)}
+	hook.Config.URL = "http://listener.com"
+	registry.merge([]webhook.W{hook})
+	registry.push(registry.Hooks())
+
+	assert.Len(peer.Hooks(), 1)
+}
+
+func TestHookRegistryHandleSync(t *testing.T) {
+	sync := func(registry *HookRegistry, authorization string, hooks ...webhook.W) int {
+		data, _ := json.Marshal(hooks)
+		req := httptest.NewRequest(http.MethodPost, "http://someURL/hooks/sync", bytes.NewReader(data))
+		req.Header.Set("Authorization", authorization)
+
+		recorder := httptest.NewRecorder()
+		registry.HandleSync(recorder, req)
+		return recorder.Code
+	}
+
+	newHook := func(url string, until time.Time) webhook.W {
+		hook := webhook.W{Events: []string{"iot"}, Until: until}
+		hook.Config.URL = url
+		return hook
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		hook := newHook("http://listener.com", time.Now().Add(time.Minute))
+
+		assert.EqualValues(http.StatusForbidden, sync(registry, "", hook))
+
+		registry.PeerAuthorization = "peer-secret"
+		assert.EqualValues(http.StatusForbidden, sync(registry, "wrong", hook))
+		assert.Empty(registry.Hooks())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.PeerAuthorization = "peer-secret"
+
+		noEvents := newHook("http://listener.com", time.Now().Add(time.Minute))
+		noEvents.Events = nil
+
+		assert.EqualValues(http.StatusOK, sync(registry, "peer-secret", noEvents, newHook("", time.Now().Add(time.Minute))))
+		assert.Empty(registry.Hooks())
+	})
+
+	t.Run("ClampedUntil", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.PeerAuthorization = "peer-secret"
+
+		assert.EqualValues(http.StatusOK, sync(registry, "peer-secret", newHook("http://listener.com", time.Now().Add(24*time.Hour))))
+
+		hooks := registry.Hooks()
+		assert.Len(hooks, 1)
+		assert.False(hooks[0].Until.After(time.Now().Add(registry.HookDuration)))
+		assert.EqualValues([]string{".*"}, hooks[0].Matcher.DeviceId)
+	})
+
+	t.Run("UnverifiedPending", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.PeerAuthorization = "peer-secret"
+		registry.VerifyOwnership = true
+
+		assert.EqualValues(http.StatusOK, sync(registry, "peer-secret", newHook("http://127.0.0.1:0", time.Now().Add(time.Minute))))
+		assert.Empty(registry.Hooks())
+	})
+}
+
+func TestHookRegistryOwnership(t *testing.T) {
+	newHook := func(url string) webhook.W {
+		hook := webhook.W{Events: []string{"iot"}, Until: time.Now().Add(time.Minute)}
+		hook.Config.URL = url
+		return hook
+	}
+
+	t.Run("Pending", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+
+		recorder := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"config": {"url": "http://127.0.0.1:0"}, "events": ["iot"]}`)
+		registry.UpdateRegistry(recorder, httptest.NewRequest(http.MethodPost, "http://someURL/hook", body))
+		assert.EqualValues(http.StatusAccepted, recorder.Code)
+		assert.Empty(registry.Hooks())
+	})
+
+	t.Run("Echoed", func(t *testing.T) {
+		assert := assert.New(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Header.Get(HeaderWebhookChallenge)))
+		}))
+		defer server.Close()
+
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+
+		hook := newHook(server.URL)
+		assert.True(registry.needsChallenge(&hook))
+
+		registry.verify(hook)
+		assert.Len(registry.Hooks(), 1)
+		assert.False(registry.needsChallenge(&hook))
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		assert := assert.New(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("not the challenge"))
+		}))
+		defer server.Close()
+
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+		registry.verify(newHook(server.URL))
+		assert.Empty(registry.Hooks())
+
+		recorder := httptest.NewRecorder()
+		registry.GetVerifications(recorder, httptest.NewRequest(http.MethodGet, "http://someURL/hooks/verifications", nil))
+
+		var verifications []HookVerification
+		assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &verifications))
+		assert.Len(verifications, 1)
+		assert.EqualValues(verificationFailed, verifications[0].Status)
+		assert.EqualValues(errChallengeMismatch.Error(), verifications[0].Error)
+	})
+}
+
+func TestHookRegistryChallengeLimits(t *testing.T) {
+	register := func(registry *HookRegistry, url string) int {
+		recorder := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"config": {"url": "` + url + `"}, "events": ["iot"]}`)
+		registry.UpdateRegistry(recorder, httptest.NewRequest(http.MethodPost, "http://someURL/hook", body))
+		return recorder.Code
+	}
+
+	t.Run("OnePending", func(t *testing.T) {
+		assert := assert.New(t)
+		release, challenges := make(chan struct{}), make(chan struct{}, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			challenges <- struct{}{}
+			<-release
+			w.Write([]byte(r.Header.Get(HeaderWebhookChallenge)))
+		}))
+		defer server.Close()
+
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+
+		for i := 0; i < 3; i++ {
+			assert.EqualValues(http.StatusAccepted, register(registry, server.URL))
+		}
+
+		<-challenges
+		close(release)
+		assert.Len(challenges, 0)
+	})
+
+	t.Run("RetryAfterFailure", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+
+		now := time.Now()
+		registry.now = func() time.Time { return now }
+		registry.setVerification(HookVerification{URL: "http://127.0.0.1:0", Status: verificationFailed, Attempted: now})
+
+		assert.EqualValues(http.StatusTooManyRequests, register(registry, "http://127.0.0.1:0"))
+
+		now = now.Add(registry.ChallengeRetry)
+		assert.EqualValues(http.StatusAccepted, register(registry, "http://127.0.0.1:0"))
+	})
+
+	t.Run("RetryAfterHostFailure", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+		registry.VerifyOwnership = true
+
+		now := time.Now()
+		registry.now = func() time.Time { return now }
+		registry.setVerification(HookVerification{URL: "http://127.0.0.1:0/first", Status: verificationFailed, Attempted: now})
+
+		assert.EqualValues(http.StatusTooManyRequests, register(registry, "http://127.0.0.1:0/second?attempt=2"))
+		verification, _ := registry.verification("http://127.0.0.1:0/second?attempt=2")
+		assert.EqualValues(errHostFailedRecently.Error(), verification.Error)
+
+		now = now.Add(registry.ChallengeRetry)
+		assert.EqualValues(http.StatusAccepted, register(registry, "http://127.0.0.1:0/third"))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		assert := assert.New(t)
+		registry := newTestHookRegistry(t, "")
+
+		now := time.Now()
+		registry.now = func() time.Time { return now }
+		registry.verified["http://verified.com"] = now
+		registry.setVerification(HookVerification{URL: "http://failed.com", Status: verificationFailed, Attempted: now})
+
+		now = now.Add(registry.ChallengeWindow + time.Second)
+		registry.setVerification(HookVerification{URL: "http://pending.com", Status: verificationPending, Attempted: now})
+
+		assert.Len(registry.verifications, 1)
+		assert.Empty(registry.verified)
+	})
+}
+
+func TestConfigureLocalWebHooks(t *testing.T) {
+	testData := []struct {
+		name         string
+		syncInterval string
+		exitCode     int
+	}{
+		{"Valid", "30s", 0},
+		{"ZeroSyncInterval", "0s", 1},
+		{"NegativeSyncInterval", "-1s", 1},
+	}
+
+	for _, record := range testData {
+		t.Run(record.name, func(t *testing.T) {
+			assert := assert.New(t)
+			v := viper.New()
+			v.Set(webhookRegistryKey, map[string]interface{}{"syncInterval": record.syncInterval})
+
+			_, _, exitCode := ConfigureLocalWebHooks(mux.NewRouter(), &alice.Chain{}, v, logging.DefaultLogger())
+			assert.EqualValues(record.exitCode, exitCode)
+		})
+	}
+}
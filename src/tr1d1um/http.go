@@ -19,9 +19,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -31,6 +31,7 @@ import (
 	"github.com/Comcast/webpa-common/secure/handler"
 	"github.com/Comcast/webpa-common/wrp"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 	"github.com/gorilla/mux"
 )
 
@@ -42,8 +43,18 @@ type ConversionHandler struct {
 	WRPRequestURL string
 	WdmpConvert   ConversionTool
 	Sender        SendAndHandle
+	Endpoints     *EndpointPool
+	Services      map[string]*ServiceRoute
+	Resolver      DeviceResolver
+	UndoStore     UndoStore
+
+	IdempotencyStore IdempotencyStore
+	Breakers         map[string]*CircuitBreaker
+	DeviceGuard      *DeviceGuard
+	EncodeFailures   metrics.Counter
 	RequestValidator
 	RetryStrategy
+	MethodRetryStrategies map[string]RetryStrategy
 	log.Logger
 }
 
@@ -60,10 +71,21 @@ func (ch *ConversionHandler) ServeHTTP(origin http.ResponseWriter, req *http.Req
 		urlVars = mux.Vars(req)
 	)
 
-	if !ch.isValidRequest(urlVars, origin) {
+	assignTID(origin, req)
+
+	if !ch.isValidRequest(req.Context(), urlVars, origin) {
+		return
+	}
+
+	route := ch.route(urlVars["service"])
+
+	if !route.isMethodAllowed(req.Method) {
+		WriteResponseWriter(fmt.Sprintf("Method %s not allowed for service", req.Method), http.StatusMethodNotAllowed, origin)
 		return
 	}
 
+	_, conversionSpan := StartSpan(req.Context(), "conversion", SpanKindInternal)
+
 	switch req.Method {
 	case http.MethodGet:
 		wdmp, err = ch.WdmpConvert.GetFlavorFormat(req, urlVars, "attributes", "names", ",")
@@ -87,51 +109,62 @@ func (ch *ConversionHandler) ServeHTTP(origin http.ResponseWriter, req *http.Req
 	}
 
 	if err != nil {
-		WriteResponseWriter(err.Error(), http.StatusBadRequest, origin)
+		conversionSpan.SetError(err)
+		conversionSpan.Finish()
+		WriteProblemWriter(conversionProblem(err), http.StatusBadRequest, err.Error(), origin)
 		logging.Error(ch).Log(logging.MessageKey(), ErrUnsuccessfulDataParse, logging.ErrorKey(), err.Error())
 		return
 	}
 
 	wdmpPayload, err := json.Marshal(wdmp)
 
+	conversionSpan.SetError(err)
+	conversionSpan.SetAttribute("wdmp.command", wdmpCommand(wdmpPayload))
+	conversionSpan.Finish()
+
 	if err != nil {
 		origin.WriteHeader(http.StatusInternalServerError)
 		logging.Error(ch).Log(logging.ErrorKey(), err.Error())
 		return
 	}
 
-	wrpMsg := ch.WdmpConvert.GetConfiguredWRP(wdmpPayload, urlVars, req.Header)
-
-	//Forward transaction id being used in Request
-	origin.Header().Set(HeaderWPATID, wrpMsg.TransactionUUID)
-	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
+	setRequestCommand(req.Context(), wdmpCommand(wdmpPayload))
+	setAccessWDMP(req.Context(), wdmpCommand(wdmpPayload), wdmp)
 
-	var wrpPayloadBuffer bytes.Buffer
-	err = wrp.NewEncoder(&wrpPayloadBuffer, wrp.Msgpack).Encode(wrpMsg)
+	idempotencyKey, done := ch.reserveIdempotencyKey(origin, req, wdmpPayload)
 
-	if err != nil {
-		origin.WriteHeader(http.StatusInternalServerError)
-		logging.Error(ch).Log(logging.ErrorKey(), err)
+	if done {
 		return
 	}
 
-	tr1Request := Tr1d1umRequest{
-		method:  http.MethodPost,
-		URL:     ch.WRPRequestURL,
-		headers: http.Header{},
-		body:    wrpPayloadBuffer.Bytes(),
+	var undoRecord *UndoRecord
+
+	if setWDMP, isSet := wdmp.(*SetWDMP); isSet && ch.UndoStore != nil && undoRequested(req.Header) {
+		var failure *Tr1d1umResponse
+		if undoRecord, failure = ch.captureUndo(req, urlVars, setWDMP); failure != nil {
+			ch.completeIdempotencyKey(idempotencyKey, "", origin.Header(), failure, nil)
+			TransferResponse(failure, origin)
+			return
+		}
 	}
 
-	tr1Request.headers.Set(contentTypeKey, wrp.Msgpack.ContentType())
-	tr1Request.headers.Set("Authorization", req.Header.Get("Authorization"))
+	wrpMsg := ch.WdmpConvert.GetConfiguredWRP(wdmpPayload, urlVars, req.Header)
+
+	//Forward transaction id being used in Request
+	origin.Header().Set(HeaderWPATID, wrpMsg.TransactionUUID)
+	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
 
-	tr1Resp, err := ch.Execute(req.Context(), ch.Sender.MakeRequest, tr1Request)
+	tr1d1umResp, err := ch.sendWRP(req, route, wrpMsg)
 
 	if err != nil {
 		errorLogger.Log(logging.MessageKey(), "error in retry execution", logging.ErrorKey(), err)
 	}
 
-	tr1d1umResp := tr1Resp.(*Tr1d1umResponse)
+	if undoRecord != nil && tr1d1umResp.Code == http.StatusOK {
+		ch.UndoStore.Store(wrpMsg.TransactionUUID, undoRecord)
+	}
+
+	ch.completeIdempotencyKey(idempotencyKey, wrpMsg.TransactionUUID, origin.Header(), tr1d1umResp, err)
 
 	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), wrpMsg.TransactionUUID)
 	TransferResponse(tr1d1umResp, origin)
@@ -141,17 +174,34 @@ func (ch *ConversionHandler) ServeHTTP(origin http.ResponseWriter, req *http.Req
 func (ch *ConversionHandler) HandleStat(origin http.ResponseWriter, req *http.Request) {
 	requestArrivalTime := time.Now()
 	logging.Debug(ch).Log(logging.MessageKey(), "HandleStat called")
-	var errorLogger = logging.Error(ch)
+	var errorLogger, tid = logging.Error(ch), assignTID(origin, req)
 
 	tr1Request := Tr1d1umRequest{
 		method:  http.MethodGet,
 		URL:     ch.TargetURL + req.URL.RequestURI(),
 		headers: http.Header{},
+		tried:   map[string]struct{}{},
 	}
 
+	//identifiers that cannot be parsed are left for the target to reject, as they always were
+	deviceID, err := resolveDeviceID(req.Context(), ch.Resolver, mux.Vars(req)["deviceid"])
+	if err == errDeviceLookupUnavailable {
+		WriteProblemWriter(ProblemDeviceLookupUnavailable, http.StatusServiceUnavailable, err.Error(), origin)
+		errorLogger.Log(logging.MessageKey(), "could not resolve deviceID", logging.ErrorKey(), err)
+		return
+	}
+
+	tr1Request.deviceID = deviceID
 	tr1Request.headers.Set("Authorization", req.Header.Get("Authorization"))
 
-	tr1Resp, err := ch.Execute(req.Context(), ch.Sender.MakeRequest, tr1Request)
+	release, tr1d1umResp, err := ch.guardDevice(req.Context(), tr1Request.deviceID, false)
+
+	if tr1d1umResp == nil {
+		var tr1Resp interface{}
+		tr1Resp, err = ch.route("").retryStrategy(http.MethodGet).Execute(req.Context(), ch.Sender.MakeRequest, tr1Request)
+		release()
+		tr1d1umResp = tr1Resp.(*Tr1d1umResponse)
+	}
 
 	if err != nil {
 		errorLogger.Log(logging.MessageKey(), "error in retry execution", logging.ErrorKey(), err)
@@ -159,109 +209,118 @@ func (ch *ConversionHandler) HandleStat(origin http.ResponseWriter, req *http.Re
 
 	// we expect content to be of json format
 	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
-	tr1d1umResp := tr1Resp.(*Tr1d1umResponse)
 
-	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), GetOrGenTID(req.Header))
+	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), tid)
 
 	TransferResponse(tr1d1umResp, origin)
 }
 
-//HandleIOT handles the /iot endpoint.
-//TODO: this is temporary and should be deleted ASA endpoint is not needed in tr1d1um
-func (ch *ConversionHandler) HandleIOT(origin http.ResponseWriter, req *http.Request) {
-	requestArrivalTime := time.Now()
-	var debugLogger, errorLogger = logging.Debug(ch), logging.Error(ch)
-
-	debugLogger.Log(logging.MessageKey(), "HandleIOT called")
-
-	var (
-		err     error
-		urlVars = mux.Vars(req)
-	)
-
-	if _, err := device.ParseID(urlVars["deviceid"]); err != nil {
-		WriteResponseWriter(fmt.Sprintf("Invalid deviceID: %s", err.Error()), http.StatusBadRequest, origin)
-		errorLogger.Log(logging.ErrorKey(), err.Error(), logging.MessageKey(), "Invalid deviceID")
-		return
+//route returns the settings configured for the given service, falling back to the handler's own
+func (ch *ConversionHandler) route(service string) *ServiceRoute {
+	if route, ok := ch.Services[service]; ok {
+		return route
 	}
 
-	var payload []byte
-	payload, err = ioutil.ReadAll(req.Body)
+	return &ServiceRoute{
+		TargetURL:     ch.TargetURL,
+		WRPRequestURL: ch.WRPRequestURL,
+		Sender:        ch.Sender,
+		Endpoints:     ch.Endpoints,
+		RetryStrategy: ch.RetryStrategy,
 
-	if err != nil {
-		origin.WriteHeader(http.StatusInternalServerError)
-		errorLogger.Log(logging.MessageKey(), "seeing error while reading request body", logging.ErrorKey(), err.Error())
-		return
+		MethodRetryStrategies: ch.MethodRetryStrategies,
 	}
+}
 
-	wrpMsg := ch.WdmpConvert.GetConfiguredWRP(payload, urlVars, req.Header)
+//sendWRP encodes the given message and sends it through the given route on behalf of the given request
+func (ch *ConversionHandler) sendWRP(req *http.Request, route *ServiceRoute, wrpMsg *wrp.Message) (tr1d1umResp *Tr1d1umResponse, err error) {
+	var wrpPayloadBuffer bytes.Buffer
 
-	//Forward transaction id being used in Request
-	origin.Header().Set(HeaderWPATID, wrpMsg.TransactionUUID)
-	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
+	//let the device, and anything in between, carry on the trace of the request
+	wrpMsg.Headers = append(wrpMsg.Headers, traceHeaders(req.Context())...)
 
-	var wrpPayloadBuffer bytes.Buffer
-	err = wrp.NewEncoder(&wrpPayloadBuffer, wrp.Msgpack).Encode(wrpMsg)
+	if err = wrp.NewEncoder(&wrpPayloadBuffer, wrp.Msgpack).Encode(wrpMsg); err != nil {
+		if ch.EncodeFailures != nil {
+			ch.EncodeFailures.Add(1)
+		}
 
-	if err != nil {
-		origin.WriteHeader(http.StatusInternalServerError)
-		logging.Error(ch).Log(logging.ErrorKey(), err)
+		tr1d1umResp = Tr1d1umResponse{}.New()
+		tr1d1umResp.Code = http.StatusInternalServerError
 		return
 	}
 
 	tr1Request := Tr1d1umRequest{
 		method:  http.MethodPost,
-		URL:     ch.WRPRequestURL,
+		URL:     route.WRPRequestURL,
 		headers: http.Header{},
 		body:    wrpPayloadBuffer.Bytes(),
+
+		//devices do not answer events so there is no WRP response to decode
+		rawResponse: wrpMsg.Type == wrp.SimpleEventMessageType,
+
+		tried: map[string]struct{}{},
 	}
 
+	//the destination holds the canonical device ID, i.e. mac:112233445566/config
+	tr1Request.deviceID, _ = device.ParseID(wrpMsg.Destination)
+
 	tr1Request.headers.Set(contentTypeKey, wrp.Msgpack.ContentType())
 	tr1Request.headers.Set("Authorization", req.Header.Get("Authorization"))
 
-	tr1Resp, err := ch.Execute(req.Context(), ch.Sender.MakeRequest, tr1Request)
+	release, failure, err := ch.guardDevice(req.Context(), tr1Request.deviceID, isWriteCommand(req.Method, wrpMsg.Payload))
 
-	if err != nil {
-		errorLogger.Log(logging.MessageKey(), "error in retry execution", logging.ErrorKey(), err)
+	if failure != nil {
+		return failure, err
 	}
 
-	tr1d1umResp := tr1Resp.(*Tr1d1umResponse)
+	defer release()
 
-	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), wrpMsg.TransactionUUID)
-	TransferResponse(tr1d1umResp, origin)
+	//the retry policy is chosen by the method of the incoming request, i.e. POST for ADD_ROW
+	tr1Resp, err := route.retryStrategy(req.Method).Execute(req.Context(), route.Sender.MakeRequest, tr1Request)
+	tr1d1umResp = tr1Resp.(*Tr1d1umResponse)
+	return
 }
 
 //RequestValidator verifies a request based the provided named URL variables
 type RequestValidator interface {
-	isValidRequest(map[string]string, http.ResponseWriter) bool
+	isValidRequest(context.Context, map[string]string, http.ResponseWriter) bool
 }
 
 //TR1RequestValidator verifies the basic validity of incoming requests to XMIDT/WebPA
 type TR1RequestValidator struct {
 	supportedServices map[string]struct{}
+	Resolver          DeviceResolver
 	log.Logger
 }
 
-//isValid returns true if and only if both service and deviceID provided in the request are supported and valid respectively
-func (validator *TR1RequestValidator) isValidRequest(URLVars map[string]string, origin http.ResponseWriter) (isValid bool) {
+//isValid returns true if and only if both service and deviceID provided in the request are supported and valid respectively.
+//The deviceid URL variable is replaced with its canonical form so that handlers do not have to resolve it again
+func (validator *TR1RequestValidator) isValidRequest(ctx context.Context, URLVars map[string]string, origin http.ResponseWriter) (isValid bool) {
 	if isValid = URLVars != nil; !isValid {
 		return
 	}
 
 	//check request contains a valid service
 	if _, isValid = validator.supportedServices[URLVars["service"]]; !isValid {
-		WriteResponseWriter(fmt.Sprintf("Unsupported Service: %s", URLVars["service"]), http.StatusBadRequest, origin)
+		WriteProblemWriter(ProblemUnsupportedService, http.StatusBadRequest, fmt.Sprintf("Unsupported Service: %s", URLVars["service"]), origin)
 		logging.Error(validator).Log(logging.ErrorKey(), "unsupported service", "service", URLVars["service"])
 		return
 	}
 
 	//check device id
-	if _, err := device.ParseID(URLVars["deviceid"]); err != nil {
-		WriteResponseWriter(fmt.Sprintf("Invalid deviceID: %s", err.Error()), http.StatusBadRequest, origin)
+	//a lookup service that cannot be reached is no fault of the client
+	deviceID, err := resolveDeviceID(ctx, validator.Resolver, URLVars["deviceid"])
+	if err == errDeviceLookupUnavailable {
+		WriteProblemWriter(ProblemDeviceLookupUnavailable, http.StatusServiceUnavailable, err.Error(), origin)
+		logging.Error(validator).Log(logging.ErrorKey(), err.Error(), logging.MessageKey(), "could not resolve deviceID")
+		return false
+	} else if err != nil {
+		WriteProblemWriter(ProblemInvalidDeviceID, http.StatusBadRequest, fmt.Sprintf("Invalid deviceID: %s", err.Error()), origin)
 		logging.Error(validator).Log(logging.ErrorKey(), err.Error(), logging.MessageKey(), "Invalid deviceID")
 		return false
 	}
 
+	URLVars["deviceid"] = string(deviceID)
 	return
 }
 
@@ -283,9 +342,9 @@ func ForwardHeadersByPrefix(prefix string, from *http.Response, to *Tr1d1umRespo
 }
 
 //ShouldRetryOnResponse determines whether or not to retry making another request
-func ShouldRetryOnResponse(tr1Resp interface{}, _ error) (retry bool) {
+func ShouldRetryOnResponse(tr1Resp interface{}, err error) (retry bool) {
 	tr1Response := tr1Resp.(*Tr1d1umResponse)
-	retry = tr1Response.Code == Tr1StatusTimeout
+	retry = tr1Response.Code == Tr1StatusTimeout && err != errCircuitOpen
 	return
 }
 
@@ -297,10 +356,22 @@ func OnRetryInternalFailure() (result interface{}) {
 	return tr1Resp
 }
 
+//OnRetryTimeout defines the result values when the request context ends while waiting to retry
+func OnRetryTimeout(err error) (result interface{}) {
+	tr1Resp := Tr1d1umResponse{}.New()
+	ReportError(err, tr1Resp)
+	return tr1Resp
+}
+
 //TransferResponse simply dumps data from a Tr1d1umResponse to its http equivalent (ResponseWriter)
 //This is needed due to the nature of retries. You can write multiple times to a tr1d1umResponse but
 //only once to a ResponseWriter
 func TransferResponse(from *Tr1d1umResponse, to http.ResponseWriter) {
+	//problem details replace whatever content type the handler expected to answer with
+	if from.problem != nil {
+		to.Header().Del(contentTypeKey)
+	}
+
 	// Headers
 	for headerKey, headerValues := range from.Headers {
 		for _, headerValue := range headerValues {
@@ -311,19 +382,34 @@ func TransferResponse(from *Tr1d1umResponse, to http.ResponseWriter) {
 	// Code
 	to.WriteHeader(from.Code)
 
-	// Body
+	// Body, which for failures carries the transaction ID of the request they belong to
+	if from.problem != nil && from.problem.TID == "" && to.Header().Get(HeaderWPATID) != "" {
+		problem := *from.problem
+		problem.TID = to.Header().Get(HeaderWPATID)
+		to.Write(problem.encode())
+		return
+	}
+
 	to.Write(from.Body)
 }
 
-//helper function that logs desired HTTP request/response info
+//helper function that logs desired HTTP request/response info. If the access log is on, the info is handed over
+//to it instead
 func bookkeepingLog(logger log.Logger, tr1Resp *Tr1d1umResponse, req *http.Request, latency time.Duration, TID string) {
-	var satClientID = "N/A"
+	var satClientID = unsetSatClientID
+
+	setResponseSource(req.Context(), tr1Resp.source)
 
 	// retrieve satClientID from request context
 	if reqContextValues, ok := handler.FromContext(req.Context()); ok {
 		satClientID = reqContextValues.SatClientID
 	}
 
+	if record, ok := accessRecordFrom(req.Context()); ok {
+		record.tid, record.satClientID, record.caller, record.responseError = TID, satClientID, ClientIdentity(req), tr1Resp.err
+		return
+	}
+
 	logging.Info(logger).Log(
 		logging.MessageKey(), "Bookkeeping response",
 		"requestAddress", req.RemoteAddr,
@@ -19,10 +19,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/Comcast/webpa-common/wrp"
@@ -59,7 +61,7 @@ func TestConversionHandler(t *testing.T) {
 
 		mockConversion.On("GetFlavorFormat", commonRequest, vars, "attributes", "names", ",").
 			Return(&GetWDMP{}, errors.New(errMsg)).Once()
-		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything).Return(true).Once()
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
 
 		ch.ServeHTTP(recorder, commonRequest)
 		assert.EqualValues(http.StatusBadRequest, recorder.Code)
@@ -72,7 +74,7 @@ func TestConversionHandler(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		getRequest := httptest.NewRequest(http.MethodGet, "http://someURL", nil)
 
-		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything).Return(false).Once()
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(false).Once()
 		mockConversion.AssertNotCalled(t, "GetFlavorFormat", getRequest, vars, "attributes", "names", ",")
 
 		ch.ServeHTTP(recorder, commonRequest)
@@ -138,7 +140,7 @@ func TestConversionHandler(t *testing.T) {
 		recorder := httptest.NewRecorder()
 
 		wrpMsg := &wrp.Message{}
-		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything).Return(true).Once()
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
 		mockConversion.On("GetConfiguredWRP", mock.AnythingOfType("[]uint8"), mock.Anything, commonRequest.Header).Return(wrpMsg).Once()
 		mockRetryStrategy.On("Execute", commonRequest.Context(), mock.Anything, mock.Anything).Return(resp, errors.New("some internal "+
 			"error")).Once()
@@ -229,42 +231,33 @@ func TestHandleStat(t *testing.T) {
 		ch.HandleStat(recorder, req)
 		mockRetryStrategy.AssertExpectations(t)
 	})
-}
 
-func TestHandleIOT(t *testing.T) {
-	ch := &ConversionHandler{
-		Sender:        mockSender,
-		Logger:        logging.DefaultLogger(),
-		TargetURL:     "http://targetURL.com",
-		RetryStrategy: mockRetryStrategy,
-		WRPRequestURL: "http://wrpurl.io",
-		WdmpConvert:   mockConversion,
-	}
-
-	t.Run("CorrectOutgoingRequest", func(t *testing.T) {
+	t.Run("LookupUnavailable", func(t *testing.T) {
+		assert := assert.New(t)
 		recorder := httptest.NewRecorder()
 
-		b := bytes.NewBufferString(`{}`)
-		req := httptest.NewRequest(http.MethodPost, "http://ThisMachineURL.com/api/v2/device/mac:112233445566/iot", b)
-		tr1Resp := Tr1d1umResponse{}.New()
-
-		urlVars := Vars{"deviceid": "mac:112233445566"}
-		req = mux.SetURLVars(req, urlVars)
-
-		mockConversion.On("GetConfiguredWRP", b.Bytes(), urlVars, req.Header).Return(&wrp.Message{})
-		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(tr1Resp, nil).Once()
+		ch := &ConversionHandler{
+			Logger:    logging.DefaultLogger(),
+			TargetURL: "http://targetURL.com",
+			Resolver: &prefixResolver{
+				prefixes: map[string]struct{}{"serial": {}},
+				delegate: NewHTTPDeviceResolver("http://127.0.0.1:0/devices/%s", time.Minute, &http.Client{}),
+			},
+		}
 
-		ch.HandleIOT(recorder, req)
+		req := httptest.NewRequest(http.MethodGet, "http://ThisMachineURL.com/api/v2/device/serial:XYZ/stat", nil)
+		ch.HandleStat(recorder, mux.SetURLVars(req, map[string]string{"deviceid": "serial:XYZ"}))
 
-		mockRetryStrategy.AssertExpectations(t)
-		mockConversion.AssertExpectations(t)
+		assert.EqualValues(http.StatusServiceUnavailable, recorder.Code)
+		assert.Contains(recorder.Body.String(), ProblemDeviceLookupUnavailable)
 	})
 }
+
 func TestIsValidRequest(t *testing.T) {
 	t.Run("NilURLVars", func(t *testing.T) {
 		assert := assert.New(t)
 		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger()}
-		assert.False(TR1RequestValidator.isValidRequest(nil, nil))
+		assert.False(TR1RequestValidator.isValidRequest(context.Background(), nil, nil))
 	})
 
 	t.Run("InvalidService", func(t *testing.T) {
@@ -272,7 +265,7 @@ func TestIsValidRequest(t *testing.T) {
 		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger()}
 		URLVars := map[string]string{"service": "wutService?"}
 		origin := httptest.NewRecorder()
-		assert.False(TR1RequestValidator.isValidRequest(URLVars, origin))
+		assert.False(TR1RequestValidator.isValidRequest(context.Background(), URLVars, origin))
 		assert.EqualValues(http.StatusBadRequest, origin.Code)
 	})
 
@@ -282,17 +275,51 @@ func TestIsValidRequest(t *testing.T) {
 		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger(), supportedServices: supportedServices}
 		URLVars := map[string]string{"service": "goodService", "deviceid": "wutDevice?"}
 		origin := httptest.NewRecorder()
-		assert.False(TR1RequestValidator.isValidRequest(URLVars, origin))
+		assert.False(TR1RequestValidator.isValidRequest(context.Background(), URLVars, origin))
 		assert.EqualValues(http.StatusBadRequest, origin.Code)
 	})
 
+	t.Run("LookupUnavailable", func(t *testing.T) {
+		assert := assert.New(t)
+		supportedServices := map[string]struct{}{"goodService": {}}
+		resolver := &prefixResolver{
+			prefixes: map[string]struct{}{"serial": {}},
+			delegate: NewHTTPDeviceResolver("http://127.0.0.1:0/devices/%s", time.Minute, &http.Client{}),
+		}
+
+		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger(), supportedServices: supportedServices, Resolver: resolver}
+		URLVars := map[string]string{"service": "goodService", "deviceid": "serial:XYZ"}
+		origin := httptest.NewRecorder()
+		assert.False(TR1RequestValidator.isValidRequest(context.Background(), URLVars, origin))
+		assert.EqualValues(http.StatusServiceUnavailable, origin.Code)
+		assert.Contains(origin.Body.String(), ProblemDeviceLookupUnavailable)
+	})
+
+	t.Run("Resolved", func(t *testing.T) {
+		assert := assert.New(t)
+		calls := 0
+		server := newDeviceLookupServer(&calls)
+		defer server.Close()
+
+		resolver := &prefixResolver{
+			prefixes: map[string]struct{}{"serial": {}},
+			delegate: NewHTTPDeviceResolver(server.URL+"/devices/%s", time.Minute, server.Client()),
+		}
+
+		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger(), supportedServices: map[string]struct{}{"goodService": {}}, Resolver: resolver}
+		URLVars := map[string]string{"service": "goodService", "deviceid": "serial:XYZ"}
+		assert.True(TR1RequestValidator.isValidRequest(context.Background(), URLVars, httptest.NewRecorder()))
+		assert.EqualValues("mac:112233445566", URLVars["deviceid"])
+		assert.EqualValues(1, calls)
+	})
+
 	t.Run("IdealCase", func(t *testing.T) {
 		assert := assert.New(t)
 		supportedServices := map[string]struct{}{"goodService": {}}
 		TR1RequestValidator := TR1RequestValidator{Logger: logging.DefaultLogger(), supportedServices: supportedServices}
 		URLVars := map[string]string{"service": "goodService", "deviceid": "mac:112233445566"}
 		origin := httptest.NewRecorder()
-		assert.True(TR1RequestValidator.isValidRequest(URLVars, origin))
+		assert.True(TR1RequestValidator.isValidRequest(context.Background(), URLVars, origin))
 		assert.EqualValues(http.StatusOK, origin.Code) // check origin's statusCode hasn't been changed from default
 	})
 }
@@ -337,7 +364,7 @@ func SetUpTest(encodeArg interface{}, req *http.Request) {
 	recorder := httptest.NewRecorder()
 
 	wrpMsg := &wrp.Message{}
-	mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything).Return(true).Once()
+	mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
 	mockConversion.On("GetConfiguredWRP", mock.AnythingOfType("[]uint8"), mock.Anything, req.Header).Return(wrpMsg).Once()
 	mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(resp, nil).Once()
 
@@ -0,0 +1,168 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//IdempotencyRecord is what tr1d1um remembers about a write request that carried an Idempotency-Key.
+//Response stays nil while the original request is still in flight. Headers are the ones the handler had set
+//on its own before transferring Response, i.e. its Content-Type
+type IdempotencyRecord struct {
+	Fingerprint string
+	TID         string
+	Headers     http.Header
+	Response    *Tr1d1umResponse
+	Expires     time.Time
+}
+
+//IdempotencyStore keeps IdempotencyRecords indexed by the client and Idempotency-Key of the request that produced them
+type IdempotencyStore interface {
+	Reserve(key, fingerprint string) (record *IdempotencyRecord, reserved bool)
+	Complete(key, tid string, headers http.Header, response *Tr1d1umResponse)
+	Release(key string)
+}
+
+//MemoryIdempotencyStore is an in-memory IdempotencyStore whose records expire after Window. Once it holds
+//as many records as it was sized for, the least recently used ones make room for new ones
+type MemoryIdempotencyStore struct {
+	Window  time.Duration
+	lock    sync.Mutex
+	records *lruCache
+	now     func() time.Time
+}
+
+//NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore holding up to size records.
+//A non-positive size leaves it unbounded
+func NewMemoryIdempotencyStore(window time.Duration, size int) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{Window: window, records: newLRUCache(size), now: time.Now}
+}
+
+//Reserve claims key for a request with the given fingerprint. If some unexpired record already holds the key,
+//a copy of it is returned instead
+func (m *MemoryIdempotencyStore) Reserve(key, fingerprint string) (record *IdempotencyRecord, reserved bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	if existing, found := m.records.Get(key); found && !now.After(existing.(*IdempotencyRecord).Expires) {
+		copied := *existing.(*IdempotencyRecord)
+		return &copied, false
+	}
+
+	m.records.Add(key, &IdempotencyRecord{Fingerprint: fingerprint, Expires: now.Add(m.Window)})
+	return nil, true
+}
+
+//Complete saves the final response of the request that reserved key, along with a copy of the headers
+//the handler had set for it
+func (m *MemoryIdempotencyStore) Complete(key, tid string, headers http.Header, response *Tr1d1umResponse) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if stored, found := m.records.Get(key); found {
+		record := stored.(*IdempotencyRecord)
+		record.TID, record.Response = tid, response
+		record.Headers = http.Header{}
+		for name, values := range headers {
+			record.Headers[name] = append([]string(nil), values...)
+		}
+		record.Expires = m.now().Add(m.Window)
+	}
+}
+
+//Release drops the reservation of key so that the request can be attempted again
+func (m *MemoryIdempotencyStore) Release(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.records.Remove(key)
+}
+
+//requestFingerprint identifies a write request by its method, path and converted WDMP payload
+func requestFingerprint(req *http.Request, wdmpPayload []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	hash.Write(wdmpPayload)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//idempotencyStoreKey scopes the Idempotency-Key of a request to the client that sent it, so that clients
+//picking the same key never see each other's responses. Header values cannot hold the NUL separator
+func idempotencyStoreKey(req *http.Request, key string) string {
+	return ClientIdentity(req) + "\x00" + key
+}
+
+//reserveIdempotencyKey claims the Idempotency-Key of the given write request, if any. When the client already used
+//the key, the stored response is replayed (or the appropriate error written) to origin and done is returned as true.
+//Anonymous clients are refused a key since they would all share, and so could replay, each other's responses
+func (ch *ConversionHandler) reserveIdempotencyKey(origin http.ResponseWriter, req *http.Request, wdmpPayload []byte) (key string, done bool) {
+	if key = req.Header.Get(HeaderIdempotency); key == "" || ch.IdempotencyStore == nil || req.Method == http.MethodGet {
+		return "", false
+	}
+
+	if ClientIdentity(req) == anonymousClient {
+		WriteResponseWriter("Idempotency-Key requires an authenticated client", http.StatusBadRequest, origin)
+		return "", true
+	}
+
+	key = idempotencyStoreKey(req, key)
+
+	record, reserved := ch.IdempotencyStore.Reserve(key, requestFingerprint(req, wdmpPayload))
+	if reserved {
+		return
+	}
+
+	switch {
+	case record.Fingerprint != requestFingerprint(req, wdmpPayload):
+		WriteResponseWriter("Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity, origin)
+
+	case record.Response == nil:
+		WriteResponseWriter("A request with this Idempotency-Key is still in progress", http.StatusConflict, origin)
+
+	default:
+		for name, values := range record.Headers {
+			origin.Header()[name] = values
+		}
+		origin.Header().Set(HeaderWPATID, record.TID)
+		origin.Header().Set(HeaderReplayed, "true")
+		TransferResponse(record.Response, origin)
+	}
+
+	return key, true
+}
+
+//completeIdempotencyKey remembers the final response of the request holding key, and the headers already set for it.
+//Requests an open circuit breaker or a busy device guard kept from reaching the device release their key instead
+//so that they can be retried
+func (ch *ConversionHandler) completeIdempotencyKey(key, tid string, headers http.Header, response *Tr1d1umResponse, err error) {
+	if key == "" {
+		return
+	}
+
+	if err == errCircuitOpen || err == errDeviceBusy {
+		ch.IdempotencyStore.Release(key)
+		return
+	}
+
+	ch.IdempotencyStore.Complete(key, tid, headers, response)
+}
@@ -0,0 +1,182 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	t.Run("ReserveAndComplete", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryIdempotencyStore(time.Minute, 0)
+
+		_, reserved := store.Reserve("key", "fingerprint")
+		assert.True(reserved)
+
+		record, reserved := store.Reserve("key", "fingerprint")
+		assert.False(reserved)
+		assert.Nil(record.Response)
+
+		headers := http.Header{contentTypeKey: {"application/json"}}
+		store.Complete("key", "tid", headers, Tr1d1umResponse{}.New())
+		headers.Set(contentTypeKey, "text/plain")
+
+		record, _ = store.Reserve("key", "fingerprint")
+		assert.EqualValues("tid", record.TID)
+		assert.NotNil(record.Response)
+		assert.EqualValues("application/json", record.Headers.Get(contentTypeKey))
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryIdempotencyStore(time.Minute, 2)
+
+		store.Reserve("first", "fingerprint")
+		store.Reserve("second", "fingerprint")
+		store.Reserve("third", "fingerprint")
+		assert.EqualValues(2, store.records.Len())
+
+		_, reserved := store.Reserve("first", "fingerprint")
+		assert.True(reserved)
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryIdempotencyStore(time.Minute, 0)
+
+		store.Reserve("key", "fingerprint")
+		store.Release("key")
+
+		_, reserved := store.Reserve("key", "fingerprint")
+		assert.True(reserved)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryIdempotencyStore(time.Minute, 0)
+		now := time.Now()
+		store.now = func() time.Time { return now }
+
+		store.Reserve("key", "fingerprint")
+		now = now.Add(2 * time.Minute)
+
+		_, reserved := store.Reserve("key", "fingerprint")
+		assert.True(reserved)
+	})
+}
+
+func TestServeHTTPIdempotency(t *testing.T) {
+	ch := &ConversionHandler{
+		WdmpConvert:      mockConversion,
+		Sender:           mockSender,
+		Logger:           logging.DefaultLogger(),
+		RequestValidator: mockRequestValidator,
+		RetryStrategy:    mockRetryStrategy,
+		IdempotencyStore: NewMemoryIdempotencyStore(time.Minute, 0),
+	}
+
+	newRequest := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://someURL/device/mac:112233445566/config/Device.Table.", bytes.NewBufferString(body))
+		req.Header.Set(HeaderIdempotency, "add-row-1")
+		req.SetBasicAuth("client", "pass")
+		return req
+	}
+
+	t.Run("Anonymous", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := newRequest("row")
+		req.Header.Del("Authorization")
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("AddFlavorFormat", mock.Anything, mock.Anything, "parameter").Return(&AddRowWDMP{Command: CommandAddRow}, nil).Once()
+
+		ch.ServeHTTP(recorder, req)
+		assert.EqualValues(http.StatusBadRequest, recorder.Code)
+		mockConversion.AssertExpectations(t)
+	})
+
+	t.Run("FirstRequest", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := newRequest("row")
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("AddFlavorFormat", mock.Anything, mock.Anything, "parameter").Return(&AddRowWDMP{Command: CommandAddRow}, nil).Once()
+		mockConversion.On("GetConfiguredWRP", mock.Anything, mock.Anything, mock.Anything).Return(&wrp.Message{TransactionUUID: "tid"}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(Tr1d1umResponse{}.New(), nil).Once()
+
+		ch.ServeHTTP(recorder, req)
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		mockRetryStrategy.AssertExpectations(t)
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("AddFlavorFormat", mock.Anything, mock.Anything, "parameter").Return(&AddRowWDMP{Command: CommandAddRow}, nil).Once()
+
+		ch.ServeHTTP(recorder, newRequest("row"))
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.EqualValues("tid", recorder.Header().Get(HeaderWPATID))
+		assert.EqualValues("true", recorder.Header().Get(HeaderReplayed))
+		assert.EqualValues(wrp.JSON.ContentType(), recorder.Header().Get(contentTypeKey))
+	})
+
+	t.Run("DifferentBody", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		row := map[string]string{"name": "other"}
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("AddFlavorFormat", mock.Anything, mock.Anything, "parameter").Return(&AddRowWDMP{Command: CommandAddRow, Row: row}, nil).Once()
+
+		ch.ServeHTTP(recorder, newRequest("other row"))
+		assert.EqualValues(http.StatusUnprocessableEntity, recorder.Code)
+		mockConversion.AssertExpectations(t)
+	})
+
+	t.Run("OtherClient", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := newRequest("row")
+		req.SetBasicAuth("other", "pass")
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("AddFlavorFormat", mock.Anything, mock.Anything, "parameter").Return(&AddRowWDMP{Command: CommandAddRow}, nil).Once()
+		mockConversion.On("GetConfiguredWRP", mock.Anything, mock.Anything, mock.Anything).Return(&wrp.Message{TransactionUUID: "other-tid"}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(Tr1d1umResponse{}.New(), nil).Once()
+
+		ch.ServeHTTP(recorder, req)
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.Empty(recorder.Header().Get(HeaderReplayed))
+		mockRetryStrategy.AssertExpectations(t)
+	})
+}
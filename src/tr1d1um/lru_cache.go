@@ -0,0 +1,77 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import "container/list"
+
+//lruCache holds up to max values, evicting the least recently used one to make room for a new one.
+//It is not safe for concurrent use; callers guard it with their own lock
+type lruCache struct {
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+//newLRUCache returns an empty lruCache. A non-positive max leaves it unbounded
+func newLRUCache(max int) *lruCache {
+	return &lruCache{max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+//Get returns the value stored under key and marks it as the most recently used
+func (c *lruCache) Get(key string) (value interface{}, found bool) {
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+//Add stores value under key, evicting the least recently used values beyond max
+func (c *lruCache) Add(key string, value interface{}) {
+	if element, found := c.entries[key]; found {
+		element.Value.(*lruEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+
+	for c.max > 0 && c.order.Len() > c.max {
+		c.Remove(c.order.Back().Value.(*lruEntry).key)
+	}
+}
+
+//Remove drops the value stored under key, if any
+func (c *lruCache) Remove(key string) {
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+//Len returns the number of values held
+func (c *lruCache) Len() int {
+	return c.order.Len()
+}
@@ -0,0 +1,66 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache(t *testing.T) {
+	t.Run("Evicts", func(t *testing.T) {
+		assert := assert.New(t)
+		cache := newLRUCache(2)
+
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+		cache.Get("a")
+		cache.Add("c", 3)
+
+		assert.EqualValues(2, cache.Len())
+		_, found := cache.Get("b")
+		assert.False(found)
+
+		value, found := cache.Get("a")
+		assert.True(found)
+		assert.EqualValues(1, value)
+	})
+
+	t.Run("Replaces", func(t *testing.T) {
+		assert := assert.New(t)
+		cache := newLRUCache(2)
+
+		cache.Add("a", 1)
+		cache.Add("a", 2)
+		value, _ := cache.Get("a")
+		assert.EqualValues(2, value)
+		assert.EqualValues(1, cache.Len())
+
+		cache.Remove("a")
+		assert.Zero(cache.Len())
+	})
+
+	t.Run("Unbounded", func(t *testing.T) {
+		cache := newLRUCache(0)
+		for _, key := range []string{"a", "b", "c"} {
+			cache.Add(key, key)
+		}
+		assert.EqualValues(t, 3, cache.Len())
+	})
+}
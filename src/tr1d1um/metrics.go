@@ -0,0 +1,107 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import "github.com/Comcast/webpa-common/xmetrics"
+
+//Names for the metrics tr1d1um exports
+const (
+	CircuitBreakerStateGauge         = "circuit_breaker_state"
+	CircuitBreakerTransitionsCounter = "circuit_breaker_transitions"
+	CircuitBreakerRejectedCounter    = "circuit_breaker_rejected"
+
+	RequestsCounter          = "requests"
+	ResponsesCounter         = "responses"
+	InFlightRequestsGauge    = "in_flight_requests"
+	RetryAttemptsCounter     = "retry_attempts"
+	RetriesExhaustedCounter  = "retries_exhausted"
+	OutboundLatencyHistogram = "outbound_request_duration_seconds"
+	WRPEncodeFailuresCounter = "wrp_encode_failures"
+	WRPDecodeFailuresCounter = "wrp_decode_failures"
+)
+
+//Metrics returns the metrics tr1d1um registers in addition to those of the webpa-common packages it uses
+func Metrics() []xmetrics.Metric {
+	return []xmetrics.Metric{
+		{
+			Name:       CircuitBreakerStateGauge,
+			Type:       xmetrics.GaugeType,
+			Help:       "State of the circuit breaker of a service: 0 closed, 1 half-open, 2 open",
+			LabelNames: []string{"service"},
+		},
+		{
+			Name:       CircuitBreakerTransitionsCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of times the circuit breaker of a service changed into the given state",
+			LabelNames: []string{"service", "state"},
+		},
+		{
+			Name:       CircuitBreakerRejectedCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of requests rejected because the circuit breaker of a service was open",
+			LabelNames: []string{"service"},
+		},
+		{
+			Name:       RequestsCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of requests handled, by route template, WDMP command and service",
+			LabelNames: []string{"route", "command", "service"},
+		},
+		{
+			Name:       ResponsesCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of responses sent, by status code and by whether tr1d1um, the target or the device produced the code",
+			LabelNames: []string{"code", "source"},
+		},
+		{
+			Name:       InFlightRequestsGauge,
+			Type:       xmetrics.GaugeType,
+			Help:       "Number of requests being handled, by route template",
+			LabelNames: []string{"route"},
+		},
+		{
+			Name:       RetryAttemptsCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of retries made towards the target of a service",
+			LabelNames: []string{"service"},
+		},
+		{
+			Name:       RetriesExhaustedCounter,
+			Type:       xmetrics.CounterType,
+			Help:       "Number of requests to the target of a service that still failed after the last retry",
+			LabelNames: []string{"service"},
+		},
+		{
+			Name:       OutboundLatencyHistogram,
+			Type:       xmetrics.HistogramType,
+			Help:       "Time taken by the target of a service to answer, redirects included",
+			LabelNames: []string{"service"},
+			Buckets:    []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		{
+			Name: WRPEncodeFailuresCounter,
+			Type: xmetrics.CounterType,
+			Help: "Number of WRP messages that could not be encoded for the target",
+		},
+		{
+			Name: WRPDecodeFailuresCounter,
+			Type: xmetrics.CounterType,
+			Help: "Number of WRP responses from the target that could not be decoded",
+		},
+	}
+}
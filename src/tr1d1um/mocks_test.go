@@ -98,8 +98,8 @@ type MockRequestValidator struct {
 	mock.Mock
 }
 
-func (m *MockRequestValidator) isValidRequest(reqVars map[string]string, origin http.ResponseWriter) bool {
-	args := m.Called(reqVars, origin)
+func (m *MockRequestValidator) isValidRequest(ctx context.Context, reqVars map[string]string, origin http.ResponseWriter) bool {
+	args := m.Called(ctx, reqVars, origin)
 	return args.Bool(0)
 }
 
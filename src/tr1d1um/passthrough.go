@@ -0,0 +1,141 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/mux"
+)
+
+//Headers through which callers of the WRP passthrough endpoint describe the message to be sent
+const (
+	HeaderWRPMessageType = "X-Xmidt-Message-Type"
+	HeaderWRPPath        = "X-Xmidt-Path"
+	HeaderWRPHeaders     = "X-Xmidt-Headers"
+	HeaderWRPMetadata    = "X-Xmidt-Metadata"
+)
+
+var (
+	errUnsupportedMessageType = errors.New("unsupported WRP message type")
+	errInvalidMetadata        = errors.New("metadata values must be of the form key=value")
+)
+
+//passthroughMessageTypes are the WRP message types callers may send through the passthrough endpoint
+var passthroughMessageTypes = map[string]wrp.MessageType{
+	"simpleevent":           wrp.SimpleEventMessageType,
+	"event":                 wrp.SimpleEventMessageType,
+	"simplerequestresponse": wrp.SimpleRequestResponseMessageType,
+	"request":               wrp.SimpleRequestResponseMessageType,
+	"create":                wrp.CreateMessageType,
+	"retrieve":              wrp.RetrieveMessageType,
+	"update":                wrp.UpdateMessageType,
+	"delete":                wrp.DeleteMessageType,
+}
+
+//HandleWRP sends the raw payload of the request to a device as the WRP message type given in the X-Xmidt-Message-Type
+//header. SimpleRequestResponse is used if no type is given
+func (ch *ConversionHandler) HandleWRP(origin http.ResponseWriter, req *http.Request) {
+	requestArrivalTime := time.Now()
+	var debugLogger, errorLogger = logging.Debug(ch), logging.Error(ch)
+
+	debugLogger.Log(logging.MessageKey(), "HandleWRP called")
+
+	assignTID(origin, req)
+	urlVars := mux.Vars(req)
+
+	if !ch.isValidRequest(req.Context(), urlVars, origin) {
+		return
+	}
+
+	route := ch.route(urlVars["service"])
+
+	if !route.isMethodAllowed(req.Method) {
+		WriteResponseWriter(fmt.Sprintf("Method %s not allowed for service", req.Method), http.StatusMethodNotAllowed, origin)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		origin.WriteHeader(http.StatusInternalServerError)
+		errorLogger.Log(logging.MessageKey(), "seeing error while reading request body", logging.ErrorKey(), err.Error())
+		return
+	}
+
+	wrpMsg := ch.WdmpConvert.GetConfiguredWRP(payload, urlVars, req.Header)
+
+	if err = configurePassthroughWRP(wrpMsg, req.Header); err != nil {
+		WriteResponseWriter(err.Error(), http.StatusBadRequest, origin)
+		errorLogger.Log(logging.MessageKey(), ErrUnsuccessfulDataParse, logging.ErrorKey(), err.Error())
+		return
+	}
+
+	//Forward transaction id being used in Request
+	origin.Header().Set(HeaderWPATID, wrpMsg.TransactionUUID)
+
+	tr1d1umResp, err := ch.sendWRP(req, route, wrpMsg)
+
+	if err != nil {
+		errorLogger.Log(logging.MessageKey(), "error in retry execution", logging.ErrorKey(), err)
+	}
+
+	//the payload is answered as the device described it, json otherwise
+	if contentType := tr1d1umResp.contentType; contentType != "" {
+		origin.Header().Set(contentTypeKey, contentType)
+	} else {
+		origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
+	}
+
+	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), wrpMsg.TransactionUUID)
+	TransferResponse(tr1d1umResp, origin)
+}
+
+//configurePassthroughWRP applies the message type, path, headers and metadata supplied by the caller
+func configurePassthroughWRP(wrpMsg *wrp.Message, header http.Header) (err error) {
+	if messageType := header.Get(HeaderWRPMessageType); messageType != "" {
+		var supported bool
+		if wrpMsg.Type, supported = passthroughMessageTypes[strings.ToLower(messageType)]; !supported {
+			return fmt.Errorf("%s: %s", errUnsupportedMessageType, messageType)
+		}
+	}
+
+	wrpMsg.Path = header.Get(HeaderWRPPath)
+	wrpMsg.Headers = header[HeaderWRPHeaders]
+
+	for _, metadata := range header[HeaderWRPMetadata] {
+		keyValue := strings.SplitN(metadata, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return errInvalidMetadata
+		}
+
+		if wrpMsg.Metadata == nil {
+			wrpMsg.Metadata = map[string]string{}
+		}
+		wrpMsg.Metadata[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+
+	return
+}
@@ -0,0 +1,171 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConfigurePassthroughWRP(t *testing.T) {
+	t.Run("DefaultType", func(t *testing.T) {
+		assert := assert.New(t)
+		wrpMsg := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType}
+
+		assert.Nil(configurePassthroughWRP(wrpMsg, http.Header{}))
+		assert.EqualValues(wrp.SimpleRequestResponseMessageType, wrpMsg.Type)
+		assert.Nil(wrpMsg.Metadata)
+	})
+
+	t.Run("AllFields", func(t *testing.T) {
+		assert := assert.New(t)
+		wrpMsg := &wrp.Message{}
+		header := http.Header{}
+		header.Set(HeaderWRPMessageType, "Update")
+		header.Set(HeaderWRPPath, "/some/path")
+		header.Add(HeaderWRPHeaders, "a")
+		header.Add(HeaderWRPHeaders, "b")
+		header.Add(HeaderWRPMetadata, "key = value")
+
+		assert.Nil(configurePassthroughWRP(wrpMsg, header))
+		assert.EqualValues(wrp.UpdateMessageType, wrpMsg.Type)
+		assert.EqualValues("/some/path", wrpMsg.Path)
+		assert.EqualValues([]string{"a", "b"}, wrpMsg.Headers)
+		assert.EqualValues(map[string]string{"key": "value"}, wrpMsg.Metadata)
+	})
+
+	t.Run("DeviceContentType", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+
+		b := bytes.NewBufferString(`{}`)
+		req := httptest.NewRequest(http.MethodPost, "http://ThisMachineURL.com/api/v2/wrp/device/mac:112233445566/iot", b)
+
+		urlVars := Vars{"deviceid": "mac:112233445566", "service": "iot"}
+		req = mux.SetURLVars(req, urlVars)
+
+		tr1Resp := Tr1d1umResponse{}.New()
+		tr1Resp.contentType = "text/plain"
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("GetConfiguredWRP", b.Bytes(), urlVars, req.Header).Return(&wrp.Message{TransactionUUID: "tid"}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(tr1Resp, nil).Once()
+
+		ch.HandleWRP(recorder, req)
+
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.EqualValues([]string{"text/plain"}, recorder.Header()[contentTypeKey])
+	})
+
+	t.Run("UnsupportedType", func(t *testing.T) {
+		header := http.Header{}
+		header.Set(HeaderWRPMessageType, "ServiceAlive")
+		assert.NotNil(t, configurePassthroughWRP(&wrp.Message{}, header))
+	})
+
+	t.Run("InvalidMetadata", func(t *testing.T) {
+		header := http.Header{}
+		header.Set(HeaderWRPMetadata, "noValue")
+		assert.EqualValues(t, errInvalidMetadata, configurePassthroughWRP(&wrp.Message{}, header))
+	})
+}
+
+func TestHandleWRP(t *testing.T) {
+	ch := &ConversionHandler{
+		Sender:           mockSender,
+		Logger:           logging.DefaultLogger(),
+		RetryStrategy:    mockRetryStrategy,
+		WRPRequestURL:    "http://wrpurl.io",
+		WdmpConvert:      mockConversion,
+		RequestValidator: mockRequestValidator,
+	}
+
+	t.Run("CorrectOutgoingRequest", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+
+		b := bytes.NewBufferString(`{}`)
+		req := httptest.NewRequest(http.MethodPost, "http://ThisMachineURL.com/api/v2/wrp/device/mac:112233445566/iot", b)
+		req.Header.Set(HeaderWRPMessageType, "SimpleEvent")
+
+		urlVars := Vars{"deviceid": "mac:112233445566", "service": "iot"}
+		req = mux.SetURLVars(req, urlVars)
+		wrpMsg := &wrp.Message{Type: wrp.SimpleRequestResponseMessageType, TransactionUUID: "tid"}
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("GetConfiguredWRP", b.Bytes(), urlVars, req.Header).Return(wrpMsg).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(Tr1d1umResponse{}.New(), nil).Once()
+
+		ch.HandleWRP(recorder, req)
+
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.EqualValues("tid", recorder.Header().Get(HeaderWPATID))
+		assert.EqualValues(wrp.JSON.ContentType(), recorder.Header().Get(contentTypeKey))
+		assert.EqualValues(wrp.SimpleEventMessageType, wrpMsg.Type)
+		mockRetryStrategy.AssertExpectations(t)
+		mockConversion.AssertExpectations(t)
+	})
+
+	t.Run("UnsupportedType", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+
+		b := bytes.NewBufferString(`{}`)
+		req := httptest.NewRequest(http.MethodPost, "http://ThisMachineURL.com/api/v2/wrp/device/mac:112233445566/iot", b)
+		req.Header.Set(HeaderWRPMessageType, "Unknown")
+
+		urlVars := Vars{"deviceid": "mac:112233445566", "service": "iot"}
+		req = mux.SetURLVars(req, urlVars)
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+		mockConversion.On("GetConfiguredWRP", b.Bytes(), urlVars, req.Header).Return(&wrp.Message{}).Once()
+
+		ch.HandleWRP(recorder, req)
+		assert.EqualValues(http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		assert := assert.New(t)
+		ch := &ConversionHandler{
+			Logger:           logging.DefaultLogger(),
+			RequestValidator: mockRequestValidator,
+			WdmpConvert:      mockConversion,
+			Services: map[string]*ServiceRoute{
+				"iot": {allowedMethods: map[string]struct{}{http.MethodGet: {}}},
+			},
+		}
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://ThisMachineURL.com/api/v2/wrp/device/mac:112233445566/iot", bytes.NewBufferString(`{}`))
+		req = mux.SetURLVars(req, map[string]string{"deviceid": "mac:112233445566", "service": "iot"})
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+
+		ch.HandleWRP(recorder, req)
+		assert.EqualValues(http.StatusMethodNotAllowed, recorder.Code)
+		mockConversion.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,168 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+//problemTypeBase prefixes the code of a problem to build its type URI
+const problemTypeBase = "urn:tr1d1um:problem:"
+
+//Stable codes clients can rely on to tell failures apart regardless of the wording of their detail
+const (
+	ProblemUnsupportedService = "unsupported_service"
+	ProblemInvalidDeviceID    = "invalid_device_id"
+	ProblemEmptyNames         = "empty_names"
+	ProblemInvalidSet         = "invalid_set"
+	ProblemMissingNewCid      = "missing_new_cid"
+	ProblemDeviceTimeout      = "device_timeout"
+	ProblemDeviceBusy         = "device_busy"
+	ProblemTargetUnavailable  = "target_unavailable"
+
+	ProblemDeviceLookupUnavailable = "device_lookup_unavailable"
+
+	ProblemBadRequest         = "bad_request"
+	ProblemForbidden          = "forbidden"
+	ProblemNotFound           = "not_found"
+	ProblemMethodNotAllowed   = "method_not_allowed"
+	ProblemConflict           = "conflict"
+	ProblemUnprocessable      = "unprocessable_entity"
+	ProblemTooManyRequests    = "too_many_requests"
+	ProblemInternalError      = "internal_error"
+	ProblemBadGateway         = "bad_gateway"
+	ProblemServiceUnavailable = "service_unavailable"
+)
+
+var problemTitles = map[string]string{
+	ProblemUnsupportedService: "Unsupported service",
+	ProblemInvalidDeviceID:    "Invalid device ID",
+	ProblemEmptyNames:         "Empty names",
+	ProblemInvalidSet:         "Invalid SET request",
+	ProblemMissingNewCid:      "Missing NewCid",
+	ProblemDeviceTimeout:      "Device timeout",
+	ProblemDeviceBusy:         "Device busy",
+	ProblemTargetUnavailable:  "Target unavailable",
+
+	ProblemDeviceLookupUnavailable: "Device lookup unavailable",
+}
+
+//statusProblems holds the code used for failures with no more specific class than their status code
+var statusProblems = map[int]string{
+	http.StatusBadRequest:          ProblemBadRequest,
+	http.StatusForbidden:           ProblemForbidden,
+	http.StatusNotFound:            ProblemNotFound,
+	http.StatusMethodNotAllowed:    ProblemMethodNotAllowed,
+	http.StatusConflict:            ProblemConflict,
+	http.StatusUnprocessableEntity: ProblemUnprocessable,
+	http.StatusTooManyRequests:     ProblemTooManyRequests,
+	http.StatusInternalServerError: ProblemInternalError,
+	http.StatusBadGateway:          ProblemBadGateway,
+	http.StatusServiceUnavailable:  ProblemServiceUnavailable,
+}
+
+//Problem is the RFC 7807 body of every error response. Code and TID are extension members
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+	TID    string `json:"tid,omitempty"`
+}
+
+//NewProblem builds the problem for the given code, status and detail
+func NewProblem(code string, statusCode int, detail string) *Problem {
+	title, ok := problemTitles[code]
+	if !ok {
+		title = http.StatusText(statusCode)
+	}
+
+	return &Problem{
+		Type:   problemTypeBase + code,
+		Title:  title,
+		Status: statusCode,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+//statusProblem returns the generic code for the given status code
+func statusProblem(statusCode int) string {
+	if code, ok := statusProblems[statusCode]; ok {
+		return code
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		return ProblemInternalError
+	}
+	return ProblemBadRequest
+}
+
+//conversionProblem returns the code of an error found while converting a request into WDMP
+func conversionProblem(err error) string {
+	switch err {
+	case errEmptyNames:
+		return ProblemEmptyNames
+	case errInvalidSetWDMP:
+		return ProblemInvalidSet
+	case errNewCIDRequired:
+		return ProblemMissingNewCid
+	}
+	return ProblemBadRequest
+}
+
+//encode serializes the problem. Problems are plain data so this cannot fail
+func (p *Problem) encode() []byte {
+	body, _ := json.Marshal(p)
+	return body
+}
+
+//WriteProblem turns the given Tr1d1umResponse into the problem for the given code, status and detail
+func WriteProblem(code string, statusCode int, detail string, tr1Resp *Tr1d1umResponse) {
+	tr1Resp.problem = NewProblem(code, statusCode, detail)
+	tr1Resp.problem.TID = tr1Resp.Headers.Get(HeaderWPATID)
+
+	tr1Resp.Headers.Set(contentTypeKey, problemContentType)
+	tr1Resp.Code = statusCode
+	tr1Resp.Body = tr1Resp.problem.encode()
+}
+
+//WriteProblemWriter writes the problem for the given code, status and detail to a caller through a ResponseWriter.
+//The transaction ID, if the response already carries one, goes into the problem as well
+func WriteProblemWriter(code string, statusCode int, detail string, origin http.ResponseWriter) {
+	problem := NewProblem(code, statusCode, detail)
+	problem.TID = origin.Header().Get(HeaderWPATID)
+
+	origin.Header().Set(contentTypeKey, problemContentType)
+	origin.WriteHeader(statusCode)
+	origin.Write(problem.encode())
+}
+
+//assignTID settles the transaction ID of the given request up front and forwards it in the response so that
+//every answer, errors included, can be traced back to it
+func assignTID(origin http.ResponseWriter, req *http.Request) (tid string) {
+	tid = GetOrGenTID(req.Header)
+	req.Header.Set(HeaderWPATID, tid)
+	origin.Header().Set(HeaderWPATID, tid)
+	return
+}
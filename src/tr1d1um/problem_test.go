@@ -0,0 +1,171 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeProblem(t *testing.T, body []byte) (problem Problem) {
+	assert.Nil(t, json.Unmarshal(body, &problem))
+	return
+}
+
+func TestNewProblem(t *testing.T) {
+	t.Run("Specific", func(t *testing.T) {
+		assert := assert.New(t)
+		problem := NewProblem(ProblemEmptyNames, http.StatusBadRequest, "names is empty")
+
+		assert.EqualValues("urn:tr1d1um:problem:empty_names", problem.Type)
+		assert.EqualValues("Empty names", problem.Title)
+		assert.EqualValues(http.StatusBadRequest, problem.Status)
+		assert.EqualValues("names is empty", problem.Detail)
+		assert.EqualValues(ProblemEmptyNames, problem.Code)
+	})
+
+	t.Run("Generic", func(t *testing.T) {
+		assert := assert.New(t)
+		problem := NewProblem(statusProblem(http.StatusConflict), http.StatusConflict, "")
+
+		assert.EqualValues(ProblemConflict, problem.Code)
+		assert.EqualValues("Conflict", problem.Title)
+	})
+}
+
+func TestStatusProblem(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualValues(ProblemTooManyRequests, statusProblem(http.StatusTooManyRequests))
+	assert.EqualValues(ProblemInternalError, statusProblem(http.StatusGatewayTimeout))
+	assert.EqualValues(ProblemBadRequest, statusProblem(http.StatusTeapot))
+}
+
+func TestConversionProblem(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualValues(ProblemEmptyNames, conversionProblem(errEmptyNames))
+	assert.EqualValues(ProblemInvalidSet, conversionProblem(errInvalidSetWDMP))
+	assert.EqualValues(ProblemMissingNewCid, conversionProblem(errNewCIDRequired))
+	assert.EqualValues(ProblemBadRequest, conversionProblem(errors.New("other")))
+}
+
+func TestWriteProblemWriter(t *testing.T) {
+	t.Run("WithTID", func(t *testing.T) {
+		assert := assert.New(t)
+		origin := httptest.NewRecorder()
+		origin.Header().Set(HeaderWPATID, "tid")
+
+		WriteProblemWriter(ProblemInvalidDeviceID, http.StatusBadRequest, `bad "id"`, origin)
+
+		assert.EqualValues(http.StatusBadRequest, origin.Code)
+		assert.EqualValues(problemContentType, origin.Header().Get(contentTypeKey))
+
+		problem := decodeProblem(t, origin.Body.Bytes())
+		assert.EqualValues(ProblemInvalidDeviceID, problem.Code)
+		assert.EqualValues(`bad "id"`, problem.Detail)
+		assert.EqualValues("tid", problem.TID)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		assert := assert.New(t)
+		origin := httptest.NewRecorder()
+
+		WriteResponseWriter("Success", http.StatusOK, origin)
+
+		assert.EqualValues(http.StatusOK, origin.Code)
+		assert.EqualValues(`{"message":"Success"}`, origin.Body.String())
+		assert.EqualValues("application/json", origin.Header().Get(contentTypeKey))
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		assert := assert.New(t)
+		origin := httptest.NewRecorder()
+
+		WriteResponseWriter("Forbidden", http.StatusForbidden, origin)
+
+		assert.EqualValues(problemContentType, origin.Header().Get(contentTypeKey))
+		assert.EqualValues(ProblemForbidden, decodeProblem(t, origin.Body.Bytes()).Code)
+	})
+}
+
+func TestTransferProblem(t *testing.T) {
+	assert := assert.New(t)
+	from, to := Tr1d1umResponse{}.New(), httptest.NewRecorder()
+	ReportError(errors.New("refused"), from)
+
+	to.Header().Set(HeaderWPATID, "tid")
+	to.Header().Set(contentTypeKey, "application/json")
+	TransferResponse(from, to)
+
+	assert.EqualValues([]string{problemContentType}, to.Header()[contentTypeKey])
+
+	problem := decodeProblem(t, to.Body.Bytes())
+	assert.EqualValues(ProblemInternalError, problem.Code)
+	assert.EqualValues("tid", problem.TID)
+	assert.Empty(from.problem.TID)
+}
+
+func TestIsValidRequestProblems(t *testing.T) {
+	validator := TR1RequestValidator{
+		supportedServices: map[string]struct{}{"config": {}},
+		Logger:            logging.DefaultLogger(),
+	}
+
+	t.Run("UnsupportedService", func(t *testing.T) {
+		assert := assert.New(t)
+		origin := httptest.NewRecorder()
+
+		assert.False(validator.isValidRequest(context.Background(), map[string]string{"service": "wut"}, origin))
+		assert.EqualValues(ProblemUnsupportedService, decodeProblem(t, origin.Body.Bytes()).Code)
+	})
+
+	t.Run("InvalidDeviceID", func(t *testing.T) {
+		assert := assert.New(t)
+		origin := httptest.NewRecorder()
+
+		assert.False(validator.isValidRequest(context.Background(), map[string]string{"service": "config", "deviceid": "wut"}, origin))
+		assert.EqualValues(ProblemInvalidDeviceID, decodeProblem(t, origin.Body.Bytes()).Code)
+	})
+}
+
+func TestAssignTID(t *testing.T) {
+	t.Run("Given", func(t *testing.T) {
+		assert := assert.New(t)
+		origin, req := httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(HeaderWPATID, "tid")
+
+		assert.EqualValues("tid", assignTID(origin, req))
+		assert.EqualValues("tid", origin.Header().Get(HeaderWPATID))
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		assert := assert.New(t)
+		origin, req := httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)
+
+		tid := assignTID(origin, req)
+		assert.NotEmpty(tid)
+		assert.EqualValues(tid, req.Header.Get(HeaderWPATID))
+		assert.EqualValues(tid, origin.Header().Get(HeaderWPATID))
+	})
+}
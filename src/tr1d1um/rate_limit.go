@@ -0,0 +1,235 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	rateLimitKey = "rateLimit"
+
+	//route classes requests are rate limited by
+	RouteClassRead  = "read"
+	RouteClassWrite = "write"
+	RouteClassStat  = "stat"
+
+	//headers describing the limit a request was counted against
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+
+	anonymousClient = "anonymous"
+
+	//unsetSatClientID is what authorization records as SatClientID for basic auth and JWTs without a subject
+	unsetSatClientID = "N/A"
+)
+
+//RateLimit is a token bucket refilled at Rate tokens per second that holds up to Burst tokens. A zero Rate means no limit
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+//RateLimitConfig defines the rateLimit section of the configuration file. Limits are given per route class (read,
+//write, stat). Clients, keyed by their authenticated identity, override the Default limits class by class
+type RateLimitConfig struct {
+	Default map[string]RateLimit            `json:"default"`
+	Clients map[string]map[string]RateLimit `json:"clients"`
+}
+
+//validate checks that only known route classes are configured and that limits are sensible
+func (config RateLimitConfig) validate() error {
+	limits := []map[string]RateLimit{config.Default}
+	for _, client := range config.Clients {
+		limits = append(limits, client)
+	}
+
+	for _, classes := range limits {
+		for class, limit := range classes {
+			if class != RouteClassRead && class != RouteClassWrite && class != RouteClassStat {
+				return fmt.Errorf("unknown route class %s", class)
+			}
+
+			if limit.Rate < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+				return fmt.Errorf("invalid rate limit for route class %s", class)
+			}
+		}
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	client string
+	class  string
+}
+
+//RateLimiter limits how often each client may call each route class
+type RateLimiter struct {
+	Config RateLimitConfig
+	log.Logger
+
+	lock      sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+//NewRateLimiter returns a RateLimiter enforcing the given configuration
+func NewRateLimiter(config RateLimitConfig, logger log.Logger) (*RateLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return &RateLimiter{
+		Config:  config,
+		Logger:  logger,
+		buckets: map[bucketKey]*tokenBucket{},
+		now:     time.Now,
+	}, nil
+}
+
+//limit returns the limit that applies to the given client and route class
+func (r *RateLimiter) limit(client, class string) RateLimit {
+	if limit, ok := r.Config.Clients[client][class]; ok {
+		return limit
+	}
+	return r.Config.Default[class]
+}
+
+//Take spends one token of the given client's bucket for the route class. When no token is left, retryAfter tells
+//how long until one is available. reset is how long until the bucket is full again
+func (r *RateLimiter) Take(client, class string) (limit RateLimit, remaining int, retryAfter, reset time.Duration, allowed bool) {
+	if limit = r.limit(client, class); limit.Rate == 0 {
+		return limit, 0, 0, 0, true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	key := bucketKey{client, class}
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if allowed = bucket.tokens >= 1; allowed {
+		bucket.tokens--
+	} else {
+		retryAfter = secondsToDuration((1 - bucket.tokens) / limit.Rate)
+	}
+
+	remaining = int(bucket.tokens)
+	reset = secondsToDuration((float64(limit.Burst) - bucket.tokens) / limit.Rate)
+	return
+}
+
+//sweep drops, at most once a minute, the buckets that refilled completely since they were last used, as
+//they are no different from new ones
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+
+	for key, bucket := range r.buckets {
+		limit := r.limit(key.client, key.class)
+		if limit.Rate == 0 || bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+//Decorate rate limits the requests reaching the given handler. It must come after authorization in the chain
+func (r *RateLimiter) Decorate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		client, class := ClientIdentity(req), RouteClass(req)
+		limit, remaining, retryAfter, reset, allowed := r.Take(client, class)
+
+		if limit.Rate > 0 {
+			origin.Header().Set(HeaderRateLimitLimit, strconv.Itoa(limit.Burst))
+			origin.Header().Set(HeaderRateLimitRemaining, strconv.Itoa(remaining))
+			origin.Header().Set(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(reset)))
+		}
+
+		if !allowed {
+			logging.Info(r).Log(logging.MessageKey(), "rate limit exceeded", "client", client, "routeClass", class)
+			origin.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			WriteResponseWriter("Too Many Requests", http.StatusTooManyRequests, origin)
+			return
+		}
+
+		delegate.ServeHTTP(origin, req)
+	})
+}
+
+//ClientIdentity returns who the request was authenticated as: the JWT subject or client certificate identity
+//recorded by authorization, else the basic auth user. The N/A placeholder authorization records for callers
+//without a subject does not count as an identity, lest all of them share one
+func ClientIdentity(req *http.Request) string {
+	if values, ok := handler.FromContext(req.Context()); ok && values.SatClientID != "" && values.SatClientID != unsetSatClientID {
+		return values.SatClientID
+	}
+
+	if user, _, ok := req.BasicAuth(); ok && user != "" {
+		return "basic:" + user
+	}
+	return anonymousClient
+}
+
+//RouteClass groups requests into stat, read (other GETs) and write (anything else)
+func RouteClass(req *http.Request) string {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/stat"):
+		return RouteClassStat
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		return RouteClassRead
+	default:
+		return RouteClassWrite
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,145 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewRateLimiter(RateLimitConfig{Default: map[string]RateLimit{"admin": {Rate: 1, Burst: 1}}}, logging.DefaultLogger())
+	assert.NotNil(err)
+
+	_, err = NewRateLimiter(RateLimitConfig{Clients: map[string]map[string]RateLimit{"c": {RouteClassRead: {Rate: 1}}}}, logging.DefaultLogger())
+	assert.NotNil(err)
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	limiter, err := NewRateLimiter(RateLimitConfig{
+		Default: map[string]RateLimit{RouteClassWrite: {Rate: 1, Burst: 2}},
+		Clients: map[string]map[string]RateLimit{"noisy": {RouteClassWrite: {Rate: 0.5, Burst: 1}}},
+	}, logging.DefaultLogger())
+	assert.Nil(t, err)
+
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	t.Run("Refills", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, remaining, _, _, allowed := limiter.Take("client", RouteClassWrite)
+		assert.True(allowed)
+		assert.EqualValues(1, remaining)
+
+		limiter.Take("client", RouteClassWrite)
+		_, _, retryAfter, _, allowed := limiter.Take("client", RouteClassWrite)
+		assert.False(allowed)
+		assert.EqualValues(time.Second, retryAfter)
+
+		now = now.Add(time.Second)
+		_, _, _, _, allowed = limiter.Take("client", RouteClassWrite)
+		assert.True(allowed)
+	})
+
+	t.Run("PerClient", func(t *testing.T) {
+		assert := assert.New(t)
+
+		limit, _, _, _, allowed := limiter.Take("noisy", RouteClassWrite)
+		assert.True(allowed)
+		assert.EqualValues(1, limit.Burst)
+
+		_, _, retryAfter, _, allowed := limiter.Take("noisy", RouteClassWrite)
+		assert.False(allowed)
+		assert.EqualValues(2*time.Second, retryAfter)
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			_, _, _, _, allowed := limiter.Take("client", RouteClassRead)
+			assert.True(t, allowed)
+		}
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		limiter.Take("other", RouteClassWrite)
+		assert.Len(t, limiter.buckets, 1)
+	})
+}
+
+func TestRateLimiterDecorate(t *testing.T) {
+	assert := assert.New(t)
+	limiter, err := NewRateLimiter(RateLimitConfig{Default: map[string]RateLimit{RouteClassStat: {Rate: 1, Burst: 1}}}, logging.DefaultLogger())
+	assert.Nil(err)
+
+	decorated := limiter.Decorate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(satClientID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/device/mac:112233445566/stat", nil)
+		req = req.WithContext(handler.NewContextWithValue(req.Context(), &handler.ContextValues{SatClientID: satClientID}))
+		recorder := httptest.NewRecorder()
+		decorated.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := serve("client-a")
+	assert.EqualValues(http.StatusOK, recorder.Code)
+	assert.EqualValues("1", recorder.Header().Get(HeaderRateLimitLimit))
+	assert.EqualValues("0", recorder.Header().Get(HeaderRateLimitRemaining))
+	assert.EqualValues("1", recorder.Header().Get(HeaderRateLimitReset))
+
+	recorder = serve("client-a")
+	assert.EqualValues(http.StatusTooManyRequests, recorder.Code)
+	assert.EqualValues("1", recorder.Header().Get("Retry-After"))
+
+	assert.EqualValues(http.StatusOK, serve("client-b").Code)
+}
+
+func TestClientIdentityAndRouteClass(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest(http.MethodPatch, "http://tr1d1um/api/v2/device/mac:112233445566/config", nil)
+	assert.EqualValues(anonymousClient, ClientIdentity(req))
+	assert.EqualValues(RouteClassWrite, RouteClass(req))
+
+	req.SetBasicAuth("user", "pass")
+	assert.EqualValues("basic:user", ClientIdentity(req))
+
+	req = req.WithContext(handler.NewContextWithValue(req.Context(), &handler.ContextValues{SatClientID: "sat-client"}))
+	assert.EqualValues("sat-client", ClientIdentity(req))
+
+	//basic auth and JWTs without a subject are recorded as N/A, which is no identity at all
+	req = req.WithContext(handler.NewContextWithValue(req.Context(), &handler.ContextValues{SatClientID: unsetSatClientID}))
+	assert.EqualValues("basic:user", ClientIdentity(req))
+
+	req = httptest.NewRequest(http.MethodPatch, "http://tr1d1um/api/v2/device/mac:112233445566/config", nil)
+	req = req.WithContext(handler.NewContextWithValue(req.Context(), &handler.ContextValues{SatClientID: unsetSatClientID}))
+	assert.EqualValues(anonymousClient, ClientIdentity(req))
+
+	assert.EqualValues(RouteClassRead, RouteClass(httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/device/mac:1/config", nil)))
+	assert.EqualValues(RouteClassStat, RouteClass(httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/device/mac:1/stat", nil)))
+}
@@ -0,0 +1,185 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+)
+
+const (
+	redirectCacheTTLKey = "redirectCacheTTL"
+	maxRedirectsKey     = "maxRedirects"
+)
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+//LocationCache remembers which instance (as scheme://host) holds each device. Locations are learnt from the
+//redirects of the routing tier and expire after TTL
+type LocationCache struct {
+	TTL       time.Duration
+	lock      sync.Mutex
+	locations map[device.ID]deviceLocation
+	now       func() time.Time
+}
+
+type deviceLocation struct {
+	origin  string
+	expires time.Time
+}
+
+//NewLocationCache returns an empty LocationCache
+func NewLocationCache(ttl time.Duration) *LocationCache {
+	return &LocationCache{TTL: ttl, locations: map[device.ID]deviceLocation{}, now: time.Now}
+}
+
+//Get returns the origin of the instance holding the given device, if known
+func (c *LocationCache) Get(id device.ID) (origin string, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	location, found := c.locations[id]
+	if found && c.now().After(location.expires) {
+		delete(c.locations, id)
+		return "", false
+	}
+	return location.origin, found
+}
+
+//Set records the origin of the instance holding the given device. Expired locations are swept out along the way
+func (c *LocationCache) Set(id device.ID, origin string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for cached, location := range c.locations {
+		if now.After(location.expires) {
+			delete(c.locations, cached)
+		}
+	}
+
+	c.locations[id] = deviceLocation{origin: origin, expires: now.Add(c.TTL)}
+}
+
+//Delete forgets the location of the given device
+func (c *LocationCache) Delete(id device.ID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.locations, id)
+}
+
+//noFollowRedirects keeps an http.Client from following redirects so that Tr1SendAndHandle can follow them itself
+func noFollowRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+//isRedirect returns true for the redirects that preserve the method and body of a request
+func isRedirect(code int) bool {
+	return code == http.StatusTemporaryRedirect || code == http.StatusPermanentRedirect
+}
+
+//withOrigin returns the given URL with its scheme and host replaced by those of origin
+func withOrigin(target *url.URL, origin string) *url.URL {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return target
+	}
+
+	moved := *target
+	moved.Scheme, moved.Host = originURL.Scheme, originURL.Host
+	return &moved
+}
+
+//send performs the given request, following the 307/308 redirects of the routing tier with the same method,
+//headers and body. The instance the device was found at is cached so that later requests go straight to it and,
+//if the device is no longer there, the request goes through the routing tier again
+func (tr1 *Tr1SendAndHandle) send(tr1Request Tr1d1umRequest, request *http.Request) (*http.Response, error) {
+	var (
+		ctx         = request.Context()
+		originalURL = request.URL
+		cached      = false
+		err         error
+	)
+
+	if tr1.Locations != nil && tr1Request.deviceID != "" {
+		if origin, found := tr1.Locations.Get(tr1Request.deviceID); found {
+			if request, err = tr1.newHTTPRequest(ctx, tr1Request, withOrigin(originalURL, origin).String()); err != nil {
+				return nil, err
+			}
+			cached = true
+		}
+	}
+
+	for redirects := 0; ; {
+		httpResp, err := tr1.client.Do(request)
+		if err != nil {
+			if !cached || ctx.Err() != nil {
+				return nil, err
+			}
+
+			//the instance the device was last seen at may be gone, so ask the original target once more
+			logging.Debug(tr1).Log(logging.MessageKey(), "cached location of device unreachable", "deviceID", tr1Request.deviceID, logging.ErrorKey(), err)
+			tr1.Locations.Delete(tr1Request.deviceID)
+			cached = false
+
+			if request, err = tr1.newHTTPRequest(ctx, tr1Request, originalURL.String()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var next *url.URL
+
+		switch {
+		case cached && httpResp.StatusCode == http.StatusNotFound:
+			logging.Debug(tr1).Log(logging.MessageKey(), "device not found at its cached location", "deviceID", tr1Request.deviceID)
+			tr1.Locations.Delete(tr1Request.deviceID)
+			next, cached = originalURL, false
+
+		case isRedirect(httpResp.StatusCode) && httpResp.Header.Get("Location") != "":
+			if redirects++; redirects > tr1.MaxRedirects {
+				httpResp.Body.Close()
+				return nil, errTooManyRedirects
+			}
+
+			if next, err = request.URL.Parse(httpResp.Header.Get("Location")); err != nil {
+				httpResp.Body.Close()
+				return nil, err
+			}
+
+			if tr1.Locations != nil && tr1Request.deviceID != "" {
+				tr1.Locations.Set(tr1Request.deviceID, next.Scheme+"://"+next.Host)
+			}
+
+		default:
+			return httpResp, nil
+		}
+
+		httpResp.Body.Close()
+
+		if request, err = tr1.newHTTPRequest(ctx, tr1Request, next.String()); err != nil {
+			return nil, err
+		}
+	}
+}
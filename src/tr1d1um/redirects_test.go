@@ -0,0 +1,181 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationCache(t *testing.T) {
+	t.Run("SetGetDelete", func(t *testing.T) {
+		assert := assert.New(t)
+		cache := NewLocationCache(time.Minute)
+
+		cache.Set("mac:112233445566", "http://talaria-1")
+		origin, found := cache.Get("mac:112233445566")
+		assert.True(found)
+		assert.EqualValues("http://talaria-1", origin)
+
+		cache.Delete("mac:112233445566")
+		_, found = cache.Get("mac:112233445566")
+		assert.False(found)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		cache := NewLocationCache(time.Minute)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+
+		cache.Set("mac:112233445566", "http://talaria-1")
+		now = now.Add(2 * time.Minute)
+
+		_, found := cache.Get("mac:112233445566")
+		assert.False(found)
+	})
+}
+
+func TestMakeRequestRedirects(t *testing.T) {
+	var deviceID device.ID = "mac:112233445566"
+
+	newSender := func() *Tr1SendAndHandle {
+		return &Tr1SendAndHandle{
+			Logger:       logging.DefaultLogger(),
+			RespTimeout:  time.Minute,
+			Locations:    NewLocationCache(time.Minute),
+			MaxRedirects: 3,
+			client:       &http.Client{CheckRedirect: noFollowRedirects},
+		}
+	}
+
+	newRequest := func(URL string) Tr1d1umRequest {
+		return Tr1d1umRequest{
+			method:      http.MethodPost,
+			URL:         URL,
+			body:        []byte("msgpack"),
+			headers:     http.Header{"Authorization": []string{"Basic abc"}},
+			rawResponse: true,
+			deviceID:    deviceID,
+		}
+	}
+
+	t.Run("FollowsAndCaches", func(t *testing.T) {
+		assert := assert.New(t)
+		talariaHits := 0
+
+		talaria := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			talariaHits++
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.EqualValues(http.MethodPost, r.Method)
+			assert.EqualValues("Basic abc", r.Header.Get("Authorization"))
+			assert.EqualValues("msgpack", string(body))
+			assert.EqualValues("/api/v2/device", r.URL.Path)
+		}))
+		defer talaria.Close()
+
+		petasosHits := 0
+		petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			petasosHits++
+			http.Redirect(w, r, talaria.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		}))
+		defer petasos.Close()
+
+		tr1 := newSender()
+
+		for i := 0; i < 2; i++ {
+			resp, err := tr1.MakeRequest(context.Background(), newRequest(petasos.URL+"/api/v2/device"))
+			assert.Nil(err)
+			assert.EqualValues(http.StatusOK, resp.(*Tr1d1umResponse).Code)
+		}
+
+		assert.EqualValues(1, petasosHits)
+		assert.EqualValues(2, talariaHits)
+
+		origin, found := tr1.Locations.Get(deviceID)
+		assert.True(found)
+		assert.EqualValues(talaria.URL, origin)
+	})
+
+	t.Run("InvalidatesOnNotFound", func(t *testing.T) {
+		assert := assert.New(t)
+
+		stale := httptest.NewServer(http.NotFoundHandler())
+		defer stale.Close()
+
+		talaria := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer talaria.Close()
+
+		petasos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, talaria.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		}))
+		defer petasos.Close()
+
+		tr1 := newSender()
+		tr1.Locations.Set(deviceID, stale.URL)
+
+		resp, err := tr1.MakeRequest(context.Background(), newRequest(petasos.URL+"/api/v2/device"))
+		assert.Nil(err)
+		assert.EqualValues(http.StatusOK, resp.(*Tr1d1umResponse).Code)
+
+		origin, _ := tr1.Locations.Get(deviceID)
+		assert.EqualValues(talaria.URL, origin)
+	})
+
+	t.Run("InvalidatesOnTransportError", func(t *testing.T) {
+		assert := assert.New(t)
+
+		gone := httptest.NewServer(http.NotFoundHandler())
+		gone.Close()
+
+		talaria := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer talaria.Close()
+
+		tr1 := newSender()
+		tr1.Locations.Set(deviceID, gone.URL)
+
+		resp, err := tr1.MakeRequest(context.Background(), newRequest(talaria.URL+"/api/v2/device"))
+		assert.Nil(err)
+		assert.EqualValues(http.StatusOK, resp.(*Tr1d1umResponse).Code)
+
+		_, found := tr1.Locations.Get(deviceID)
+		assert.False(found)
+	})
+
+	t.Run("TooManyRedirects", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var loop *httptest.Server
+		loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, loop.URL+r.URL.Path, http.StatusPermanentRedirect)
+		}))
+		defer loop.Close()
+
+		resp, err := newSender().MakeRequest(context.Background(), newRequest(loop.URL+"/api/v2/device"))
+		assert.EqualValues(errTooManyRedirects, err)
+		assert.EqualValues(http.StatusInternalServerError, resp.(*Tr1d1umResponse).Code)
+	})
+}
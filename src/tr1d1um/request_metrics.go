@@ -0,0 +1,149 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/Comcast/webpa-common/xmetrics"
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+)
+
+//Sources of the status code of a response
+const (
+	SourceTr1d1um = "tr1d1um"
+	SourceTarget  = "target"
+	SourceDevice  = "device"
+)
+
+//RequestMeasures are the metrics describing the requests tr1d1um handles and the ones it makes to its targets
+type RequestMeasures struct {
+	Requests          metrics.Counter
+	Responses         metrics.Counter
+	InFlight          metrics.Gauge
+	RetryAttempts     metrics.Counter
+	RetriesExhausted  metrics.Counter
+	OutboundLatency   metrics.Histogram
+	WRPEncodeFailures metrics.Counter
+	WRPDecodeFailures metrics.Counter
+
+	//Services are the services requests are labeled with. Any other service in the URL is labeled unknown
+	Services map[string]struct{}
+}
+
+//NewRequestMeasures fetches the request metrics out of the given registry
+func NewRequestMeasures(registry xmetrics.Registry) *RequestMeasures {
+	return &RequestMeasures{
+		Requests:          registry.NewCounter(RequestsCounter),
+		Responses:         registry.NewCounter(ResponsesCounter),
+		InFlight:          registry.NewGauge(InFlightRequestsGauge),
+		RetryAttempts:     registry.NewCounter(RetryAttemptsCounter),
+		RetriesExhausted:  registry.NewCounter(RetriesExhaustedCounter),
+		OutboundLatency:   registry.NewHistogram(OutboundLatencyHistogram, 10),
+		WRPEncodeFailures: registry.NewCounter(WRPEncodeFailuresCounter),
+		WRPDecodeFailures: registry.NewCounter(WRPDecodeFailuresCounter),
+	}
+}
+
+//instrumentRoute makes the retry strategies and sender of the given route report to the measures
+func (m *RequestMeasures) instrumentRoute(service string, route *ServiceRoute) {
+	strategies := []RetryStrategy{route.RetryStrategy}
+	for _, strategy := range route.MethodRetryStrategies {
+		strategies = append(strategies, strategy)
+	}
+
+	for _, strategy := range strategies {
+		if retry, ok := strategy.(*Retry); ok {
+			retry.Retries = m.RetryAttempts.With("service", service)
+			retry.Exhausted = m.RetriesExhausted.With("service", service)
+		}
+	}
+
+	if sender, ok := route.Sender.(*Tr1SendAndHandle); ok {
+		sender.Latency = m.OutboundLatency.With("service", service)
+		sender.DecodeFailures = m.WRPDecodeFailures
+	}
+}
+
+//requestLabels collects, while a request is handled, the labels only the handlers know about
+type requestLabels struct {
+	command string
+	source  string
+}
+
+type requestLabelsKey struct{}
+
+//setRequestCommand records the WDMP command the request carried out
+func setRequestCommand(ctx context.Context, command string) {
+	if labels, ok := ctx.Value(requestLabelsKey{}).(*requestLabels); ok && command != "" {
+		labels.command = command
+	}
+}
+
+//setResponseSource records what produced the status code of the response
+func setResponseSource(ctx context.Context, source string) {
+	if labels, ok := ctx.Value(requestLabelsKey{}).(*requestLabels); ok && source != "" {
+		labels.source = source
+	}
+}
+
+//routeTemplate returns the path template of the route the request matched
+func routeTemplate(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unknown"
+}
+
+//serviceLabel returns the service in the URL of the request if it is one of Services, so that arbitrary URLs
+//cannot grow the number of series. Routes without a service are not labeled with one
+func (m *RequestMeasures) serviceLabel(req *http.Request) string {
+	service, ok := mux.Vars(req)["service"]
+	if !ok {
+		return ""
+	}
+
+	if _, supported := m.Services[service]; supported {
+		return service
+	}
+	return "unknown"
+}
+
+//Decorate counts the requests reaching the given handler and their responses. It should come first in the chain so
+//that rejected requests are counted too
+func (m *RequestMeasures) Decorate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		route := routeTemplate(req)
+		labels := &requestLabels{command: commandType(req), source: SourceTr1d1um}
+
+		inFlight := m.InFlight.With("route", route)
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		recorder := &statusRecorder{ResponseWriter: origin, code: http.StatusOK}
+		delegate.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), requestLabelsKey{}, labels)))
+
+		m.Requests.With("route", route, "command", labels.command, "service", m.serviceLabel(req)).Add(1)
+		m.Responses.With("code", strconv.Itoa(recorder.code), "source", labels.source).Add(1)
+	})
+}
@@ -0,0 +1,138 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+//testCounter is a counter whose labeled children share their values with it, keyed by their label values
+type testCounter struct {
+	lock   *sync.Mutex
+	values map[string]float64
+	labels []string
+}
+
+func newTestCounter() *testCounter {
+	return &testCounter{lock: new(sync.Mutex), values: map[string]float64{}}
+}
+
+func (c *testCounter) With(labelValues ...string) metrics.Counter {
+	return &testCounter{lock: c.lock, values: c.values, labels: append(append([]string{}, c.labels...), labelValues...)}
+}
+
+func (c *testCounter) Add(delta float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(c.labels, ",")] += delta
+}
+
+func (c *testCounter) value(labelValues ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[strings.Join(labelValues, ",")]
+}
+
+//testHistogram counts its observations
+type testHistogram struct {
+	lock         sync.Mutex
+	observations int
+}
+
+func (h *testHistogram) With(...string) metrics.Histogram { return h }
+
+func (h *testHistogram) Observe(float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.observations++
+}
+
+func TestRequestMeasuresDecorate(t *testing.T) {
+	assert := assert.New(t)
+	requests, responses := newTestCounter(), newTestCounter()
+	measures := &RequestMeasures{Requests: requests, Responses: responses, InFlight: generic.NewGauge("inFlight"),
+		Services: map[string]struct{}{"config": {}}}
+
+	r := mux.NewRouter()
+	r.Handle("/device/{deviceid}/stat", measures.Decorate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})))
+	r.Handle("/device/{deviceid}/{service}", measures.Decorate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		setRequestCommand(req.Context(), CommandSetAttrs)
+		setResponseSource(req.Context(), SourceDevice)
+		w.WriteHeader(http.StatusAccepted)
+	})))
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/device/mac:112233445566/config", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/device/mac:112233445566/stat", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/device/mac:112233445566/random-1234", nil))
+
+	assert.EqualValues(1, requests.value("route", "/device/{deviceid}/{service}", "command", CommandSetAttrs, "service", "config"))
+	assert.EqualValues(1, requests.value("route", "/device/{deviceid}/{service}", "command", CommandSetAttrs, "service", "unknown"))
+	assert.EqualValues(0, requests.value("route", "/device/{deviceid}/{service}", "command", CommandSetAttrs, "service", "random-1234"))
+	assert.EqualValues(2, responses.value("code", "202", "source", SourceDevice))
+	assert.EqualValues(1, responses.value("code", "400", "source", SourceTr1d1um))
+}
+
+func TestSendAndHandleMeasures(t *testing.T) {
+	assert := assert.New(t)
+	var device bytes.Buffer
+	wrp.NewEncoder(&device, wrp.Msgpack).Encode(&wrp.Message{Type: wrp.SimpleRequestResponseMessageType, Payload: []byte(`{"statusCode":520}`)})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/garbage" {
+			w.Write([]byte("not msgpack"))
+			return
+		}
+		w.Write(device.Bytes())
+	}))
+	defer server.Close()
+
+	latency, decodeFailures := new(testHistogram), generic.NewCounter("decodeFailures")
+	tr1 := &Tr1SendAndHandle{
+		Logger:         logging.DefaultLogger(),
+		RespTimeout:    time.Minute,
+		Latency:        latency,
+		DecodeFailures: decodeFailures,
+		client:         &http.Client{},
+	}
+
+	resp, _ := tr1.MakeRequest(context.Background(), Tr1d1umRequest{method: http.MethodPost, URL: server.URL + "/device"})
+	assert.EqualValues(520, resp.(*Tr1d1umResponse).Code)
+	assert.EqualValues(SourceDevice, resp.(*Tr1d1umResponse).source)
+
+	resp, _ = tr1.MakeRequest(context.Background(), Tr1d1umRequest{method: http.MethodPost, URL: server.URL + "/garbage"})
+	assert.EqualValues("", resp.(*Tr1d1umResponse).source)
+
+	assert.EqualValues(2, latency.observations)
+	assert.EqualValues(1, decodeFailures.Value())
+}
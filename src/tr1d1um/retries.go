@@ -20,10 +20,14 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
 	"time"
 
 	"github.com/Comcast/webpa-common/logging"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 )
 
 var (
@@ -33,6 +37,23 @@ var (
 	errUndefinedRetryOp     = errors.New("retry: operation to retry is undefined")
 )
 
+//Supported backoff strategies for the wait between retries
+const (
+	BackoffConstant    = "constant"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+)
+
+//ValidateBackoff returns an error if the given backoff strategy is not supported. An empty strategy means constant
+func ValidateBackoff(backoff string) (err error) {
+	switch backoff {
+	case "", BackoffConstant, BackoffLinear, BackoffExponential:
+	default:
+		err = fmt.Errorf("retry: unsupported backoff strategy '%s'", backoff)
+	}
+	return
+}
+
 //RetryStrategy defines
 type RetryStrategy interface {
 	Execute(context.Context, func(context.Context, ...interface{}) (interface{}, error), ...interface{}) (interface{}, error)
@@ -41,10 +62,15 @@ type RetryStrategy interface {
 //Retry is the realization of RetryStrategy.
 type Retry struct {
 	log.Logger
-	Interval       time.Duration                 // time we wait between retries
+	Interval       time.Duration                 // time we wait between retries (base value for non constant backoffs)
+	MaxInterval    time.Duration                 // cap on the time we wait between retries. Zero means no cap
+	Backoff        string                        // one of BackoffConstant, BackoffLinear or BackoffExponential
 	MaxRetries     int                           //maximum number of retries
 	ShouldRetry    func(interface{}, error) bool // provided function to determine whether or not to retry
 	OnInternalFail func() interface{}            // provided function to define some result in the case of failure
+	OnTimeout      func(error) interface{}       // provided function to define some result if the context ends while waiting
+	Retries        metrics.Counter               // if set, counts the attempts made after the first one
+	Exhausted      metrics.Counter               // if set, counts the operations still asking for a retry after the last attempt
 }
 
 //RetryStrategyFactory is the fool-proof method to get a RetryStrategy struct initialized
@@ -63,6 +89,26 @@ func (r RetryStrategyFactory) NewRetryStrategy(logger log.Logger, interval time.
 	return retry
 }
 
+//NewRetryStrategyWithBackoff provides a RetryStrategy (of type Retry) that waits according to the given backoff strategy
+func (r RetryStrategyFactory) NewRetryStrategyWithBackoff(logger log.Logger, backoff string, interval, maxInterval time.Duration,
+	maxRetries int, shouldRetry func(interface{}, error) bool, onInternalFailure func() interface{},
+	onTimeout func(error) interface{}) (RetryStrategy, error) {
+	if err := ValidateBackoff(backoff); err != nil {
+		return nil, err
+	}
+
+	return &Retry{
+		Logger:         logger,
+		Interval:       interval,
+		MaxInterval:    maxInterval,
+		Backoff:        backoff,
+		MaxRetries:     maxRetries,
+		ShouldRetry:    shouldRetry,
+		OnInternalFail: onInternalFailure,
+		OnTimeout:      onTimeout,
+	}, nil
+}
+
 //Execute is the core method of the RetryStrategy. It runs a given operation on provided inputs based on
 // pre-defined configurations
 func (r *Retry) Execute(ctx context.Context, op func(context.Context, ...interface{}) (interface{}, error), arguments ...interface{}) (result interface{}, err error) {
@@ -83,11 +129,76 @@ func (r *Retry) Execute(ctx context.Context, op func(context.Context, ...interfa
 	for attempt := 0; attempt < r.MaxRetries; attempt++ {
 		debugLogger.Log(logging.MessageKey(), "Attempting operation", "attempt", attempt)
 
-		result, err = op(ctx, arguments...)
+		if attempt > 0 && r.Retries != nil {
+			r.Retries.Add(1)
+		}
+
+		countAttempt(ctx)
+
+		attemptCtx, span := StartSpan(ctx, "attempt", SpanKindInternal)
+		span.SetAttribute("retry.attempt", strconv.Itoa(attempt))
+
+		result, err = op(attemptCtx, arguments...)
+		span.SetError(err)
+		span.Finish()
+
 		if !r.ShouldRetry(result, err) {
 			break
 		}
-		time.Sleep(r.Interval)
+
+		if attempt == r.MaxRetries-1 {
+			if r.Exhausted != nil {
+				r.Exhausted.Add(1)
+			}
+			break
+		}
+
+		if waitErr := r.wait(ctx, attempt+1); waitErr != nil {
+			debugLogger.Log(logging.MessageKey(), "Context ended while waiting to retry", logging.ErrorKey(), waitErr)
+			if r.OnTimeout != nil {
+				result, err = r.OnTimeout(waitErr), waitErr
+			}
+			break
+		}
+	}
+	return
+}
+
+//wait blocks for the backoff of the given retry (1 for the first retry) or until the context ends,
+//in which case the context's error is returned
+func (r *Retry) wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(r.backoff(retry))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//backoff returns the time to wait before the given retry (1 for the first retry)
+func (r *Retry) backoff(retry int) (interval time.Duration) {
+	switch r.Backoff {
+	case BackoffLinear:
+		interval = r.Interval * time.Duration(retry)
+	case BackoffExponential:
+		interval = r.Interval
+		for i := 1; i < retry && (r.MaxInterval <= 0 || interval < r.MaxInterval); i++ {
+			interval *= 2
+		}
+	default:
+		interval = r.Interval
+	}
+
+	if r.MaxInterval > 0 && interval > r.MaxInterval {
+		interval = r.MaxInterval
+	}
+
+	// full jitter keeps concurrent retries of many clients from hitting the target at once
+	if r.Backoff == BackoffExponential && interval > 0 {
+		interval = time.Duration(rand.Int63n(int64(interval) + 1))
 	}
 	return
 }
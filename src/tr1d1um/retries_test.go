@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/metrics/generic"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,6 +52,28 @@ func TestRetryExecute(t *testing.T) {
 		assert.EqualValues(retry.MaxRetries, callCount)
 	})
 
+	t.Run("Measures", func(t *testing.T) {
+		assert := assert.New(t)
+		retries, exhausted := generic.NewCounter("retries"), generic.NewCounter("exhausted")
+		retry := Retry{
+			Logger:         logging.DefaultLogger(),
+			MaxRetries:     3,
+			ShouldRetry:    func(_ interface{}, _ error) bool { return true },
+			OnInternalFail: func() interface{} { return -1 },
+			Retries:        retries,
+			Exhausted:      exhausted,
+		}
+
+		retry.Execute(context.TODO(), func(_ context.Context, _ ...interface{}) (_ interface{}, _ error) { return }, 0)
+		assert.EqualValues(2, retries.Value())
+		assert.EqualValues(1, exhausted.Value())
+
+		retry.ShouldRetry = func(_ interface{}, _ error) bool { return false }
+		retry.Execute(context.TODO(), func(_ context.Context, _ ...interface{}) (_ interface{}, _ error) { return }, 0)
+		assert.EqualValues(2, retries.Value())
+		assert.EqualValues(1, exhausted.Value())
+	})
+
 	t.Run("FailInBetween", func(t *testing.T) {
 		assert := assert.New(t)
 		retry := Retry{
@@ -147,3 +170,64 @@ func TestRetryCheckDependencies(t *testing.T) {
 		assert.EqualValues(errUndefinedRetryOp, err)
 	})
 }
+
+func TestRetryBackoff(t *testing.T) {
+	t.Run("Constant", func(t *testing.T) {
+		assert := assert.New(t)
+		retry := Retry{Interval: time.Second}
+		assert.EqualValues(time.Second, retry.backoff(1))
+		assert.EqualValues(time.Second, retry.backoff(3))
+	})
+
+	t.Run("Linear", func(t *testing.T) {
+		assert := assert.New(t)
+		retry := Retry{Interval: time.Second, MaxInterval: 5 * time.Second, Backoff: BackoffLinear}
+		assert.EqualValues(time.Second, retry.backoff(1))
+		assert.EqualValues(3*time.Second, retry.backoff(3))
+		assert.EqualValues(5*time.Second, retry.backoff(10))
+	})
+
+	t.Run("ExponentialWithJitter", func(t *testing.T) {
+		assert := assert.New(t)
+		retry := Retry{Interval: time.Second, MaxInterval: 5 * time.Second, Backoff: BackoffExponential}
+		for i := 0; i < 100; i++ {
+			assert.True(retry.backoff(2) <= 2*time.Second)
+			assert.True(retry.backoff(50) <= 5*time.Second)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		assert := assert.New(t)
+		assert.Nil(ValidateBackoff(""))
+		assert.Nil(ValidateBackoff(BackoffExponential))
+		assert.NotNil(ValidateBackoff("fibonacci"))
+	})
+}
+
+func TestRetryContextDone(t *testing.T) {
+	assert := assert.New(t)
+	retry := Retry{
+		Logger:         logging.DefaultLogger(),
+		Interval:       time.Hour,
+		MaxRetries:     3,
+		ShouldRetry:    func(_ interface{}, _ error) bool { return true },
+		OnInternalFail: OnRetryInternalFailure,
+		OnTimeout:      OnRetryTimeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	callCount := 0
+	countOp := func(_ context.Context, _ ...interface{}) (_ interface{}, _ error) {
+		callCount++
+		return
+	}
+
+	start := time.Now()
+	result, err := retry.Execute(ctx, countOp)
+	assert.True(time.Since(start) < time.Minute)
+	assert.EqualValues(context.DeadlineExceeded, err)
+	assert.EqualValues(1, callCount)
+	assert.EqualValues(Tr1StatusTimeout, result.(*Tr1d1umResponse).Code)
+}
@@ -0,0 +1,148 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const retryPolicyKey = "retryPolicy"
+
+//Error classes a RetryCondition can list
+const (
+	RetryOnTimeout           = "timeout"
+	RetryOnConnectionRefused = "connectionRefused"
+	RetryOnDNSFailure        = "dnsFailure"
+)
+
+//retryErrorClasses maps each error class to the error message fragments that identify it
+var retryErrorClasses = map[string][]string{
+	RetryOnTimeout:           {"context canceled", "deadline exceeded", "Client.Timeout exceeded"},
+	RetryOnConnectionRefused: {"connection refused"},
+	RetryOnDNSFailure:        {"no such host", "server misbehaving"},
+}
+
+//RetryCondition lists the outcomes of a request that are worth another attempt
+type RetryCondition struct {
+	StatusCodes    []int    `json:"statusCodes"`
+	Errors         []string `json:"errors"`
+	RDKStatusCodes []int    `json:"rdkStatusCodes"`
+}
+
+//RetryPolicyConfig defines the retryPolicy section of the configuration file. Methods override the
+//default condition for requests of the given HTTP method. A method with an empty condition is never retried
+type RetryPolicyConfig struct {
+	Default RetryCondition            `json:"default"`
+	Methods map[string]RetryCondition `json:"methods"`
+}
+
+//defaultRetryMethods are the methods that are never retried unless the retry policy configures them. Repeating
+//a POST or PUT can apply its change twice
+var defaultRetryMethods = map[string]RetryCondition{
+	http.MethodPost: {},
+	http.MethodPut:  {},
+}
+
+//defaultRetryPolicy retries timeouts of any method but those in defaultRetryMethods
+func defaultRetryPolicy() RetryPolicyConfig {
+	return RetryPolicyConfig{Default: RetryCondition{StatusCodes: []int{Tr1StatusTimeout}}}
+}
+
+//validate returns an error if the condition lists an unknown error class
+func (c RetryCondition) validate() error {
+	for _, class := range c.Errors {
+		if _, ok := retryErrorClasses[class]; !ok {
+			return fmt.Errorf("retry: unsupported error class '%s'", class)
+		}
+	}
+	return nil
+}
+
+//ShouldRetry determines whether or not the given outcome of a request matches the condition.
+//Requests rejected by an open circuit breaker are never retried
+func (c RetryCondition) ShouldRetry(tr1Resp interface{}, err error) bool {
+	if err == errCircuitOpen {
+		return false
+	}
+
+	if err != nil {
+		for _, class := range c.Errors {
+			for _, fragment := range retryErrorClasses[class] {
+				if strings.Contains(err.Error(), fragment) {
+					return true
+				}
+			}
+		}
+	}
+
+	tr1Response, ok := tr1Resp.(*Tr1d1umResponse)
+	if !ok {
+		return false
+	}
+
+	for _, code := range c.StatusCodes {
+		if tr1Response.Code == code {
+			return true
+		}
+	}
+
+	if len(c.RDKStatusCodes) > 0 {
+		if rdkCode, rdkErr := GetStatusCodeFromRDKResponse(tr1Response.Body); rdkErr == nil {
+			for _, code := range c.RDKStatusCodes {
+				if rdkCode == code {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+//conditions returns the validated condition of every configured method, keyed by upper case method name.
+//Methods in defaultRetryMethods that are not configured get their default condition
+func (p RetryPolicyConfig) conditions() (methods map[string]RetryCondition, err error) {
+	if err = p.Default.validate(); err != nil {
+		return
+	}
+
+	methods = make(map[string]RetryCondition, len(p.Methods))
+	for method, condition := range p.Methods {
+		if err = condition.validate(); err != nil {
+			return
+		}
+		methods[strings.ToUpper(method)] = condition
+	}
+
+	for method, condition := range defaultRetryMethods {
+		if _, configured := methods[method]; !configured {
+			methods[method] = condition
+		}
+	}
+	return
+}
+
+//retryStrategy returns the RetryStrategy to use for requests of the given HTTP method
+func (route *ServiceRoute) retryStrategy(method string) RetryStrategy {
+	if strategy, ok := route.MethodRetryStrategies[strings.ToUpper(method)]; ok {
+		return strategy
+	}
+	return route.RetryStrategy
+}
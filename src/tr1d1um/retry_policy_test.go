@@ -0,0 +1,135 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConditionShouldRetry(t *testing.T) {
+	condition := RetryCondition{
+		StatusCodes:    []int{http.StatusBadGateway},
+		Errors:         []string{RetryOnConnectionRefused},
+		RDKStatusCodes: []int{520},
+	}
+
+	t.Run("StatusCode", func(t *testing.T) {
+		assert := assert.New(t)
+		tr1Resp := Tr1d1umResponse{}.New()
+		tr1Resp.Code = http.StatusBadGateway
+		assert.True(condition.ShouldRetry(tr1Resp, nil))
+
+		tr1Resp.Code = http.StatusGatewayTimeout
+		assert.False(condition.ShouldRetry(tr1Resp, nil))
+	})
+
+	t.Run("ErrorClass", func(t *testing.T) {
+		assert := assert.New(t)
+		tr1Resp := Tr1d1umResponse{}.New()
+		assert.True(condition.ShouldRetry(tr1Resp, errors.New("dial tcp 127.0.0.1:80: connect: connection refused")))
+		assert.False(condition.ShouldRetry(tr1Resp, errors.New("lookup target: no such host")))
+	})
+
+	t.Run("RDKStatusCode", func(t *testing.T) {
+		assert := assert.New(t)
+		tr1Resp := Tr1d1umResponse{}.New()
+		tr1Resp.Body = []byte(`{"statusCode": 520}`)
+		assert.True(condition.ShouldRetry(tr1Resp, nil))
+	})
+
+	t.Run("CircuitOpen", func(t *testing.T) {
+		assert := assert.New(t)
+		tr1Resp := Tr1d1umResponse{}.New()
+		tr1Resp.Code = http.StatusBadGateway
+		assert.False(condition.ShouldRetry(tr1Resp, errCircuitOpen))
+	})
+}
+
+func TestRetryPolicyPerMethod(t *testing.T) {
+	assert := assert.New(t)
+	v := viper.New()
+	v.Set(retryPolicyKey, map[string]interface{}{
+		"default": map[string]interface{}{"statusCodes": []int{503, 504}},
+		"methods": map[string]interface{}{"post": map[string]interface{}{}},
+	})
+
+	config, err := defaultServiceConfig(v)
+	assert.Nil(err)
+
+	config.RequestMaxRetries = 1
+	route, err := newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+
+	timeout := Tr1d1umResponse{}.New()
+	timeout.Code = http.StatusGatewayTimeout
+
+	assert.True(route.retryStrategy(http.MethodGet).(*Retry).ShouldRetry(timeout, nil))
+	assert.False(route.retryStrategy(http.MethodPost).(*Retry).ShouldRetry(timeout, nil))
+
+	v.Set(retryPolicyKey, map[string]interface{}{"default": map[string]interface{}{"errors": []string{"cosmicRays"}}})
+	config, _ = defaultServiceConfig(v)
+	_, err = newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.NotNil(err)
+}
+
+func TestRetryPolicyDefaultMethods(t *testing.T) {
+	assert := assert.New(t)
+	v := viper.New()
+	v.Set(retryPolicyKey, map[string]interface{}{
+		"default": map[string]interface{}{"statusCodes": []int{503}},
+		"methods": map[string]interface{}{"put": map[string]interface{}{"statusCodes": []int{503}}},
+	})
+
+	config, err := defaultServiceConfig(v)
+	assert.Nil(err)
+
+	config.RequestMaxRetries = 1
+	route, err := newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+
+	unavailable := Tr1d1umResponse{}.New()
+	unavailable.Code = http.StatusServiceUnavailable
+
+	assert.True(route.retryStrategy(http.MethodGet).(*Retry).ShouldRetry(unavailable, nil))
+	assert.True(route.retryStrategy(http.MethodDelete).(*Retry).ShouldRetry(unavailable, nil))
+	assert.False(route.retryStrategy(http.MethodPost).(*Retry).ShouldRetry(unavailable, nil))
+
+	//a configured method replaces its default
+	assert.True(route.retryStrategy(http.MethodPut).(*Retry).ShouldRetry(unavailable, nil))
+
+	config, err = defaultServiceConfig(viper.New())
+	assert.Nil(err)
+
+	config.RequestMaxRetries = 1
+	route, err = newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+
+	timeout := Tr1d1umResponse{}.New()
+	timeout.Code = Tr1StatusTimeout
+
+	assert.True(route.retryStrategy(http.MethodGet).(*Retry).ShouldRetry(timeout, nil))
+	assert.False(route.retryStrategy(http.MethodPost).(*Retry).ShouldRetry(timeout, nil))
+	assert.False(route.retryStrategy(http.MethodPut).(*Retry).ShouldRetry(timeout, nil))
+}
@@ -0,0 +1,268 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/spf13/viper"
+)
+
+const servicesKey = "services"
+
+//ServiceConfig defines the settings of a single service under the services section of the configuration file.
+//Settings left empty fall back to their global counterparts
+type ServiceConfig struct {
+	TargetURL               string   `json:"targetURL"`
+	WRPSource               string   `json:"WRPSource"`
+	ClientTimeout           string   `json:"clientTimeout"`
+	RespWaitTimeout         string   `json:"respWaitTimeout"`
+	RequestRetryInterval    string   `json:"requestRetryInterval"`
+	RequestRetryBackoff     string   `json:"requestRetryBackoff"`
+	RequestRetryMaxInterval string   `json:"requestRetryMaxInterval"`
+	RequestMaxRetries       int      `json:"requestMaxRetries"`
+	AllowedMethods          []string `json:"allowedMethods"`
+	RedirectCacheTTL        string   `json:"redirectCacheTTL"`
+	MaxRedirects            int      `json:"maxRedirects"`
+
+	RetryPolicy RetryPolicyConfig `json:"retryPolicy"`
+
+	// TargetURLs, if set, replaces TargetURL with a load balanced set of endpoints
+	TargetURLs   []string           `json:"targetURLs"`
+	LoadBalancer LoadBalancerConfig `json:"loadBalancer"`
+
+	// Discovery, if set, keeps the load balanced endpoints up to date
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// TLS configures the client used to reach the target, health checks included
+	TLS TLSConfig `json:"tls"`
+}
+
+//ServiceRoute holds everything the ConversionHandler needs to reach the target behind some service
+type ServiceRoute struct {
+	TargetURL     string
+	WRPRequestURL string
+	Sender        SendAndHandle
+	RetryStrategy
+
+	// Endpoints is set when the target is made of several load balanced endpoints
+	Endpoints *EndpointPool
+
+	// MethodRetryStrategies override RetryStrategy for the HTTP methods the retry policy lists
+	MethodRetryStrategies map[string]RetryStrategy
+
+	allowedMethods map[string]struct{}
+}
+
+//isMethodAllowed returns true if no method restrictions were configured or if the given method is listed
+func (route *ServiceRoute) isMethodAllowed(method string) (allowed bool) {
+	if allowed = len(route.allowedMethods) == 0; !allowed {
+		_, allowed = route.allowedMethods[method]
+	}
+	return
+}
+
+//defaultServiceConfig returns a ServiceConfig populated with the global settings
+func defaultServiceConfig(v *viper.Viper) (config ServiceConfig, err error) {
+	config = ServiceConfig{
+		TargetURL:               v.GetString(targetURLKey),
+		WRPSource:               v.GetString("WRPSource"),
+		ClientTimeout:           v.GetString(clientTimeoutKey),
+		RespWaitTimeout:         v.GetString(respWaitTimeoutKey),
+		RequestRetryInterval:    v.GetString(reqRetryIntervalKey),
+		RequestRetryBackoff:     v.GetString(reqRetryBackoffKey),
+		RequestRetryMaxInterval: v.GetString(reqRetryMaxIntervalKey),
+		RequestMaxRetries:       v.GetInt(reqMaxRetriesKey),
+		RedirectCacheTTL:        v.GetString(redirectCacheTTLKey),
+		MaxRedirects:            v.GetInt(maxRedirectsKey),
+		RetryPolicy:             defaultRetryPolicy(),
+		TargetURLs:              v.GetStringSlice(targetURLsKey),
+		LoadBalancer:            defaultLoadBalancerConfig(),
+		Discovery:               defaultDiscoveryConfig(),
+	}
+
+	if v.IsSet(retryPolicyKey) {
+		config.RetryPolicy = RetryPolicyConfig{}
+		if err = v.UnmarshalKey(retryPolicyKey, &config.RetryPolicy); err != nil {
+			return
+		}
+	}
+
+	if err = v.UnmarshalKey(loadBalancerKey, &config.LoadBalancer); err != nil {
+		return
+	}
+
+	if err = v.UnmarshalKey(discoveryKey, &config.Discovery); err != nil {
+		return
+	}
+
+	err = v.UnmarshalKey(tlsKey, &config.TLS)
+	return
+}
+
+//getServiceConfigs reads the services section of the configuration file. Each entry is merged over the global settings
+func getServiceConfigs(v *viper.Viper) (configs map[string]ServiceConfig, err error) {
+	configs = map[string]ServiceConfig{}
+	if !v.IsSet(servicesKey) {
+		return
+	}
+
+	for service := range v.GetStringMap(servicesKey) {
+		var config ServiceConfig
+		if config, err = defaultServiceConfig(v); err != nil {
+			return
+		}
+
+		serviceKey := servicesKey + "." + service
+		resetConfiguredSlices(v, serviceKey, reflect.ValueOf(&config).Elem())
+
+		if err = v.UnmarshalKey(serviceKey, &config); err != nil {
+			return
+		}
+
+		//a service with its own targetURL does not inherit the global endpoints nor their discovery
+		if v.IsSet(serviceKey+"."+targetURLKey) && !v.IsSet(serviceKey+"."+targetURLsKey) {
+			config.TargetURLs = nil
+		}
+
+		if v.IsSet(serviceKey+"."+targetURLKey) && !v.IsSet(serviceKey+"."+discoveryKey) {
+			config.Discovery.Type = ""
+		}
+		configs[service] = config
+	}
+	return
+}
+
+//resetConfiguredSlices empties the slices of the given struct that are set under key. Decoding a list over
+//a longer one only overwrites the leading elements, so lists configured for a service must start out empty to
+//replace their global counterparts
+func resetConfiguredSlices(v *viper.Viper, key string, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldKey := value.Field(i), key+"."+value.Type().Field(i).Name
+
+		if !field.CanSet() || !v.IsSet(fieldKey) {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Slice:
+			field.Set(reflect.Zero(field.Type()))
+		case reflect.Struct:
+			resetConfiguredSlices(v, fieldKey, field)
+		}
+	}
+}
+
+//newServiceRoute builds the sender and retry strategy described by the given configuration
+func newServiceRoute(config ServiceConfig, dialerTimeout time.Duration, logger log.Logger) (route *ServiceRoute, err error) {
+	clientTimeout, _ := time.ParseDuration(config.ClientTimeout)
+	respTimeout, _ := time.ParseDuration(config.RespWaitTimeout)
+	retryInterval, _ := time.ParseDuration(config.RequestRetryInterval)
+	retryMaxInterval, _ := time.ParseDuration(config.RequestRetryMaxInterval)
+	redirectCacheTTL, _ := time.ParseDuration(config.RedirectCacheTTL)
+
+	methodConditions, err := config.RetryPolicy.conditions()
+	if err != nil {
+		return
+	}
+
+	newRetryStrategy := func(condition RetryCondition) (RetryStrategy, error) {
+		return RetryStrategyFactory{}.NewRetryStrategyWithBackoff(logger, config.RequestRetryBackoff, retryInterval,
+			retryMaxInterval, config.RequestMaxRetries, condition.ShouldRetry, OnRetryInternalFailure, OnRetryTimeout)
+	}
+
+	retryStrategy, err := newRetryStrategy(config.RetryPolicy.Default)
+	if err != nil {
+		return
+	}
+
+	methodRetryStrategies := make(map[string]RetryStrategy, len(methodConditions))
+	for method, condition := range methodConditions {
+		if methodRetryStrategies[method], err = newRetryStrategy(condition); err != nil {
+			return
+		}
+	}
+
+	tlsConfig, err := NewTLSConfig(config.TLS)
+	if err != nil {
+		return
+	}
+
+	discoverer, refreshInterval, err := NewDiscoverer(config.Discovery)
+	if err != nil {
+		return
+	}
+
+	var endpoints *EndpointPool
+
+	if len(config.TargetURLs) > 0 || discoverer != nil {
+		if endpoints, err = NewEndpointPool(config.TargetURLs, config.LoadBalancer, logger); err != nil {
+			return
+		}
+
+		if tlsConfig != nil {
+			endpoints.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+
+		if discoverer != nil {
+			endpoints.Discoverer, endpoints.RefreshInterval = discoverer, refreshInterval
+			endpoints.refresh()
+		}
+
+		//the target is picked per request out of the endpoints so request URLs are relative to it
+		config.TargetURL = ""
+	}
+
+	route = &ServiceRoute{
+		TargetURL:     config.TargetURL,
+		WRPRequestURL: fmt.Sprintf("%s%s/device", config.TargetURL, apiBase),
+
+		Sender: &Tr1SendAndHandle{
+			RespTimeout:  respTimeout,
+			Logger:       logger,
+			Endpoints:    endpoints,
+			Locations:    NewLocationCache(redirectCacheTTL),
+			MaxRedirects: config.MaxRedirects,
+			client: &http.Client{Timeout: clientTimeout,
+				CheckRedirect: noFollowRedirects,
+				Transport: &http.Transport{
+					TLSClientConfig: tlsConfig,
+					Dial: (&net.Dialer{
+						Timeout: dialerTimeout,
+					}).Dial}}},
+
+		RetryStrategy:         retryStrategy,
+		MethodRetryStrategies: methodRetryStrategies,
+		Endpoints:             endpoints,
+	}
+
+	if len(config.AllowedMethods) > 0 {
+		route.allowedMethods = map[string]struct{}{}
+		for _, method := range config.AllowedMethods {
+			route.allowedMethods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,129 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetServiceConfigs(t *testing.T) {
+	assert := assert.New(t)
+	v := viper.New()
+	v.Set(targetURLKey, "http://global.com")
+	v.Set(clientTimeoutKey, "30s")
+	v.Set(targetURLsKey, []string{"http://global-1.com", "http://global-2.com"})
+	v.Set(servicesKey, map[string]interface{}{
+		"iot": map[string]interface{}{
+			"targetURL":      "http://iot.com",
+			"allowedMethods": []string{"post"},
+		},
+	})
+
+	configs, err := getServiceConfigs(v)
+	assert.Nil(err)
+	assert.EqualValues("http://iot.com", configs["iot"].TargetURL)
+	assert.EqualValues("30s", configs["iot"].ClientTimeout)
+	assert.Empty(configs["iot"].TargetURLs)
+
+	route, err := newServiceRoute(configs["iot"], time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+	assert.EqualValues("http://iot.com/api/v2/device", route.WRPRequestURL)
+	assert.True(route.isMethodAllowed(http.MethodPost))
+	assert.False(route.isMethodAllowed(http.MethodGet))
+}
+
+func TestGetServiceConfigsShorterLists(t *testing.T) {
+	assert := assert.New(t)
+	v := viper.New()
+	v.SetConfigType("json")
+	assert.Nil(v.ReadConfig(bytes.NewBufferString(`{
+		"targetURLs": ["http://a.com", "http://b.com", "http://c.com"],
+		"retryPolicy": {"default": {"statusCodes": [503, 504]}},
+		"tls": {"cipherSuites": ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"]},
+		"services": {
+			"config": {
+				"targetURLs": ["http://x.com"],
+				"retryPolicy": {"default": {"statusCodes": [502]}},
+				"tls": {"cipherSuites": ["TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"]}
+			},
+			"iot": {}
+		}
+	}`)))
+
+	configs, err := getServiceConfigs(v)
+	assert.Nil(err)
+
+	assert.EqualValues([]string{"http://x.com"}, configs["config"].TargetURLs)
+	assert.EqualValues([]int{502}, configs["config"].RetryPolicy.Default.StatusCodes)
+	assert.EqualValues([]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, configs["config"].TLS.CipherSuites)
+
+	//lists the service leaves out are still inherited
+	assert.EqualValues([]string{"http://a.com", "http://b.com", "http://c.com"}, configs["iot"].TargetURLs)
+	assert.EqualValues([]int{503, 504}, configs["iot"].RetryPolicy.Default.StatusCodes)
+	assert.Len(configs["iot"].TLS.CipherSuites, 2)
+}
+
+func TestNewServiceRouteInvalidBackoff(t *testing.T) {
+	assert := assert.New(t)
+	config := ServiceConfig{RequestRetryBackoff: "fibonacci", RequestMaxRetries: 1}
+
+	route, err := newServiceRoute(config, time.Second, logging.DefaultLogger())
+	assert.Nil(route)
+	assert.NotNil(err)
+}
+
+func TestServiceRouting(t *testing.T) {
+	t.Run("DefaultRoute", func(t *testing.T) {
+		assert := assert.New(t)
+		ch := &ConversionHandler{TargetURL: "http://default.com", WRPRequestURL: "http://default.com/api/v2/device"}
+
+		route := ch.route("unknown")
+		assert.EqualValues("http://default.com/api/v2/device", route.WRPRequestURL)
+		assert.True(route.isMethodAllowed(http.MethodDelete))
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		assert := assert.New(t)
+		ch := &ConversionHandler{
+			Logger:           logging.DefaultLogger(),
+			RequestValidator: mockRequestValidator,
+			WdmpConvert:      mockConversion,
+			Services: map[string]*ServiceRoute{
+				"config": {allowedMethods: map[string]struct{}{http.MethodGet: {}}},
+			},
+		}
+
+		recorder := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "http://someURL", nil), map[string]string{"service": "config"})
+
+		mockRequestValidator.On("isValidRequest", mock.Anything, mock.Anything, mock.Anything).Return(true).Once()
+
+		ch.ServeHTTP(recorder, req)
+		assert.EqualValues(http.StatusMethodNotAllowed, recorder.Code)
+	})
+}
@@ -0,0 +1,209 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const tlsKey = "tls"
+
+var (
+	errNoCACertificates  = errors.New("no certificates found in the CA bundle")
+	errIncompleteKeyPair = errors.New("both certFile and keyFile are required for a client certificate")
+	errLegacyTLSVersion  = errors.New("TLS versions below 1.2 require allowLegacyVersions")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+//TLSConfig defines the tls section of the configuration file, used by the client that talks to the target service
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the authorities trusted for the target. The system pool is used if empty
+	CAFile string `json:"caFile"`
+
+	// CertFile and KeyFile hold the client certificate presented for mutual TLS. Both are read again once either changes
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// ServerName overrides the host name the target's certificate is verified against
+	ServerName string `json:"serverName"`
+
+	// MinVersion and MaxVersion are one of 1.0, 1.1, 1.2 or 1.3
+	MinVersion   string   `json:"minVersion"`
+	MaxVersion   string   `json:"maxVersion"`
+	CipherSuites []string `json:"cipherSuites"`
+
+	// AllowLegacyVersions lets MinVersion go below 1.2, for targets that cannot be upgraded yet
+	AllowLegacyVersions bool `json:"allowLegacyVersions"`
+}
+
+//IsEmpty returns true if nothing was configured, in which case Go's default TLS settings apply
+func (config TLSConfig) IsEmpty() bool {
+	return config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" && config.ServerName == "" &&
+		config.MinVersion == "" && config.MaxVersion == "" && len(config.CipherSuites) == 0
+}
+
+//NewTLSConfig builds the client tls.Config described by the given configuration. A nil tls.Config is returned
+//if nothing was configured
+func NewTLSConfig(config TLSConfig) (tlsConfig *tls.Config, err error) {
+	if config.IsEmpty() {
+		return
+	}
+
+	tlsConfig = &tls.Config{ServerName: config.ServerName}
+
+	if config.CAFile != "" {
+		var bundle []byte
+		if bundle, err = ioutil.ReadFile(config.CAFile); err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errNoCACertificates
+		}
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, errIncompleteKeyPair
+		}
+
+		reloader := &CertificateReloader{CertFile: config.CertFile, KeyFile: config.KeyFile}
+		if _, err = reloader.Certificate(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	if tlsConfig.MinVersion, err = parseTLSVersion(config.MinVersion); err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.MinVersion != 0 && tlsConfig.MinVersion < tls.VersionTLS12 && !config.AllowLegacyVersions {
+		return nil, errLegacyTLSVersion
+	}
+
+	if tlsConfig.MaxVersion, err = parseTLSVersion(config.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	for _, name := range config.CipherSuites {
+		suite, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+
+	return
+}
+
+//parseTLSVersion returns the tls package constant of the given version. An empty version leaves Go's default in place
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %s", version)
+}
+
+//CertificateReloader serves a client certificate read from disk. The key pair is read again once the
+//modification time of either file changes; a failed reload keeps the last good certificate
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+
+	lock        sync.Mutex
+	certModTime time.Time
+	keyModTime  time.Time
+	certificate *tls.Certificate
+}
+
+//Certificate returns the current key pair, reading it again if the files changed since the last call
+func (r *CertificateReloader) Certificate() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return r.lastGood(err)
+	}
+
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return r.lastGood(err)
+	}
+
+	if r.certificate != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return r.lastGood(err)
+	}
+
+	r.certificate, r.certModTime, r.keyModTime = &certificate, certInfo.ModTime(), keyInfo.ModTime()
+	return r.certificate, nil
+}
+
+//GetClientCertificate plugs the reloader into tls.Config
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate()
+}
+
+//lastGood falls back to the certificate loaded before, if any, when reading the key pair fails
+func (r *CertificateReloader) lastGood(err error) (*tls.Certificate, error) {
+	if r.certificate != nil {
+		return r.certificate, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,207 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+//writeTestKeyPair writes a self-signed certificate for the given name, and its key, as PEM files in dir
+func writeTestKeyPair(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tr1d1um-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestKeyPair(t, dir, "client")
+
+	t.Run("Empty", func(t *testing.T) {
+		tlsConfig, err := NewTLSConfig(TLSConfig{})
+		assert.Nil(t, tlsConfig)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		assert := assert.New(t)
+		tlsConfig, err := NewTLSConfig(TLSConfig{
+			CAFile:       certFile,
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ServerName:   "xmidt",
+			MinVersion:   "1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		})
+
+		assert.Nil(err)
+		assert.NotNil(tlsConfig.RootCAs)
+		assert.NotNil(tlsConfig.GetClientCertificate)
+		assert.EqualValues("xmidt", tlsConfig.ServerName)
+		assert.EqualValues(tls.VersionTLS12, tlsConfig.MinVersion)
+		assert.EqualValues([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tlsConfig.CipherSuites)
+	})
+
+	t.Run("Versions", func(t *testing.T) {
+		assert := assert.New(t)
+
+		tlsConfig, err := NewTLSConfig(TLSConfig{MinVersion: "1.3"})
+		assert.Nil(err)
+		assert.EqualValues(tls.VersionTLS13, tlsConfig.MinVersion)
+
+		tlsConfig, err = NewTLSConfig(TLSConfig{MinVersion: "1.0", AllowLegacyVersions: true})
+		assert.Nil(err)
+		assert.EqualValues(tls.VersionTLS10, tlsConfig.MinVersion)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		assert := assert.New(t)
+
+		_, err := NewTLSConfig(TLSConfig{CAFile: keyFile})
+		assert.EqualValues(errNoCACertificates, err)
+
+		_, err = NewTLSConfig(TLSConfig{CertFile: certFile})
+		assert.EqualValues(errIncompleteKeyPair, err)
+
+		_, err = NewTLSConfig(TLSConfig{MinVersion: "0.9"})
+		assert.NotNil(err)
+
+		_, err = NewTLSConfig(TLSConfig{MinVersion: "1.1"})
+		assert.EqualValues(errLegacyTLSVersion, err)
+
+		_, err = NewTLSConfig(TLSConfig{CipherSuites: []string{"TLS_NULL"}})
+		assert.NotNil(err)
+	})
+}
+
+func TestCertificateReloader(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "tr1d1um-tls")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestKeyPair(t, dir, "client")
+	reloader := &CertificateReloader{CertFile: certFile, KeyFile: keyFile}
+
+	first, err := reloader.Certificate()
+	assert.Nil(err)
+
+	same, err := reloader.Certificate()
+	assert.Nil(err)
+	assert.True(first == same)
+
+	//rotate the key pair and make sure the change is noticed regardless of the file system's time resolution
+	writeTestKeyPair(t, dir, "client")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	rotated, err := reloader.Certificate()
+	assert.Nil(err)
+	assert.NotEqual(first.Certificate[0], rotated.Certificate[0])
+
+	//a broken rotation keeps the last good certificate
+	assert.Nil(ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+
+	kept, err := reloader.Certificate()
+	assert.Nil(err)
+	assert.True(rotated == kept)
+}
+
+func TestServiceRouteMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "tr1d1um-tls")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := writeTestKeyPair(t, dir, "xmidt")
+	clientCert, clientKey := writeTestKeyPair(t, dir, "tr1d1um")
+
+	clientCA, err := ioutil.ReadFile(clientCert)
+	assert.Nil(err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCA)
+
+	serverPair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	assert.Nil(err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.EqualValues("tr1d1um", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverPair}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	route, err := newServiceRoute(ServiceConfig{
+		TargetURL:       server.URL,
+		ClientTimeout:   "5s",
+		RespWaitTimeout: "5s",
+		RetryPolicy:     defaultRetryPolicy(),
+		TLS:             TLSConfig{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey, ServerName: "xmidt"},
+	}, time.Second, logging.DefaultLogger())
+	assert.Nil(err)
+
+	resp, err := route.Sender.MakeRequest(context.Background(), Tr1d1umRequest{method: http.MethodGet, URL: route.WRPRequestURL})
+	assert.Nil(err)
+	assert.EqualValues(http.StatusOK, resp.(*Tr1d1umResponse).Code)
+}
@@ -21,12 +21,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/Comcast/webpa-common/concurrent"
@@ -51,20 +51,32 @@ import (
 const (
 	applicationName, apiBase = "tr1d1um", "/api/v2"
 
-	DefaultKeyID            = "current"
-	defaultClientTimeout    = "30s"
-	defaultRespWaitTimeout  = "40s"
-	defaultNetDialerTimeout = "5s"
-	defaultRetryInterval    = "2s"
-	defaultMaxRetries       = 2
-
-	supportedServicesKey = "supportedServices"
-	targetURLKey         = "targetURL"
-	netDialerTimeoutKey  = "netDialerTimeout"
-	clientTimeoutKey     = "clientTimeout"
-	reqRetryIntervalKey  = "requestRetryInterval"
-	reqMaxRetriesKey     = "requestMaxRetries"
-	respWaitTimeoutKey   = "respWaitTimeout"
+	DefaultKeyID             = "current"
+	defaultClientTimeout     = "30s"
+	defaultRespWaitTimeout   = "40s"
+	defaultNetDialerTimeout  = "5s"
+	defaultRetryInterval     = "2s"
+	defaultRetryBackoff      = BackoffConstant
+	defaultRetryMaxInterval  = "30s"
+	defaultMaxRetries        = 2
+	defaultUndoTTL           = "1h"
+	defaultIdempotencyWindow = "24h"
+	defaultIdempotencySize   = 10000
+	defaultRedirectCacheTTL  = "5m"
+	defaultMaxRedirects      = 3
+
+	supportedServicesKey   = "supportedServices"
+	targetURLKey           = "targetURL"
+	netDialerTimeoutKey    = "netDialerTimeout"
+	clientTimeoutKey       = "clientTimeout"
+	reqRetryIntervalKey    = "requestRetryInterval"
+	reqRetryBackoffKey     = "requestRetryBackoff"
+	reqRetryMaxIntervalKey = "requestRetryMaxInterval"
+	reqMaxRetriesKey       = "requestMaxRetries"
+	respWaitTimeoutKey     = "respWaitTimeout"
+	undoTTLKey             = "undoTTL"
+	idempotencyWindowKey   = "idempotencyWindow"
+	idempotencySizeKey     = "idempotencySize"
 )
 
 func tr1d1um(arguments []string) (exitCode int) {
@@ -72,15 +84,22 @@ func tr1d1um(arguments []string) (exitCode int) {
 	var (
 		f                                   = pflag.NewFlagSet(applicationName, pflag.ContinueOnError)
 		v                                   = viper.New()
-		logger, metricsRegistry, webPA, err = server.Initialize(applicationName, arguments, f, v, webhook.Metrics, aws.Metrics, secure.Metrics)
+		logger, metricsRegistry, webPA, err = server.Initialize(applicationName, arguments, f, v, webhook.Metrics, aws.Metrics, secure.Metrics, Metrics)
 	)
 
 	// set config file value defaults
 	v.SetDefault(clientTimeoutKey, defaultClientTimeout)
 	v.SetDefault(respWaitTimeoutKey, defaultRespWaitTimeout)
 	v.SetDefault(reqRetryIntervalKey, defaultRetryInterval)
+	v.SetDefault(reqRetryBackoffKey, defaultRetryBackoff)
+	v.SetDefault(reqRetryMaxIntervalKey, defaultRetryMaxInterval)
 	v.SetDefault(reqMaxRetriesKey, defaultMaxRetries)
 	v.SetDefault(netDialerTimeoutKey, defaultNetDialerTimeout)
+	v.SetDefault(undoTTLKey, defaultUndoTTL)
+	v.SetDefault(idempotencyWindowKey, defaultIdempotencyWindow)
+	v.SetDefault(idempotencySizeKey, defaultIdempotencySize)
+	v.SetDefault(redirectCacheTTLKey, defaultRedirectCacheTTL)
+	v.SetDefault(maxRedirectsKey, defaultMaxRedirects)
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to initialize viper: %s\n", err.Error())
@@ -106,19 +125,83 @@ func tr1d1um(arguments []string) (exitCode int) {
 		return 1
 	}
 
-	conversionHandler := SetUpHandler(v, logger)
+	conversionHandler, err := SetUpHandler(v, logger, metricsRegistry)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up conversion handler: %s\n", err.Error())
+		return 1
+	}
+
+	usageTracker, err := SetUpUsageTracker(v, logger)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up usage tracker: %s\n", err.Error())
+		return 1
+	}
+
+	tracer, err := SetUpTracer(v, logger)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up tracing: %s\n", err.Error())
+		return 1
+	}
+
+	accessLogger, err := SetUpAccessLogger(v, logger)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up access log: %s\n", err.Error())
+		return 1
+	}
+
+	preHandler = decoratePreHandler(preHandler, usageTracker, tracer, accessLogger)
 
 	r := mux.NewRouter()
 	baseRouter := r.PathPrefix(apiBase).Subrouter()
 
 	AddRoutes(baseRouter, preHandler, conversionHandler)
 
-	var snsFactory *webhook.Factory
+	if usageTracker != nil {
+		baseRouter.Handle("/usage", preHandler.ThenFunc(usageTracker.HandleUsage)).
+			Methods(http.MethodGet)
+	}
+
+	var dispatcher *HookDispatcher
+
+	if v.IsSet(webhookDispatcherKey) {
+		if dispatcher, err = NewHookDispatcher(v, logger); err != nil {
+			fmt.Fprintf(os.Stderr, "error setting up webhook dispatcher: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	if v.IsSet(eventStreamKey) || dispatcher != nil {
+		if err = ConfigureEventStream(baseRouter, preHandler, v, logger, conversionHandler.Resolver, dispatcher); err != nil {
+			fmt.Fprintf(os.Stderr, "error setting up event stream: %s\n", err.Error())
+			return 1
+		}
+	}
+
+	var (
+		snsFactory       *webhook.Factory
+		hookRegistry     *HookRegistry
+		hookSyncInterval time.Duration
+	)
 
 	if accessKey := v.GetString("aws.accessKey"); accessKey != "" && accessKey != "fake-accessKey" { //only proceed if sure that value was set and not the default one
 		if snsFactory, exitCode = ConfigureWebHooks(baseRouter, r, preHandler, v, logger, metricsRegistry); exitCode != 0 {
 			return
 		}
+	} else if hookRegistry, hookSyncInterval, exitCode = ConfigureLocalWebHooks(baseRouter, preHandler, v, logger); exitCode != 0 {
+		return
+	}
+
+	if dispatcher != nil {
+		if snsFactory != nil {
+			snsFactory.SetExternalUpdate(dispatcher.Update)
+		} else {
+			hookRegistry.OnUpdate = dispatcher.Update
+			dispatcher.Update(hookRegistry.Hooks())
+		}
 	}
 
 	var (
@@ -140,11 +223,40 @@ func tr1d1um(arguments []string) (exitCode int) {
 		return 4
 	}
 
+	if hookRegistry != nil && len(hookRegistry.Peers) > 0 {
+		go hookRegistry.Sync(hookSyncInterval, shutdown)
+	}
+
+	//usage and spans are flushed one last time on shutdown, which has to complete before exiting
+	var flushers sync.WaitGroup
+
+	if usageTracker != nil {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			usageTracker.Persist(shutdown)
+		}()
+	}
+
+	if tracer != nil {
+		flushers.Add(1)
+		go func() {
+			defer flushers.Done()
+			tracer.Run(shutdown)
+		}()
+	}
+
+	for _, pool := range conversionHandler.endpointPools() {
+		go pool.HealthCheck(shutdown)
+		go pool.Refresh(shutdown)
+	}
+
 	signal.Notify(signals)
 	s := server.SignalWait(infoLogger, signals, os.Kill, os.Interrupt)
 	errorLogger.Log(logging.MessageKey(), "exiting due to signal", "signal", s)
 	close(shutdown)
 	waitGroup.Wait()
+	flushers.Wait()
 
 	return 0
 }
@@ -202,46 +314,135 @@ func AddRoutes(r *mux.Router, preHandler *alice.Chain, conversionHandler *Conver
 	r.Handle("/device/{deviceid}/{service}/{parameter}", preHandler.Then(conversionHandler)).
 		Methods(http.MethodDelete)
 
-	r.Handle("/device/{deviceid}/{service:iot}", preHandler.ThenFunc(conversionHandler.HandleIOT)).
-		Methods(http.MethodPost) //TODO: path is temporary. Should be deleted once endpoint is not needed in tr1d1um
-
 	r.Handle("/device/{deviceid}/{service}/{parameter}", preHandler.Then(conversionHandler)).
 		Methods(http.MethodPut, http.MethodPost).MatcherFunc(BodyNonEmpty)
+
+	r.Handle("/wrp/device/{deviceid}/{service}", preHandler.ThenFunc(conversionHandler.HandleWRP)).
+		Methods(http.MethodPost)
+
+	if conversionHandler.UndoStore != nil {
+		r.Handle("/transactions/{tid}/undo", preHandler.ThenFunc(conversionHandler.HandleUndo)).
+			Methods(http.MethodPost)
+	}
+
+	if len(conversionHandler.Breakers) > 0 {
+		r.Handle("/admin/breakers", preHandler.ThenFunc(conversionHandler.HandleCircuitBreakers)).
+			Methods(http.MethodGet)
+	}
 }
 
 //SetUpHandler prepares the main handler under TR1D1UM which is the ConversionHandler
-func SetUpHandler(v *viper.Viper, logger log.Logger) (cHandler *ConversionHandler) {
-	clientTimeout, _ := time.ParseDuration(v.GetString(clientTimeoutKey))
-	respTimeout, _ := time.ParseDuration(v.GetString(respWaitTimeoutKey))
-	retryInterval, _ := time.ParseDuration(v.GetString(reqRetryIntervalKey))
+func SetUpHandler(v *viper.Viper, logger log.Logger, registry xmetrics.Registry) (cHandler *ConversionHandler, err error) {
 	dialerTimeout, _ := time.ParseDuration(v.GetString(netDialerTimeoutKey))
-	maxRetries := v.GetInt(reqMaxRetriesKey)
+	undoTTL, _ := time.ParseDuration(v.GetString(undoTTLKey))
+	idempotencyWindow, _ := time.ParseDuration(v.GetString(idempotencyWindowKey))
+
+	resolver, err := NewDeviceResolver(v, logger)
+
+	if err != nil {
+		return
+	}
+
+	serviceConfigs, err := getServiceConfigs(v)
+
+	if err != nil {
+		return
+	}
+
+	defaultConfig, err := defaultServiceConfig(v)
+
+	if err != nil {
+		return
+	}
+
+	defaultRoute, err := newServiceRoute(defaultConfig, dialerTimeout, logger)
+
+	if err != nil {
+		return
+	}
+
+	var (
+		supportedServices = getSupportedServicesMap(v.GetStringSlice(supportedServicesKey))
+		services          = make(map[string]*ServiceRoute, len(serviceConfigs))
+		serviceSources    = make(map[string]string, len(serviceConfigs))
+	)
+
+	for service, serviceConfig := range serviceConfigs {
+		supportedServices[service] = struct{}{}
+		if services[service], err = newServiceRoute(serviceConfig, dialerTimeout, logger); err != nil {
+			return
+		}
+		serviceSources[service] = serviceConfig.WRPSource
+	}
+
+	measures := NewRequestMeasures(registry)
+	measures.instrumentRoute(defaultBreakerName, defaultRoute)
+	for service, route := range services {
+		measures.instrumentRoute(service, route)
+	}
+
+	var breakers map[string]*CircuitBreaker
+
+	if v.IsSet(circuitBreakerKey) {
+		routes := map[string]*ServiceRoute{defaultBreakerName: defaultRoute}
+		for service, route := range services {
+			routes[service] = route
+		}
+
+		if breakers, err = addCircuitBreakers(v, routes, registry, logger); err != nil {
+			return
+		}
+	}
+
+	var deviceGuard *DeviceGuard
+
+	if v.IsSet(deviceGuardKey) {
+		guardConfig := defaultDeviceGuardConfig()
+		if err = v.UnmarshalKey(deviceGuardKey, &guardConfig); err != nil {
+			return
+		}
+
+		if deviceGuard, err = NewDeviceGuard(guardConfig); err != nil {
+			return
+		}
+	}
 
 	cHandler = &ConversionHandler{
 		WdmpConvert: &ConversionWDMP{
-			WRPSource: v.GetString("WRPSource")},
+			WRPSource:      v.GetString("WRPSource"),
+			ServiceSources: serviceSources},
+
+		Sender: defaultRoute.Sender,
+
+		Endpoints: defaultRoute.Endpoints,
 
-		Sender: &Tr1SendAndHandle{
-			RespTimeout: respTimeout,
-			Logger:      logger,
-			client: &http.Client{Timeout: clientTimeout,
-				Transport: &http.Transport{
-					Dial: (&net.Dialer{
-						Timeout: dialerTimeout,
-					}).Dial}}},
+		Services: services,
+
+		Resolver: resolver,
+
+		UndoStore: NewMemoryUndoStore(undoTTL),
+
+		IdempotencyStore: NewMemoryIdempotencyStore(idempotencyWindow, v.GetInt(idempotencySizeKey)),
+
+		Breakers: breakers,
+
+		EncodeFailures: measures.WRPEncodeFailures,
+
+		DeviceGuard: deviceGuard,
 
 		Logger: logger,
 
 		RequestValidator: &TR1RequestValidator{
-			supportedServices: getSupportedServicesMap(v.GetStringSlice(supportedServicesKey)),
+			supportedServices: supportedServices,
+			Resolver:          resolver,
 			Logger:            logger,
 		},
 
-		RetryStrategy: RetryStrategyFactory{}.NewRetryStrategy(logger, retryInterval, maxRetries,
-			ShouldRetryOnResponse, OnRetryInternalFailure),
-		WRPRequestURL: fmt.Sprintf("%s%s/device", v.GetString(targetURLKey), apiBase),
+		RetryStrategy:         defaultRoute.RetryStrategy,
+		MethodRetryStrategies: defaultRoute.MethodRetryStrategies,
+		WRPRequestURL:         defaultRoute.WRPRequestURL,
 
-		TargetURL: v.GetString(targetURLKey),
+		TargetURL: defaultRoute.TargetURL,
 	}
 
 	return
@@ -262,12 +463,118 @@ func SetUpPreHandler(v *viper.Viper, logger log.Logger, registry xmetrics.Regist
 
 		authHandler.DefineMeasures(m)
 
-		newPreHandler := alice.New(authHandler.Decorate)
+		measures := NewRequestMeasures(registry)
+		measures.Services = getSupportedServicesMap(v.GetStringSlice(supportedServicesKey))
+		for service := range v.GetStringMap(servicesKey) {
+			measures.Services[service] = struct{}{}
+		}
+
+		newPreHandler := alice.New(measures.Decorate, authHandler.Decorate)
+
+		if v.IsSet(clientCertAuthKey) {
+			var certHandler ClientCertHandler
+			if certHandler, err = getClientCertHandler(v, logger); err != nil {
+				return
+			}
+
+			certHandler.Fallback = authHandler.Decorate
+			newPreHandler = alice.New(measures.Decorate, certHandler.Decorate)
+		}
+
+		if v.IsSet(rateLimitKey) {
+			var config RateLimitConfig
+			if err = v.UnmarshalKey(rateLimitKey, &config); err != nil {
+				return
+			}
+
+			var limiter *RateLimiter
+			if limiter, err = NewRateLimiter(config, logger); err != nil {
+				return
+			}
+
+			newPreHandler = newPreHandler.Append(limiter.Decorate)
+		}
+
 		preHandler = &newPreHandler
 	}
 	return
 }
 
+//decoratePreHandler adds usage accounting after authorization, and tracing and the access log ahead of everything,
+//to the given chain. Any of them may be nil
+func decoratePreHandler(preHandler *alice.Chain, usageTracker *UsageTracker, tracer *Tracer, accessLogger *AccessLogger) *alice.Chain {
+	decorated := *preHandler
+
+	if usageTracker != nil {
+		decorated = decorated.Append(usageTracker.Decorate)
+	}
+
+	if tracer != nil {
+		decorated = alice.New(tracer.Decorate).Extend(decorated)
+	}
+
+	if accessLogger != nil {
+		decorated = alice.New(accessLogger.Decorate).Extend(decorated)
+	}
+	return &decorated
+}
+
+//SetUpUsageTracker prepares the accounting and quotas of tenant usage. A nil UsageTracker is returned if the
+//usage section is not configured
+func SetUpUsageTracker(v *viper.Viper, logger log.Logger) (tracker *UsageTracker, err error) {
+	if !v.IsSet(usageKey) {
+		return
+	}
+
+	config := defaultUsageConfig()
+	if err = v.UnmarshalKey(usageKey, &config); err != nil {
+		return
+	}
+
+	return NewUsageTracker(config, logger)
+}
+
+//SetUpTracer prepares the tracing of requests. A nil Tracer is returned if the tracing section is not configured
+func SetUpTracer(v *viper.Viper, logger log.Logger) (tracer *Tracer, err error) {
+	if !v.IsSet(tracingKey) {
+		return
+	}
+
+	config := defaultTracingConfig()
+	if err = v.UnmarshalKey(tracingKey, &config); err != nil {
+		return
+	}
+
+	return NewTracer(config, logger)
+}
+
+//SetUpAccessLogger prepares the access log. A nil AccessLogger is returned if the accessLog section is not
+//configured, in which case requests are logged by bookkeepingLog alone
+func SetUpAccessLogger(v *viper.Viper, logger log.Logger) (accessLogger *AccessLogger, err error) {
+	if !v.IsSet(accessLogKey) {
+		return
+	}
+
+	config := defaultAccessLogConfig()
+	if err = v.UnmarshalKey(accessLogKey, &config); err != nil {
+		return
+	}
+
+	return NewAccessLogger(config, logger)
+}
+
+//getClientCertHandler returns the handler that authenticates requests by their client certificate
+func getClientCertHandler(v *viper.Viper, logger log.Logger) (certHandler ClientCertHandler, err error) {
+	var config ClientCertAuthConfig
+	if err = v.UnmarshalKey(clientCertAuthKey, &config); err != nil {
+		return
+	}
+
+	certHandler.Logger = logger
+	certHandler.Validator, err = NewClientCertValidator(config)
+	return
+}
+
 //getValidator returns a validator for JWT/Basic tokens
 //It reads in tokens from a config file. Zero or more tokens
 //can be read.
@@ -19,7 +19,8 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
 
@@ -45,6 +46,15 @@ type Tr1d1umResponse struct {
 	Code    int
 	Headers http.Header
 	err     error
+
+	//source tells what produced Code: tr1d1um itself (empty), the target or the device
+	source string
+
+	//contentType is the content type the device gave the payload of its WRP response, if any
+	contentType string
+
+	//problem is set when Body holds the problem details of a failure
+	problem *Problem
 }
 
 //New helps initialize values that avoid nil exceptions and keeps
@@ -55,38 +65,59 @@ func (tr1Resp Tr1d1umResponse) New() *Tr1d1umResponse {
 }
 
 //WriteResponse is a tiny helper function that passes responses (In Json format only for now)
-//to a caller
+//to a caller. Failures are written as problem details with the generic code of their status
 func WriteResponse(message string, statusCode int, tr1Resp *Tr1d1umResponse) {
-	tr1Resp.Headers.Set("Content-Type", wrp.JSON.ContentType())
+	if statusCode >= http.StatusBadRequest {
+		WriteProblem(statusProblem(statusCode), statusCode, message, tr1Resp)
+		return
+	}
+
+	tr1Resp.Headers.Set(contentTypeKey, wrp.JSON.ContentType())
 	tr1Resp.Code = statusCode
-	tr1Resp.Body = []byte(fmt.Sprintf(`{"message":"%s"}`, message))
+	tr1Resp.Body = encodeMessage(message)
 }
 
 //WriteResponseWriter is a tiny helper function that passes responses (In Json format only for now)
-//to a caller through a ResponseWriter
+//to a caller through a ResponseWriter. Failures are written as problem details with the generic code of their status
 func WriteResponseWriter(message string, statusCode int, origin http.ResponseWriter) {
-	origin.Header().Set("Content-Type", wrp.JSON.ContentType())
+	if statusCode >= http.StatusBadRequest {
+		WriteProblemWriter(statusProblem(statusCode), statusCode, message, origin)
+		return
+	}
+
+	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
 	origin.WriteHeader(statusCode)
-	origin.Write([]byte(fmt.Sprintf(`{"message":"%s"}`, message)))
+	origin.Write(encodeMessage(message))
+}
+
+//encodeMessage returns the json body carrying the given message
+func encodeMessage(message string) []byte {
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{message})
+	return body
 }
 
 //ReportError checks (given that the given error is not nil) if the error is related to a timeout. If it is, it marks it as so.
-//Else, it defaults to an InternalError
+//Failures to reach the target, or to hear back from it, are reported as such. Else, it defaults to an InternalError
 func ReportError(err error, tr1Resp *Tr1d1umResponse) {
 	if err == nil {
 		return
 	}
-	message, statusCode := "", http.StatusInternalServerError
 
 	if errMsg := err.Error(); strings.HasSuffix(errMsg, "context canceled") ||
 		strings.HasSuffix(errMsg, "deadline exceeded") ||
 		strings.Contains(errMsg, "Client.Timeout exceeded") {
-		message, statusCode = "Error Timeout", Tr1StatusTimeout
+		WriteProblem(ProblemDeviceTimeout, Tr1StatusTimeout, "Error Timeout", tr1Resp)
+		return
 	}
 
-	WriteResponse(message, statusCode, tr1Resp)
+	if _, isNetError := err.(net.Error); isNetError || err == io.ErrUnexpectedEOF {
+		WriteProblem(ProblemTargetUnavailable, http.StatusBadGateway, "", tr1Resp)
+		return
+	}
 
-	return
+	WriteProblem(ProblemInternalError, http.StatusInternalServerError, "", tr1Resp)
 }
 
 //GetStatusCodeFromRDKResponse returns the status code given a well-formatted
@@ -19,7 +19,10 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,7 +47,23 @@ func TestReportError(t *testing.T) {
 		ReportError(errors.New("internal"), origin)
 
 		assert.EqualValues(http.StatusInternalServerError, origin.Code)
-		assert.EqualValues(`{"message":""}`, string(origin.Body))
+		assert.EqualValues(`{"type":"urn:tr1d1um:problem:internal_error","title":"Internal Server Error","status":500,"code":"internal_error"}`, string(origin.Body))
+		assert.EqualValues(problemContentType, origin.Headers.Get(contentTypeKey))
+	})
+
+	t.Run("TransportErr", func(t *testing.T) {
+		assert := assert.New(t)
+		transportErrors := []error{
+			&url.Error{Op: "Post", URL: "http://target", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			io.ErrUnexpectedEOF,
+		}
+
+		for _, transportError := range transportErrors {
+			origin := Tr1d1umResponse{}.New()
+			ReportError(transportError, origin)
+			assert.EqualValues(http.StatusBadGateway, origin.Code)
+			assert.EqualValues(`{"type":"urn:tr1d1um:problem:target_unavailable","title":"Target unavailable","status":502,"code":"target_unavailable"}`, string(origin.Body))
+		}
 	})
 
 	t.Run("TimeoutErr", func(t *testing.T) {
@@ -55,7 +74,7 @@ func TestReportError(t *testing.T) {
 			origin := Tr1d1umResponse{}.New()
 			ReportError(timeoutError, origin)
 			assert.EqualValues(Tr1StatusTimeout, origin.Code)
-			assert.EqualValues(`{"message":"Error Timeout"}`, string(origin.Body))
+			assert.EqualValues(`{"type":"urn:tr1d1um:problem:device_timeout","title":"Device timeout","status":503,"detail":"Error Timeout","code":"device_timeout"}`, string(origin.Body))
 		}
 	})
 
@@ -18,13 +18,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/Comcast/webpa-common/xmetrics"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/spf13/viper"
@@ -33,6 +42,7 @@ import (
 
 func TestSetUpHandler(t *testing.T) {
 	logger := logging.DefaultLogger()
+	registry, _ := xmetrics.NewRegistry(nil, Metrics)
 
 	t.Run("CompleteConfigSetUp", func(t *testing.T) {
 		assert := assert.New(t)
@@ -40,8 +50,9 @@ func TestSetUpHandler(t *testing.T) {
 		v.Set("targetURL", "https://someCoolURL.com")
 		v.SetDefault("clientTimeout", defaultClientTimeout)
 		v.SetDefault("respWaitTimeout", defaultRespWaitTimeout)
-		actualHandler := SetUpHandler(v, logger)
+		actualHandler, err := SetUpHandler(v, logger, registry)
 
+		assert.Nil(err)
 		AssertCommon(actualHandler, assert)
 	})
 
@@ -50,10 +61,26 @@ func TestSetUpHandler(t *testing.T) {
 		v := viper.New()
 		v.Set("targetURL", "https://someCoolURL.com")
 
-		actualHandler := SetUpHandler(v, logger)
+		actualHandler, err := SetUpHandler(v, logger, registry)
 
+		assert.Nil(err)
 		AssertCommon(actualHandler, assert)
 	})
+
+	t.Run("CircuitBreakers", func(t *testing.T) {
+		assert := assert.New(t)
+		v := viper.New()
+		v.Set("targetURL", "https://someCoolURL.com")
+		v.Set(circuitBreakerKey, map[string]interface{}{"minRequests": 5})
+		v.Set(servicesKey, map[string]interface{}{"iot": map[string]interface{}{}})
+
+		actualHandler, err := SetUpHandler(v, logger, registry)
+
+		assert.Nil(err)
+		assert.Len(actualHandler.Breakers, 2)
+		assert.IsType(&BreakerSendAndHandle{}, actualHandler.Sender)
+		assert.IsType(&BreakerSendAndHandle{}, actualHandler.Services["iot"].Sender)
+	})
 }
 func TestRouteConfigurations(t *testing.T) {
 	r := mux.NewRouter()
@@ -150,3 +177,81 @@ type RouteTestBundle struct {
 	req     *http.Request
 	passing bool
 }
+
+func TestEventStreamThroughPreHandler(t *testing.T) {
+	assert := assert.New(t)
+	logger := logging.DefaultLogger()
+	registry, _ := xmetrics.NewRegistry(nil, Metrics)
+
+	dir, err := ioutil.TempDir("", "stream")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	v.SetConfigType("json")
+	assert.Nil(v.ReadConfig(bytes.NewBufferString(fmt.Sprintf(`{
+		"authHeader": ["Basic dXNlcjpwYXNz"],
+		"usage": {"flushInterval": "1m"},
+		"tracing": {"exporter": "file", "file": %q},
+		"accessLog": {"fields": ["tid"]},
+		"eventStream": {"ingestSecret": "secret"}
+	}`, filepath.Join(dir, "spans.json")))))
+
+	preHandler, err := SetUpPreHandler(v, logger, registry)
+	assert.Nil(err)
+	usageTracker, err := SetUpUsageTracker(v, logger)
+	assert.Nil(err)
+	tracer, err := SetUpTracer(v, logger)
+	assert.Nil(err)
+	accessLogger, err := SetUpAccessLogger(v, logger)
+	assert.Nil(err)
+
+	r := mux.NewRouter()
+	baseRouter := r.PathPrefix(apiBase).Subrouter()
+	assert.Nil(ConfigureEventStream(baseRouter, decoratePreHandler(preHandler, usageTracker, tracer, accessLogger), v, logger, nil, nil))
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+apiBase+"/events/stream?event=online", nil)
+	req.SetBasicAuth("user", "pass")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	assert.Nil(err)
+	defer resp.Body.Close()
+
+	assert.EqualValues(http.StatusOK, resp.StatusCode)
+	assert.EqualValues(eventStreamContentType, resp.Header.Get(contentTypeKey))
+
+	var event bytes.Buffer
+	wrp.NewEncoder(&event, wrp.JSON).Encode(&wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566",
+		Destination: "event:device-status/mac:112233445566/online",
+	})
+
+	ingest, _ := http.NewRequest(http.MethodPost, server.URL+apiBase+"/events/ingest", bytes.NewReader(event.Bytes()))
+	ingest.Header.Set(HeaderWebhookSignature, signIngest("sha1", "secret", event.Bytes()))
+
+	ingested, err := client.Do(ingest)
+	assert.Nil(err)
+	ingested.Body.Close()
+	assert.EqualValues(http.StatusAccepted, ingested.StatusCode)
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.Nil(err) {
+			return
+		}
+
+		if strings.HasPrefix(line, "event: ") {
+			assert.EqualValues("event: device-status/mac:112233445566/online\n", line)
+			return
+		}
+	}
+}
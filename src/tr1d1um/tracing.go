@@ -0,0 +1,516 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	tracingKey = "tracing"
+
+	//W3C trace context headers
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+
+	defaultTraceFlushInterval = "5s"
+	defaultTraceBatchSize     = 512
+	defaultTraceServiceName   = applicationName
+)
+
+//Kinds of spans, numbered as in OTLP
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+var (
+	errUnknownTraceExporter          = errors.New("unknown trace exporter")
+	errNonPositiveTraceFlushInterval = errors.New("tracing: flushInterval must be positive")
+	errMissingTraceEndpoint          = errors.New("tracing: the otlp exporter requires an endpoint")
+	errMissingTraceFile              = errors.New("tracing: the file exporter requires a file")
+)
+
+//TraceContext identifies a span across process boundaries, as carried by the traceparent and tracestate headers
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	State   string
+}
+
+//ParseTraceparent reads a version 00 traceparent header value. Invalid values are reported as not found
+func ParseTraceparent(value string) (tc TraceContext, found bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+
+	copy(tc.TraceID[:], traceID)
+	copy(tc.SpanID[:], spanID)
+
+	if tc.TraceID == [16]byte{} || tc.SpanID == [8]byte{} {
+		return TraceContext{}, false
+	}
+
+	tc.Sampled = flags&1 == 1
+	return tc, true
+}
+
+//Traceparent returns the traceparent header value of the trace context
+func (tc TraceContext) Traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(tc.TraceID[:]), hex.EncodeToString(tc.SpanID[:]), flags)
+}
+
+//Span is a timed operation within a trace. A nil Span is valid and records nothing
+type Span struct {
+	Name       string
+	Kind       int
+	Context    TraceContext
+	ParentID   [8]byte
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        string
+
+	tracer *Tracer
+	lock   sync.Mutex
+}
+
+//SetAttribute records some detail about the operation
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Attributes[key] = value
+}
+
+//SetError marks the operation as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Err = err.Error()
+}
+
+//Finish ends the span and hands it to the exporter if the trace is sampled
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.End = s.tracer.now()
+	s.lock.Unlock()
+
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+type spanKey struct{}
+
+//SpanFromContext returns the span the given context is within, if any
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+//StartSpan starts a child of the span the given context is within. Nothing is traced, and a nil Span is returned,
+//if the context is not within a span
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.newSpan(name, kind, parent.Context)
+	span.ParentID = parent.Context.SpanID
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+//InjectTraceContext sets the trace context headers of the span the given context is within, if any
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set(HeaderTraceparent, span.Context.Traceparent())
+		if span.Context.State != "" {
+			header.Set(HeaderTracestate, span.Context.State)
+		}
+	}
+}
+
+//traceHeaders returns the trace context of the span the given context is within as WRP headers
+func traceHeaders(ctx context.Context) (headers []string) {
+	if span := SpanFromContext(ctx); span != nil {
+		headers = append(headers, HeaderTraceparent+": "+span.Context.Traceparent())
+		if span.Context.State != "" {
+			headers = append(headers, HeaderTracestate+": "+span.Context.State)
+		}
+	}
+	return
+}
+
+//SpanExporter ships finished spans to some tracing backend
+type SpanExporter interface {
+	Export([]*Span) error
+}
+
+//TracingConfig defines the tracing section of the configuration file
+type TracingConfig struct {
+	// Exporter is either otlp, which posts OTLP/HTTP JSON to Endpoint, or file, which appends JSON lines to File
+	Exporter string `json:"exporter"`
+	Endpoint string `json:"endpoint"`
+	File     string `json:"file"`
+
+	ServiceName   string `json:"serviceName"`
+	FlushInterval string `json:"flushInterval"`
+	BatchSize     int    `json:"batchSize"`
+
+	// SampleRatio is the fraction of the traces started by tr1d1um that are sampled. Incoming traces keep
+	// the sampling decision of the caller
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+//defaultTracingConfig returns the settings used for anything the tracing section leaves out
+func defaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		ServiceName:   defaultTraceServiceName,
+		FlushInterval: defaultTraceFlushInterval,
+		BatchSize:     defaultTraceBatchSize,
+		SampleRatio:   1,
+	}
+}
+
+//Tracer starts the spans of the requests tr1d1um handles and exports them in batches
+type Tracer struct {
+	Exporter      SpanExporter
+	SampleRatio   float64
+	FlushInterval time.Duration
+	log.Logger
+
+	spans chan *Span
+	now   func() time.Time
+}
+
+//NewTracer builds the Tracer described by the given configuration
+func NewTracer(config TracingConfig, logger log.Logger) (tracer *Tracer, err error) {
+	if config.BatchSize < 1 {
+		config.BatchSize = defaultTraceBatchSize
+	}
+
+	tracer = &Tracer{
+		SampleRatio: config.SampleRatio,
+		Logger:      logger,
+		spans:       make(chan *Span, config.BatchSize),
+		now:         time.Now,
+	}
+
+	if tracer.FlushInterval, err = time.ParseDuration(config.FlushInterval); err != nil {
+		return nil, err
+	}
+
+	//FlushInterval doubles as the timeout of the OTLP client, where zero would mean none at all
+	if tracer.FlushInterval <= 0 {
+		return nil, errNonPositiveTraceFlushInterval
+	}
+
+	switch config.Exporter {
+	case "otlp":
+		if config.Endpoint == "" {
+			return nil, errMissingTraceEndpoint
+		}
+		tracer.Exporter = &OTLPExporter{URL: config.Endpoint, ServiceName: config.ServiceName, client: &http.Client{Timeout: tracer.FlushInterval}}
+	case "file":
+		if config.File == "" {
+			return nil, errMissingTraceFile
+		}
+		tracer.Exporter = &FileExporter{Path: config.File}
+	default:
+		return nil, errUnknownTraceExporter
+	}
+	return
+}
+
+//randomBytes fills b with random bytes
+func randomBytes(b []byte) {
+	rand.Read(b)
+}
+
+//newSpan starts a span of the given trace
+func (t *Tracer) newSpan(name string, kind int, trace TraceContext) *Span {
+	span := &Span{Name: name, Kind: kind, Context: trace, Start: t.now(), Attributes: map[string]string{}, tracer: t}
+	randomBytes(span.Context.SpanID[:])
+	return span
+}
+
+//sample decides whether a trace started by tr1d1um is recorded
+func (t *Tracer) sample() bool {
+	var b [8]byte
+	randomBytes(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/float64(1<<53) < t.SampleRatio
+}
+
+//enqueue hands a finished span over to Run. Spans are dropped if the queue is full
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		logging.Debug(t).Log(logging.MessageKey(), "span queue full, dropping span", "span", span.Name)
+	}
+}
+
+//Run exports the finished spans every FlushInterval, or as soon as a batch is full, until shutdown is closed
+func (t *Tracer) Run(shutdown <-chan struct{}) {
+	ticker := time.NewTicker(t.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, cap(t.spans))
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := t.Exporter.Export(batch); err != nil {
+			logging.Error(t).Log(logging.MessageKey(), "could not export spans", logging.ErrorKey(), err)
+		}
+		batch = make([]*Span, 0, cap(t.spans))
+	}
+
+	for {
+		select {
+		case <-shutdown:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			flush()
+			return
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+//Decorate traces the requests reaching the given handler, continuing the trace of the caller if the request carries a
+//valid traceparent header
+func (t *Tracer) Decorate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		trace, found := ParseTraceparent(req.Header.Get(HeaderTraceparent))
+
+		if found {
+			trace.State = req.Header.Get(HeaderTracestate)
+		} else {
+			randomBytes(trace.TraceID[:])
+			trace.Sampled = t.sample()
+		}
+
+		span := t.newSpan(fmt.Sprintf("%s %s", req.Method, routeTemplate(req)), SpanKindServer, trace)
+		if found {
+			span.ParentID = trace.SpanID
+		}
+
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+
+		recorder := &statusRecorder{ResponseWriter: origin, code: http.StatusOK}
+		delegate.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), spanKey{}, span)))
+
+		span.SetAttribute("http.status_code", strconv.Itoa(recorder.code))
+		if recorder.code >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(recorder.code)))
+		}
+		span.Finish()
+	})
+}
+
+//jsonSpan is how spans are written by the exporters, following the OTLP JSON encoding
+type jsonSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []jsonAttribute `json:"attributes,omitempty"`
+	Status            jsonStatus      `json:"status"`
+}
+
+type jsonAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type jsonStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newJSONAttribute(key, value string) (attribute jsonAttribute) {
+	attribute.Key, attribute.Value.StringValue = key, value
+	return
+}
+
+//toJSON returns the OTLP JSON form of the span
+func (s *Span) toJSON() jsonSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	encoded := jsonSpan{
+		TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+		TraceState:        s.Context.State,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            jsonStatus{Code: 1},
+	}
+
+	if s.ParentID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+	}
+
+	for key, value := range s.Attributes {
+		encoded.Attributes = append(encoded.Attributes, newJSONAttribute(key, value))
+	}
+
+	if s.Err != "" {
+		encoded.Status = jsonStatus{Code: 2, Message: s.Err}
+	}
+	return encoded
+}
+
+//OTLPExporter posts spans to an OpenTelemetry collector using the OTLP/HTTP JSON encoding
+type OTLPExporter struct {
+	URL         string
+	ServiceName string
+	client      *http.Client
+}
+
+//Export sends the given spans in a single request
+func (e *OTLPExporter) Export(spans []*Span) error {
+	encoded := make([]jsonSpan, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, span.toJSON())
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []jsonAttribute{newJSONAttribute("service.name", e.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": applicationName},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("trace collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+//FileExporter appends spans to a local file, one JSON object per line
+type FileExporter struct {
+	Path string
+}
+
+//Export writes the given spans to the file
+func (e *FileExporter) Export(spans []*Span) (err error) {
+	file, err := os.OpenFile(e.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, span := range spans {
+		if err = encoder.Encode(span.toJSON()); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,253 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+//recordingExporter keeps the spans it is given
+type recordingExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func newTestTracer() *Tracer {
+	return &Tracer{SampleRatio: 1, FlushInterval: time.Hour, Logger: logging.DefaultLogger(), spans: make(chan *Span, 16), now: time.Now}
+}
+
+//finishedSpans drains the spans the given tracer has queued
+func finishedSpans(tracer *Tracer) (spans []*Span) {
+	for len(tracer.spans) > 0 {
+		spans = append(spans, <-tracer.spans)
+	}
+	return
+}
+
+func TestParseTraceparent(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, found := ParseTraceparent(testTraceparent)
+	assert.True(found)
+	assert.True(tc.Sampled)
+	assert.EqualValues(testTraceparent, tc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, found = ParseTraceparent(invalid)
+		assert.False(found, invalid)
+	}
+}
+
+func TestStartSpanWithoutTracer(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "orphan", SpanKindInternal)
+	assert.Nil(t, span)
+
+	header := http.Header{}
+	InjectTraceContext(ctx, header)
+	assert.Empty(t, header)
+	assert.Empty(t, traceHeaders(ctx))
+
+	//nil spans record nothing
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("ignored"))
+	span.Finish()
+}
+
+func TestTracerPropagation(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newTestTracer()
+
+	var outbound http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outbound = r.Header
+	}))
+	defer target.Close()
+
+	sender := &Tr1SendAndHandle{Logger: logging.DefaultLogger(), RespTimeout: time.Minute, client: &http.Client{}}
+	retry := &Retry{
+		Logger:         logging.DefaultLogger(),
+		MaxRetries:     1,
+		ShouldRetry:    func(interface{}, error) bool { return false },
+		OnInternalFail: OnRetryInternalFailure,
+	}
+
+	var wrpHeaders []string
+	decorated := tracer.Decorate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		wrpHeaders = traceHeaders(req.Context())
+		retry.Execute(req.Context(), sender.MakeRequest, Tr1d1umRequest{method: http.MethodPost, URL: target.URL, rawResponse: true})
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://tr1d1um/api/v2/device/mac:112233445566/config", nil)
+	req.Header.Set(HeaderTraceparent, testTraceparent)
+	req.Header.Set(HeaderTracestate, "vendor=value")
+	decorated.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.True(strings.HasPrefix(outbound.Get(HeaderTraceparent), "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+	assert.EqualValues("vendor=value", outbound.Get(HeaderTracestate))
+	assert.Len(wrpHeaders, 2)
+	assert.True(strings.HasPrefix(wrpHeaders[0], "traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+
+	spans := finishedSpans(tracer)
+	assert.Len(spans, 3)
+
+	names := map[string]*Span{}
+	for _, span := range spans {
+		names[span.Name] = span
+		assert.EqualValues(spans[0].Context.TraceID, span.Context.TraceID)
+	}
+
+	server, attempt, client := names["POST unknown"], names["attempt"], names["HTTP POST"]
+	assert.EqualValues("00f067aa0ba902b7", server.toJSON().ParentSpanID)
+	assert.EqualValues(server.Context.SpanID, attempt.ParentID)
+	assert.EqualValues(attempt.Context.SpanID, client.ParentID)
+	assert.EqualValues("200", client.Attributes["http.status_code"])
+
+	//the outbound request carries the client span
+	assert.EqualValues(client.Context.Traceparent(), outbound.Get(HeaderTraceparent))
+}
+
+func TestTracerSampling(t *testing.T) {
+	tracer := newTestTracer()
+	tracer.SampleRatio = 0
+
+	decorated := tracer.Decorate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, span := StartSpan(req.Context(), "child", SpanKindInternal)
+		span.Finish()
+	}))
+
+	decorated.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/usage", nil))
+	assert.Empty(t, finishedSpans(tracer))
+}
+
+func TestTracerRun(t *testing.T) {
+	assert := assert.New(t)
+	exporter := &recordingExporter{}
+	tracer := newTestTracer()
+	tracer.Exporter = exporter
+
+	decorated := tracer.Decorate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	decorated.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/usage", nil))
+
+	shutdown := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		tracer.Run(shutdown)
+		close(done)
+	}()
+
+	close(shutdown)
+	<-done
+	assert.Len(exporter.spans, 1)
+}
+
+func TestSpanExporters(t *testing.T) {
+	tracer := newTestTracer()
+	span := tracer.newSpan("GET /device/{deviceid}/stat", SpanKindServer, TraceContext{Sampled: true})
+	span.SetError(errors.New("boom"))
+	span.Finish()
+
+	t.Run("OTLP", func(t *testing.T) {
+		assert := assert.New(t)
+		var body map[string]interface{}
+
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&body)
+		}))
+		defer collector.Close()
+
+		exporter := &OTLPExporter{URL: collector.URL, ServiceName: "tr1d1um", client: &http.Client{}}
+		assert.Nil(exporter.Export([]*Span{span}))
+
+		encoded, _ := json.Marshal(body)
+		assert.Contains(string(encoded), `"name":"GET /device/{deviceid}/stat"`)
+		assert.Contains(string(encoded), `"stringValue":"tr1d1um"`)
+		assert.Contains(string(encoded), `"status":{"code":2,"message":"boom"}`)
+	})
+
+	t.Run("File", func(t *testing.T) {
+		assert := assert.New(t)
+		dir, err := ioutil.TempDir("", "tr1d1um-tracing")
+		assert.Nil(err)
+		defer os.RemoveAll(dir)
+
+		exporter := &FileExporter{Path: filepath.Join(dir, "spans.json")}
+		assert.Nil(exporter.Export([]*Span{span}))
+		assert.Nil(exporter.Export([]*Span{span}))
+
+		data, err := ioutil.ReadFile(exporter.Path)
+		assert.Nil(err)
+		assert.Len(strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+	})
+}
+
+func TestNewTracer(t *testing.T) {
+	assert := assert.New(t)
+
+	config := defaultTracingConfig()
+	_, err := NewTracer(config, logging.DefaultLogger())
+	assert.EqualValues(errUnknownTraceExporter, err)
+
+	config.Exporter, config.File = "file", "spans.json"
+	tracer, err := NewTracer(config, logging.DefaultLogger())
+	assert.Nil(err)
+	assert.EqualValues(defaultTraceBatchSize, cap(tracer.spans))
+
+	config.FlushInterval = "0s"
+	_, err = NewTracer(config, logging.DefaultLogger())
+	assert.EqualValues(errNonPositiveTraceFlushInterval, err)
+
+	config = defaultTracingConfig()
+	config.Exporter = "file"
+	_, err = NewTracer(config, logging.DefaultLogger())
+	assert.EqualValues(errMissingTraceFile, err)
+
+	config.Exporter = "otlp"
+	_, err = NewTracer(config, logging.DefaultLogger())
+	assert.EqualValues(errMissingTraceEndpoint, err)
+}
@@ -0,0 +1,226 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errUndoOnlyForSet        = errors.New("undo capture is only supported for the SET command")
+	errUndoCaptureIncomplete = errors.New("could not capture current values for all parameters")
+	errUndoAnonymous         = errors.New("undo capture requires an authenticated client")
+)
+
+//UndoRecord holds the values some SET overwrote so that they can be written back to the device.
+//Client is the identity of the caller that made the SET, the only one allowed to undo it
+type UndoRecord struct {
+	DeviceID   string
+	Service    string
+	Client     string
+	Parameters []SetParam
+	Expires    time.Time
+}
+
+//UndoStore keeps UndoRecords indexed by the transaction ID of the SET that produced them
+type UndoStore interface {
+	Store(tid string, record *UndoRecord)
+	Take(tid, client string) (*UndoRecord, bool)
+	Restore(tid string, record *UndoRecord)
+}
+
+//MemoryUndoStore is an in-memory UndoStore whose records expire after TTL
+type MemoryUndoStore struct {
+	TTL     time.Duration
+	lock    sync.Mutex
+	records map[string]*UndoRecord
+	now     func() time.Time
+}
+
+//NewMemoryUndoStore returns an empty MemoryUndoStore
+func NewMemoryUndoStore(ttl time.Duration) *MemoryUndoStore {
+	return &MemoryUndoStore{TTL: ttl, records: map[string]*UndoRecord{}, now: time.Now}
+}
+
+//Store saves the given record under tid. Expired records are swept out on every call
+func (m *MemoryUndoStore) Store(tid string, record *UndoRecord) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	for key, stored := range m.records {
+		if now.After(stored.Expires) {
+			delete(m.records, key)
+		}
+	}
+
+	record.Expires = now.Add(m.TTL)
+	m.records[tid] = record
+}
+
+//Take removes and returns the record stored under tid as long as it has not expired and belongs to client,
+//so that concurrent undo requests cannot both write it back
+func (m *MemoryUndoStore) Take(tid, client string) (record *UndoRecord, found bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if record, found = m.records[tid]; !found || record.Client != client {
+		return nil, false
+	}
+
+	delete(m.records, tid)
+	if m.now().After(record.Expires) {
+		return nil, false
+	}
+	return
+}
+
+//Restore puts back a record Take returned, keeping its original expiry
+func (m *MemoryUndoStore) Restore(tid string, record *UndoRecord) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.now().After(record.Expires) {
+		m.records[tid] = record
+	}
+}
+
+//rdkGetResponse is the shape of the payload a device returns for a GET command
+type rdkGetResponse struct {
+	Parameters []SetParam `json:"parameters"`
+	StatusCode int        `json:"statusCode"`
+}
+
+//undoRequested returns true if the caller asked for the current values to be captured before a SET
+func undoRequested(header http.Header) bool {
+	return strings.EqualFold(header.Get(HeaderTr1d1umUndo), "true")
+}
+
+//captureUndo reads the current values of the parameters targeted by the given SET. On failure, the returned
+//Tr1d1umResponse describes what should be passed back to the caller instead of proceeding with the SET
+func (ch *ConversionHandler) captureUndo(req *http.Request, urlVars Vars, setWDMP *SetWDMP) (record *UndoRecord, failure *Tr1d1umResponse) {
+	if setWDMP.Command != CommandSet {
+		failure = Tr1d1umResponse{}.New()
+		WriteResponse(errUndoOnlyForSet.Error(), http.StatusBadRequest, failure)
+		return
+	}
+
+	//anonymous callers would all be allowed to undo each other's changes
+	client := ClientIdentity(req)
+	if client == anonymousClient {
+		failure = Tr1d1umResponse{}.New()
+		WriteResponse(errUndoAnonymous.Error(), http.StatusBadRequest, failure)
+		return
+	}
+
+	getWDMP := &GetWDMP{Command: CommandGet}
+	for _, param := range setWDMP.Parameters {
+		getWDMP.Names = append(getWDMP.Names, *param.Name)
+	}
+
+	payload, err := json.Marshal(getWDMP)
+	if err != nil {
+		failure = Tr1d1umResponse{}.New()
+		failure.Code = http.StatusInternalServerError
+		return
+	}
+
+	//the capture is a transaction of its own so it should not reuse the TID of the SET
+	header := http.Header{}
+	header.Set(contentTypeKey, wrp.JSON.ContentType())
+
+	tr1Resp, err := ch.sendWRP(req, ch.route(urlVars["service"]), ch.WdmpConvert.GetConfiguredWRP(payload, urlVars, header))
+	if err != nil || tr1Resp.Code != http.StatusOK {
+		logging.Error(ch).Log(logging.MessageKey(), "could not capture values for undo", logging.ErrorKey(), err)
+		failure = tr1Resp
+		return
+	}
+
+	var current rdkGetResponse
+	if err = json.Unmarshal(tr1Resp.Body, &current); err != nil || len(current.Parameters) != len(getWDMP.Names) {
+		logging.Error(ch).Log(logging.MessageKey(), errUndoCaptureIncomplete.Error(), logging.ErrorKey(), err)
+		failure = Tr1d1umResponse{}.New()
+		WriteResponse(errUndoCaptureIncomplete.Error(), http.StatusBadGateway, failure)
+		return
+	}
+
+	record = &UndoRecord{
+		DeviceID:   urlVars["deviceid"],
+		Service:    urlVars["service"],
+		Client:     client,
+		Parameters: current.Parameters,
+	}
+	return
+}
+
+//HandleUndo writes back the values captured before the SET identified by the {tid} URL variable. Only the client
+//that made the SET may undo it. The record is taken out of the store while the write is in flight and put back
+//if it fails, so that it can be attempted again
+func (ch *ConversionHandler) HandleUndo(origin http.ResponseWriter, req *http.Request) {
+	requestArrivalTime := time.Now()
+	logging.Debug(ch).Log(logging.MessageKey(), "HandleUndo called")
+
+	tid := mux.Vars(req)["tid"]
+	record, found := ch.UndoStore.Take(tid, ClientIdentity(req))
+
+	//records of other clients are not found either, lest their transaction IDs be probed
+	if !found {
+		WriteResponseWriter("no undo information found for transaction", http.StatusNotFound, origin)
+		return
+	}
+
+	wdmpPayload, err := json.Marshal(&SetWDMP{Command: CommandSet, Parameters: record.Parameters})
+
+	if err != nil {
+		ch.UndoStore.Restore(tid, record)
+		origin.WriteHeader(http.StatusInternalServerError)
+		logging.Error(ch).Log(logging.ErrorKey(), err.Error())
+		return
+	}
+
+	header := http.Header{}
+	header.Set(contentTypeKey, wrp.JSON.ContentType())
+	header.Set(HeaderWPATID, req.Header.Get(HeaderWPATID))
+
+	wrpMsg := ch.WdmpConvert.GetConfiguredWRP(wdmpPayload, Vars{"deviceid": record.DeviceID, "service": record.Service}, header)
+
+	origin.Header().Set(HeaderWPATID, wrpMsg.TransactionUUID)
+	origin.Header().Set(contentTypeKey, wrp.JSON.ContentType())
+
+	tr1d1umResp, err := ch.sendWRP(req, ch.route(record.Service), wrpMsg)
+
+	if err != nil {
+		logging.Error(ch).Log(logging.MessageKey(), "error in retry execution", logging.ErrorKey(), err)
+	}
+
+	if tr1d1umResp.Code != http.StatusOK {
+		ch.UndoStore.Restore(tid, record)
+	}
+
+	bookkeepingLog(ch, tr1d1umResp, req, time.Now().Sub(requestArrivalTime), wrpMsg.TransactionUUID)
+	TransferResponse(tr1d1umResp, origin)
+}
@@ -0,0 +1,203 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/wrp"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMemoryUndoStore(t *testing.T) {
+	t.Run("StoreAndTake", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryUndoStore(time.Minute)
+
+		store.Store("tid", &UndoRecord{DeviceID: "mac:112233445566", Client: "client"})
+		record, found := store.Take("tid", "client")
+
+		assert.True(found)
+		assert.EqualValues("mac:112233445566", record.DeviceID)
+
+		_, found = store.Take("tid", "client")
+		assert.False(found)
+
+		store.Restore("tid", record)
+		_, found = store.Take("tid", "client")
+		assert.True(found)
+	})
+
+	t.Run("OtherClient", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryUndoStore(time.Minute)
+
+		store.Store("tid", &UndoRecord{Client: "client"})
+		_, found := store.Take("tid", "other")
+		assert.False(found)
+
+		_, found = store.Take("tid", "client")
+		assert.True(found)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert := assert.New(t)
+		store := NewMemoryUndoStore(time.Minute)
+		now := time.Now()
+		store.now = func() time.Time { return now }
+
+		store.Store("tid", &UndoRecord{})
+		record, _ := store.Take("tid", "")
+		now = now.Add(2 * time.Minute)
+
+		store.Restore("tid", record)
+		assert.Empty(store.records)
+
+		store.Store("tid", &UndoRecord{})
+		now = now.Add(2 * time.Minute)
+
+		_, found := store.Take("tid", "")
+		assert.False(found)
+	})
+}
+
+func TestCaptureUndo(t *testing.T) {
+	t.Run("OnlySet", func(t *testing.T) {
+		assert := assert.New(t)
+		req := httptest.NewRequest(http.MethodPatch, "http://someURL", nil)
+
+		record, failure := ch.captureUndo(req, Vars{}, &SetWDMP{Command: CommandSetAttrs})
+		assert.Nil(record)
+		assert.EqualValues(http.StatusBadRequest, failure.Code)
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		assert := assert.New(t)
+		req := httptest.NewRequest(http.MethodPatch, "http://someURL", nil)
+
+		record, failure := ch.captureUndo(req, Vars{}, &SetWDMP{Command: CommandSet})
+		assert.Nil(record)
+		assert.EqualValues(http.StatusBadRequest, failure.Code)
+	})
+
+	t.Run("CapturesValues", func(t *testing.T) {
+		assert := assert.New(t)
+		req := httptest.NewRequest(http.MethodPatch, "http://someURL", nil)
+		req.SetBasicAuth("client", "pass")
+		name := "Device.Param"
+		urlVars := Vars{"deviceid": "mac:112233445566", "service": "config"}
+
+		getResp := Tr1d1umResponse{}.New()
+		getResp.Body = []byte(`{"parameters":[{"name":"Device.Param","value":"old","dataType":0}],"statusCode":200}`)
+
+		mockConversion.On("GetConfiguredWRP", mock.AnythingOfType("[]uint8"), urlVars, mock.Anything).Return(&wrp.Message{}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(getResp, nil).Once()
+
+		record, failure := ch.captureUndo(req, urlVars, &SetWDMP{Command: CommandSet, Parameters: []SetParam{{Name: &name}}})
+
+		assert.Nil(failure)
+		assert.EqualValues("mac:112233445566", record.DeviceID)
+		assert.EqualValues("old", record.Parameters[0].Value)
+		assert.EqualValues("basic:client", record.Client)
+		mockConversion.AssertExpectations(t)
+		mockRetryStrategy.AssertExpectations(t)
+	})
+}
+
+func TestHandleUndo(t *testing.T) {
+	store := NewMemoryUndoStore(time.Minute)
+	ch := &ConversionHandler{
+		Sender:        mockSender,
+		Logger:        logging.DefaultLogger(),
+		RetryStrategy: mockRetryStrategy,
+		WdmpConvert:   mockConversion,
+		UndoStore:     store,
+	}
+
+	t.Run("NotFound", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "http://someURL", nil), map[string]string{"tid": "unknown"})
+
+		ch.HandleUndo(recorder, req)
+		assert.EqualValues(http.StatusNotFound, recorder.Code)
+	})
+
+	newRequest := func(user string) *http.Request {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "http://someURL", nil), map[string]string{"tid": "tid"})
+		req.SetBasicAuth(user, "pass")
+		return req
+	}
+
+	t.Run("OtherClient", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+
+		store.Store("tid", &UndoRecord{DeviceID: "mac:112233445566", Service: "config", Client: "basic:client"})
+		ch.HandleUndo(recorder, newRequest("other"))
+		assert.EqualValues(http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("PutBackOnFailure", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := newRequest("client")
+
+		store.Store("tid", &UndoRecord{DeviceID: "mac:112233445566", Service: "config", Client: "basic:client"})
+
+		failure := Tr1d1umResponse{}.New()
+		failure.Code = http.StatusBadGateway
+
+		mockConversion.On("GetConfiguredWRP", mock.AnythingOfType("[]uint8"), Vars{"deviceid": "mac:112233445566", "service": "config"},
+			mock.Anything).Return(&wrp.Message{TransactionUUID: "undo-tid"}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(failure, nil).Once()
+
+		ch.HandleUndo(recorder, req)
+
+		assert.EqualValues(http.StatusBadGateway, recorder.Code)
+		assert.Contains(store.records, "tid")
+		mockRetryStrategy.AssertExpectations(t)
+	})
+
+	t.Run("WritesBack", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := httptest.NewRecorder()
+		req := newRequest("client")
+
+		store.Store("tid", &UndoRecord{DeviceID: "mac:112233445566", Service: "config", Client: "basic:client"})
+
+		mockConversion.On("GetConfiguredWRP", mock.AnythingOfType("[]uint8"), Vars{"deviceid": "mac:112233445566", "service": "config"},
+			mock.Anything).Return(&wrp.Message{TransactionUUID: "undo-tid"}).Once()
+		mockRetryStrategy.On("Execute", req.Context(), mock.Anything, mock.Anything).Return(Tr1d1umResponse{}.New(), nil).Once()
+
+		ch.HandleUndo(recorder, req)
+
+		assert.EqualValues(http.StatusOK, recorder.Code)
+		assert.EqualValues("undo-tid", recorder.Header().Get(HeaderWPATID))
+
+		assert.NotContains(store.records, "tid")
+		mockConversion.AssertExpectations(t)
+		mockRetryStrategy.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,502 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Comcast/webpa-common/device"
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	usageKey = "usage"
+
+	defaultTenantClaim        = "tenant"
+	defaultUsageFlushInterval = "1m"
+
+	dayLayout, monthLayout = "2006-01-02", "2006-01"
+
+	//how long usage is kept around for reports
+	usageRetainedDays   = 62
+	usageRetainedMonths = 13
+)
+
+var errNonPositiveUsageFlushInterval = errors.New("usage: flushInterval must be positive")
+
+//Quota caps the number of device requests a tenant may make per UTC day and month. Zero means no cap
+type Quota struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+//UsageConfig defines the usage section of the configuration file
+type UsageConfig struct {
+	// TenantClaim is the JWT claim naming the tenant of a request. Requests without it are accounted to their
+	// authenticated client identity
+	TenantClaim string `json:"tenantClaim"`
+
+	// StorePath is the file usage is persisted to every FlushInterval. Usage is only kept in memory if empty
+	StorePath     string `json:"storePath"`
+	FlushInterval string `json:"flushInterval"`
+
+	DefaultQuota Quota            `json:"defaultQuota"`
+	Quotas       map[string]Quota `json:"quotas"`
+
+	// AdminTenants may see the usage of every tenant. Others only see their own
+	AdminTenants []string `json:"adminTenants"`
+}
+
+//defaultUsageConfig returns the settings used for anything the usage section leaves out
+func defaultUsageConfig() UsageConfig {
+	return UsageConfig{TenantClaim: defaultTenantClaim, FlushInterval: defaultUsageFlushInterval}
+}
+
+//UsageCounters hold what a tenant consumed over some period
+type UsageCounters struct {
+	Requests map[string]int64    `json:"requests"`
+	Errors   int64               `json:"errors"`
+	Devices  map[string]struct{} `json:"devices"`
+}
+
+func newUsageCounters() *UsageCounters {
+	return &UsageCounters{Requests: map[string]int64{}, Devices: map[string]struct{}{}}
+}
+
+//total returns the number of requests of any command type
+func (c *UsageCounters) total() (total int64) {
+	for _, count := range c.Requests {
+		total += count
+	}
+	return
+}
+
+//UsageReport describes the consumption of a tenant over a day or a month
+type UsageReport struct {
+	Tenant    string           `json:"tenant"`
+	Period    string           `json:"period"`
+	Requests  map[string]int64 `json:"requests"`
+	Total     int64            `json:"total"`
+	Devices   int              `json:"devices"`
+	Errors    int64            `json:"errors"`
+	ErrorRate float64          `json:"errorRate"`
+	Quota     int64            `json:"quota,omitempty"`
+}
+
+//UsageTracker accounts the device requests of each tenant per day and per month, and enforces their quotas
+type UsageTracker struct {
+	Config        UsageConfig
+	FlushInterval time.Duration
+	log.Logger
+
+	lock  sync.Mutex
+	usage map[string]map[string]*UsageCounters
+	dirty bool
+	now   func() time.Time
+}
+
+//NewUsageTracker builds the UsageTracker described by the given configuration and loads previously persisted usage
+func NewUsageTracker(config UsageConfig, logger log.Logger) (tracker *UsageTracker, err error) {
+	tracker = &UsageTracker{
+		Config: config,
+		Logger: logger,
+		usage:  map[string]map[string]*UsageCounters{},
+		now:    time.Now,
+	}
+
+	if tracker.FlushInterval, err = time.ParseDuration(config.FlushInterval); err != nil {
+		return nil, err
+	}
+
+	if tracker.FlushInterval <= 0 {
+		return nil, errNonPositiveUsageFlushInterval
+	}
+
+	if err = tracker.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//periods returns the day and month the given time falls in
+func periods(t time.Time) (day, month string) {
+	t = t.UTC()
+	return t.Format(dayLayout), t.Format(monthLayout)
+}
+
+//quota returns the quota of the given tenant
+func (u *UsageTracker) quota(tenant string) Quota {
+	if quota, ok := u.Config.Quotas[tenant]; ok {
+		return quota
+	}
+	return u.Config.DefaultQuota
+}
+
+//counters returns the counters of the given tenant and period. The caller must hold the lock
+func (u *UsageTracker) counters(tenant, period string) *UsageCounters {
+	tenantUsage, ok := u.usage[tenant]
+	if !ok {
+		tenantUsage = map[string]*UsageCounters{}
+		u.usage[tenant] = tenantUsage
+	}
+
+	counters, ok := tenantUsage[period]
+	if !ok {
+		counters = newUsageCounters()
+		tenantUsage[period] = counters
+	}
+	return counters
+}
+
+//Reserve accounts a request of the given command type to the given device if the tenant is still within its quotas.
+//Otherwise, nothing is accounted and retryAfter is how long until the exhausted period ends. The check and the count
+//happen under one lock so that concurrent requests cannot overshoot the quotas
+func (u *UsageTracker) Reserve(tenant, command, deviceID string) (retryAfter time.Duration, reserved bool) {
+	quota := u.quota(tenant)
+	now := u.now().UTC()
+	day, month := periods(now)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if quota.Monthly > 0 && u.counters(tenant, month).total() >= quota.Monthly {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now), false
+	}
+
+	if quota.Daily > 0 && u.counters(tenant, day).total() >= quota.Daily {
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now), false
+	}
+
+	for _, period := range []string{day, month} {
+		counters := u.counters(tenant, period)
+		counters.Requests[command]++
+		counters.Devices[deviceID] = struct{}{}
+	}
+	u.dirty = true
+	return 0, true
+}
+
+//Record accounts the outcome of a request Reserve let through
+func (u *UsageTracker) Record(tenant string, statusCode int) {
+	if statusCode < http.StatusBadRequest {
+		return
+	}
+
+	day, month := periods(u.now())
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for _, period := range []string{day, month} {
+		u.counters(tenant, period).Errors++
+	}
+	u.dirty = true
+}
+
+//Report returns the usage of the given tenants, or of every tenant if none is given, over the given periods.
+//The current day and month are reported if no period is given
+func (u *UsageTracker) Report(tenants []string, reportPeriods []string) (reports []UsageReport) {
+	if len(reportPeriods) == 0 {
+		day, month := periods(u.now())
+		reportPeriods = []string{day, month}
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if len(tenants) == 0 {
+		for tenant := range u.usage {
+			tenants = append(tenants, tenant)
+		}
+		sort.Strings(tenants)
+	}
+
+	for _, tenant := range tenants {
+		for _, period := range reportPeriods {
+			report := UsageReport{Tenant: tenant, Period: period, Requests: map[string]int64{}}
+
+			if counters, ok := u.usage[tenant][period]; ok {
+				for command, count := range counters.Requests {
+					report.Requests[command] = count
+				}
+				report.Total, report.Devices, report.Errors = counters.total(), len(counters.Devices), counters.Errors
+			}
+
+			if report.Total > 0 {
+				report.ErrorRate = float64(report.Errors) / float64(report.Total)
+			}
+
+			if quota := u.quota(tenant); len(period) == len(dayLayout) {
+				report.Quota = quota.Daily
+			} else {
+				report.Quota = quota.Monthly
+			}
+
+			reports = append(reports, report)
+		}
+	}
+	return
+}
+
+//prune drops the usage older than what is retained for reports. The caller must hold the lock
+func (u *UsageTracker) prune() {
+	now := u.now().UTC()
+	oldestDay := now.AddDate(0, 0, -usageRetainedDays).Format(dayLayout)
+	oldestMonth := now.AddDate(0, -usageRetainedMonths, 0).Format(monthLayout)
+
+	for tenant, tenantUsage := range u.usage {
+		for period := range tenantUsage {
+			if (len(period) == len(dayLayout) && period < oldestDay) || (len(period) == len(monthLayout) && period < oldestMonth) {
+				delete(tenantUsage, period)
+			}
+		}
+
+		if len(tenantUsage) == 0 {
+			delete(u.usage, tenant)
+		}
+	}
+}
+
+//load reads the usage persisted to StorePath, if any
+func (u *UsageTracker) load() error {
+	if u.Config.StorePath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(u.Config.StorePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &u.usage)
+}
+
+//Flush writes the usage to StorePath if it changed since the last flush. The file is replaced atomically
+func (u *UsageTracker) Flush() (err error) {
+	if u.Config.StorePath == "" {
+		return
+	}
+
+	u.lock.Lock()
+	if !u.dirty {
+		u.lock.Unlock()
+		return
+	}
+
+	u.prune()
+	data, err := json.Marshal(u.usage)
+	u.dirty = false
+	u.lock.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	temp := u.Config.StorePath + ".tmp"
+	if err = ioutil.WriteFile(temp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(temp, u.Config.StorePath)
+}
+
+//Persist flushes the usage every FlushInterval, and one last time once shutdown is closed
+func (u *UsageTracker) Persist(shutdown <-chan struct{}) {
+	ticker := time.NewTicker(u.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			u.flushAndLog()
+			return
+		case <-ticker.C:
+			u.flushAndLog()
+		}
+	}
+}
+
+func (u *UsageTracker) flushAndLog() {
+	if err := u.Flush(); err != nil {
+		logging.Error(u).Log(logging.MessageKey(), "could not persist usage", logging.ErrorKey(), err)
+	}
+}
+
+//Tenant returns the tenant a request is accounted to: the configured claim of its JWT, if any, else the identity
+//it was authenticated as. The token has been validated by the time this is called, unless the request was
+//authenticated by its client certificate instead, in which case the token is ignored
+func (u *UsageTracker) Tenant(req *http.Request) string {
+	if _, byCertificate := ClientCertIdentity(req.Context()); byCertificate {
+		return ClientIdentity(req)
+	}
+
+	authorization := req.Header.Get("Authorization")
+
+	if parts := strings.Split(strings.TrimPrefix(authorization, "Bearer "), "."); strings.HasPrefix(authorization, "Bearer ") && len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "=")); err == nil {
+			claims := map[string]interface{}{}
+			if json.Unmarshal(payload, &claims) == nil {
+				if tenant, ok := claims[u.Config.TenantClaim].(string); ok && tenant != "" {
+					return tenant
+				}
+			}
+		}
+	}
+
+	return ClientIdentity(req)
+}
+
+//commandType names the kind of device request a call makes
+func commandType(req *http.Request) string {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/stat"):
+		return "STAT"
+	case strings.Contains(req.URL.Path, "/wrp/"):
+		return "WRP"
+	case req.Method == http.MethodGet:
+		return CommandGet
+	case req.Method == http.MethodPatch:
+		return CommandSet
+	case req.Method == http.MethodDelete:
+		return CommandDeleteRow
+	case req.Method == http.MethodPut:
+		return CommandReplaceRows
+	default:
+		return CommandAddRow
+	}
+}
+
+//Decorate enforces quotas on, and accounts, the device requests reaching the given handler. It must come after
+//authorization in the chain
+func (u *UsageTracker) Decorate(delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(origin http.ResponseWriter, req *http.Request) {
+		deviceID, isDeviceRequest := mux.Vars(req)["deviceid"]
+		if !isDeviceRequest {
+			delegate.ServeHTTP(origin, req)
+			return
+		}
+
+		tenant := u.Tenant(req)
+
+		if id, err := device.ParseID(deviceID); err == nil {
+			deviceID = string(id)
+		}
+
+		if retryAfter, reserved := u.Reserve(tenant, commandType(req), deviceID); !reserved {
+			logging.Info(u).Log(logging.MessageKey(), "quota exceeded", "tenant", tenant)
+			origin.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+			WriteResponseWriter("Quota exceeded", http.StatusTooManyRequests, origin)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: origin, code: http.StatusOK}
+		delegate.ServeHTTP(recorder, req)
+		u.Record(tenant, recorder.code)
+	})
+}
+
+//HandleUsage reports the consumption of the calling tenant, or of any tenant for admin tenants, as JSON or, with
+//format=csv, as CSV. The tenant and period query parameters narrow the report down
+func (u *UsageTracker) HandleUsage(origin http.ResponseWriter, req *http.Request) {
+	var (
+		query   = req.URL.Query()
+		tenant  = u.Tenant(req)
+		tenants = query["tenant"]
+		admin   = false
+	)
+
+	for _, adminTenant := range u.Config.AdminTenants {
+		admin = admin || adminTenant == tenant
+	}
+
+	if !admin {
+		for _, requested := range tenants {
+			if requested != tenant {
+				WriteResponseWriter("Forbidden", http.StatusForbidden, origin)
+				return
+			}
+		}
+		tenants = []string{tenant}
+	}
+
+	for _, period := range query["period"] {
+		if _, err := time.Parse(dayLayout, period); err != nil {
+			if _, err = time.Parse(monthLayout, period); err != nil {
+				WriteResponseWriter(fmt.Sprintf("Invalid period: %s", period), http.StatusBadRequest, origin)
+				return
+			}
+		}
+	}
+
+	reports := u.Report(tenants, query["period"])
+
+	if strings.EqualFold(query.Get("format"), "csv") {
+		origin.Header().Set(contentTypeKey, "text/csv")
+		writeUsageCSV(origin, reports)
+		return
+	}
+
+	origin.Header().Set(contentTypeKey, "application/json")
+	json.NewEncoder(origin).Encode(reports)
+}
+
+//writeUsageCSV writes one row per report and command type
+func writeUsageCSV(origin http.ResponseWriter, reports []UsageReport) {
+	w := csv.NewWriter(origin)
+	w.Write([]string{"tenant", "period", "command", "requests", "total", "devices", "errors", "errorRate", "quota"})
+
+	for _, report := range reports {
+		commands := make([]string, 0, len(report.Requests))
+		for command := range report.Requests {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+
+		if len(commands) == 0 {
+			commands = []string{""}
+		}
+
+		for _, command := range commands {
+			w.Write([]string{
+				report.Tenant, report.Period, command,
+				strconv.FormatInt(report.Requests[command], 10),
+				strconv.FormatInt(report.Total, 10),
+				strconv.Itoa(report.Devices),
+				strconv.FormatInt(report.Errors, 10),
+				strconv.FormatFloat(report.ErrorRate, 'f', 4, 64),
+				strconv.FormatInt(report.Quota, 10),
+			})
+		}
+	}
+	w.Flush()
+}
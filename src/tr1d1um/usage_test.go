@@ -0,0 +1,238 @@
+/**
+ * Copyright 2017 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Comcast/webpa-common/logging"
+	"github.com/Comcast/webpa-common/secure/handler"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestToken returns an unsigned bearer token carrying the given tenant claim
+func newTestToken(tenant string) string {
+	claims, _ := json.Marshal(map[string]string{"tenant": tenant})
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"
+}
+
+func newTestUsageTracker(t *testing.T, config UsageConfig) *UsageTracker {
+	if config.FlushInterval == "" {
+		config.FlushInterval = defaultUsageFlushInterval
+	}
+	if config.TenantClaim == "" {
+		config.TenantClaim = defaultTenantClaim
+	}
+
+	tracker, err := NewUsageTracker(config, logging.DefaultLogger())
+	assert.Nil(t, err)
+
+	now := time.Date(2018, time.March, 31, 23, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+	return tracker
+}
+
+//account lets a request through the tracker, if its quota allows, and records its outcome
+func account(tracker *UsageTracker, tenant, command string, statusCode int) bool {
+	_, reserved := tracker.Reserve(tenant, command, "mac:112233445566")
+	if reserved {
+		tracker.Record(tenant, statusCode)
+	}
+	return reserved
+}
+
+func TestUsageTrackerQuotas(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTestUsageTracker(t, UsageConfig{
+		DefaultQuota: Quota{Daily: 2},
+		Quotas:       map[string]Quota{"big": {Monthly: 3}},
+	})
+
+	assert.True(account(tracker, "small", CommandGet, http.StatusOK))
+	assert.True(account(tracker, "small", CommandSet, http.StatusInternalServerError))
+
+	retryAfter, reserved := tracker.Reserve("small", CommandGet, "mac:112233445566")
+	assert.False(reserved)
+	assert.EqualValues(time.Hour, retryAfter)
+
+	for i := 0; i < 3; i++ {
+		assert.True(account(tracker, "big", CommandGet, http.StatusOK))
+	}
+	retryAfter, reserved = tracker.Reserve("big", CommandGet, "mac:112233445566")
+	assert.False(reserved)
+	assert.EqualValues(time.Hour, retryAfter)
+
+	reports := tracker.Report([]string{"small"}, nil)
+	assert.Len(reports, 2)
+	assert.EqualValues("2018-03-31", reports[0].Period)
+	assert.EqualValues(2, reports[0].Total)
+	assert.EqualValues(1, reports[0].Devices)
+	assert.EqualValues(0.5, reports[0].ErrorRate)
+	assert.EqualValues(2, reports[0].Quota)
+	assert.EqualValues("2018-03", reports[1].Period)
+}
+
+func TestUsageTrackerConcurrentQuota(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTestUsageTracker(t, UsageConfig{DefaultQuota: Quota{Daily: 5}})
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		reserved int
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := tracker.Reserve("tenant", CommandGet, "mac:112233445566"); ok {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(5, reserved)
+	assert.EqualValues(5, tracker.Report([]string{"tenant"}, []string{"2018-03-31"})[0].Total)
+}
+
+func TestNewUsageTrackerNonPositiveFlushInterval(t *testing.T) {
+	tracker, err := NewUsageTracker(UsageConfig{FlushInterval: "0s"}, logging.DefaultLogger())
+	assert.Nil(t, tracker)
+	assert.EqualValues(t, errNonPositiveUsageFlushInterval, err)
+}
+
+func TestUsageTrackerPersistence(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "tr1d1um-usage")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config := UsageConfig{StorePath: filepath.Join(dir, "usage.json")}
+	tracker := newTestUsageTracker(t, config)
+	account(tracker, "tenant", CommandGet, http.StatusOK)
+	assert.Nil(tracker.Flush())
+
+	reloaded := newTestUsageTracker(t, config)
+	reports := reloaded.Report([]string{"tenant"}, []string{"2018-03"})
+	assert.EqualValues(1, reports[0].Requests[CommandGet])
+}
+
+func TestUsageTrackerTenant(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTestUsageTracker(t, UsageConfig{})
+
+	req := httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/usage", nil)
+	req.Header.Set("Authorization", newTestToken("partner"))
+	assert.EqualValues("partner", tracker.Tenant(req))
+
+	req.SetBasicAuth("user", "pass")
+	assert.EqualValues("basic:user", tracker.Tenant(req))
+
+	//certificate authenticated requests skip token validation, so their token cannot be trusted
+	req = httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/usage", nil)
+	req.Header.Set("Authorization", newTestToken("partner"))
+	ctx := handler.NewContextWithValue(req.Context(), &handler.ContextValues{SatClientID: "cert:cert-client"})
+	req = req.WithContext(withClientCertIdentity(ctx, "cert-client"))
+	assert.EqualValues("cert:cert-client", tracker.Tenant(req))
+}
+
+func TestUsageTrackerDecorate(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTestUsageTracker(t, UsageConfig{DefaultQuota: Quota{Daily: 1}})
+
+	decorated := tracker.Decorate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "http://tr1d1um/api/v2/device/mac:112233445566/config", nil)
+		req.Header.Set("Authorization", newTestToken("partner"))
+		req = mux.SetURLVars(req, map[string]string{"deviceid": "mac:112233445566", "service": "config"})
+		recorder := httptest.NewRecorder()
+		decorated.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	assert.EqualValues(http.StatusNotFound, serve().Code)
+
+	recorder := serve()
+	assert.EqualValues(http.StatusTooManyRequests, recorder.Code)
+	assert.EqualValues("3600", recorder.Header().Get("Retry-After"))
+
+	reports := tracker.Report([]string{"partner"}, []string{"2018-03-31"})
+	assert.EqualValues(1, reports[0].Requests[CommandSet])
+	assert.EqualValues(1, reports[0].Errors)
+}
+
+func TestHandleUsage(t *testing.T) {
+	tracker := newTestUsageTracker(t, UsageConfig{AdminTenants: []string{"ops"}})
+	account(tracker, "partner", CommandGet, http.StatusOK)
+	account(tracker, "other", CommandGet, http.StatusOK)
+
+	serve := func(tenant, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://tr1d1um/api/v2/usage?"+query, nil)
+		req.Header.Set("Authorization", newTestToken(tenant))
+		recorder := httptest.NewRecorder()
+		tracker.HandleUsage(recorder, req)
+		return recorder
+	}
+
+	t.Run("OwnUsage", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := serve("partner", "period=2018-03")
+
+		var reports []UsageReport
+		assert.Nil(json.Unmarshal(recorder.Body.Bytes(), &reports))
+		assert.Len(reports, 1)
+		assert.EqualValues("partner", reports[0].Tenant)
+		assert.EqualValues(1, reports[0].Total)
+	})
+
+	t.Run("OtherTenant", func(t *testing.T) {
+		assert.EqualValues(t, http.StatusForbidden, serve("partner", "tenant=other").Code)
+	})
+
+	t.Run("AdminCSV", func(t *testing.T) {
+		assert := assert.New(t)
+		recorder := serve("ops", "format=csv&period=2018-03")
+
+		assert.EqualValues("text/csv", recorder.Header().Get(contentTypeKey))
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		assert.Len(lines, 3)
+		assert.EqualValues("other,2018-03,GET,1,1,1,0,0.0000,0", lines[1])
+	})
+
+	t.Run("BadPeriod", func(t *testing.T) {
+		assert.EqualValues(t, http.StatusBadRequest, serve("partner", "period=yesterday").Code)
+	})
+}
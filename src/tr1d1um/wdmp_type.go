@@ -32,6 +32,9 @@ const (
 	HeaderWPASyncNewCID = "X-Webpa-Sync-New-Cid"
 	HeaderWPASyncCMC    = "X-Webpa-Sync-Cmc"
 	HeaderWPATID        = "X-WebPA-Transaction-Id"
+	HeaderTr1d1umUndo   = "X-Tr1d1um-Capture-Undo"
+	HeaderIdempotency   = "Idempotency-Key"
+	HeaderReplayed      = "Idempotent-Replayed"
 
 	ErrUnsuccessfulDataParse = "Unsuccessful Data Parse"
 )